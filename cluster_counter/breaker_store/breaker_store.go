@@ -0,0 +1,387 @@
+package breaker_store
+
+import (
+	"context"
+	"errors"
+	"github.com/boostlearn/go-cluster-limiter/cluster_counter"
+	"reflect"
+	"sync"
+	"time"
+)
+
+const DefaultFailureThreshold = 5
+const DefaultOpenIntervalSeconds = 10
+const DefaultHalfOpenSuccesses = 1
+
+var ErrCircuitOpen = errors.New("store circuit breaker is open")
+
+type BreakerState int
+
+const (
+	StateClosed BreakerState = iota
+	StateOpen
+	StateHalfOpen
+)
+
+func (state BreakerState) String() string {
+	switch state {
+	case StateClosed:
+		return "closed"
+	case StateOpen:
+		return "open"
+	case StateHalfOpen:
+		return "half-open"
+	}
+	return "unknown"
+}
+
+// options for creating breaker store
+type BreakerStoreOpts struct {
+	// consecutive failures to open the circuit
+	FailureThreshold int
+	// waiting time before probing the store again
+	OpenInterval time.Duration
+	// consecutive successful probes to close the circuit
+	HalfOpenSuccesses int
+	// source of time, should be the same as counters', default is cluster_counter.RealClock
+	Clock cluster_counter.Clock
+}
+
+// store wrapper: fail fast while the wrapped store is unavailable,
+// counters then run in degraded mode and extrapolate cluster's data from local traffic, see ClusterCounter.Degraded
+type BreakerStore struct {
+	mu           sync.Mutex
+	store        cluster_counter.DataStoreI
+	storeV2      cluster_counter.DataStoreV2I
+	batchStoreV2 cluster_counter.BatchDataStoreV2I
+
+	failureThreshold  int
+	openInterval      time.Duration
+	halfOpenSuccesses int
+	clock             cluster_counter.Clock
+
+	state     BreakerState
+	failures  int
+	successes int
+	openTime  time.Time
+	probing   bool
+}
+
+// wrap store with circuit breaker
+func NewStore(store cluster_counter.DataStoreI, opts *BreakerStoreOpts) (*BreakerStore, error) {
+	if store == nil {
+		return nil, errors.New("store cannot be nil")
+	}
+
+	if opts == nil {
+		opts = &BreakerStoreOpts{}
+	}
+
+	if opts.FailureThreshold <= 0 {
+		opts.FailureThreshold = DefaultFailureThreshold
+	}
+
+	if opts.OpenInterval == 0 {
+		opts.OpenInterval = DefaultOpenIntervalSeconds * time.Second
+	}
+
+	if opts.HalfOpenSuccesses <= 0 {
+		opts.HalfOpenSuccesses = DefaultHalfOpenSuccesses
+	}
+
+	clock := opts.Clock
+	if clock == nil || reflect.ValueOf(clock).IsNil() {
+		clock = cluster_counter.RealClock
+	}
+
+	return &BreakerStore{
+		store:             store,
+		storeV2:           cluster_counter.NewStoreV2(store),
+		batchStoreV2:      cluster_counter.NewBatchStoreV2(store),
+		failureThreshold:  opts.FailureThreshold,
+		openInterval:      opts.OpenInterval,
+		halfOpenSuccesses: opts.HalfOpenSuccesses,
+		clock:             clock,
+	}, nil
+}
+
+// store client's data within cluster
+func (store *BreakerStore) Store(name string, beginTime time.Time, endTime time.Time, lbs map[string]string,
+	value cluster_counter.CounterValue, force bool) error {
+	if store.allow() == false {
+		return ErrCircuitOpen
+	}
+
+	err := store.store.Store(name, beginTime, endTime, lbs, value, force)
+	store.done(err == nil)
+	return err
+}
+
+// store client's data once for token, if the wrapped store supports it
+func (store *BreakerStore) StoreOnce(token string, name string, beginTime time.Time, endTime time.Time,
+	lbs map[string]string, value cluster_counter.CounterValue, force bool) error {
+	if store.allow() == false {
+		return ErrCircuitOpen
+	}
+
+	err := storeOnce(store.store, token, name, beginTime, endTime, lbs, value, force)
+	store.done(err == nil)
+	return err
+}
+
+// load cluster's data for clients
+func (store *BreakerStore) Load(name string, beginTime time.Time, endTime time.Time, lbs map[string]string,
+) (cluster_counter.CounterValue, error) {
+	if store.allow() == false {
+		return cluster_counter.CounterValue{}, ErrCircuitOpen
+	}
+
+	value, err := store.store.Load(name, beginTime, endTime, lbs)
+	store.done(err == nil)
+	return value, err
+}
+
+// set value if absent through the wrapped store, which should be able to, see cluster_counter.CanSetIfAbsent
+func (store *BreakerStore) SetIfAbsent(name string, beginTime time.Time, endTime time.Time, lbs map[string]string,
+	value cluster_counter.CounterValue) (cluster_counter.CounterValue, error) {
+	setStore, ok := store.store.(cluster_counter.SetIfAbsentDataStoreI)
+	if ok == false {
+		return cluster_counter.CounterValue{}, errors.New("wrapped store cannot set values if absent")
+	}
+	if store.allow() == false {
+		return cluster_counter.CounterValue{}, ErrCircuitOpen
+	}
+
+	kept, err := setStore.SetIfAbsent(name, beginTime, endTime, lbs, value)
+	store.done(err == nil)
+	return kept, err
+}
+
+// the wrapped store
+func (store *BreakerStore) Unwrap() cluster_counter.DataStoreI {
+	return store.store
+}
+
+// store with context through the wrapped store, keeping kinds of its errors. only transient errors open the circuit
+func (store *BreakerStore) StoreV2(ctx context.Context, nodeID string, item *cluster_counter.StoreItem) error {
+	if store.allow() == false {
+		return cluster_counter.NewTransientError(ErrCircuitOpen)
+	}
+
+	err := store.storeV2.StoreV2(ctx, nodeID, item)
+	store.done(cluster_counter.IsTransient(err) == false)
+	return err
+}
+
+// load with context through the wrapped store, see StoreV2
+func (store *BreakerStore) LoadV2(ctx context.Context, nodeID string, key *cluster_counter.StoreKey,
+) (cluster_counter.CounterValue, error) {
+	if store.allow() == false {
+		return cluster_counter.CounterValue{}, cluster_counter.NewTransientError(ErrCircuitOpen)
+	}
+
+	value, err := store.storeV2.LoadV2(ctx, nodeID, key)
+	store.done(cluster_counter.IsTransient(err) == false)
+	return value, err
+}
+
+// store several counters' data, the batch fails when all items fail
+func (store *BreakerStore) StoreBatch(items []*cluster_counter.StoreItem) []error {
+	errs := make([]error, len(items))
+	if store.allow() == false {
+		for i := range errs {
+			errs[i] = ErrCircuitOpen
+		}
+		return errs
+	}
+
+	if batchStore, ok := store.store.(cluster_counter.BatchDataStoreI); ok {
+		errs = batchStore.StoreBatch(items)
+	} else {
+		for i, item := range items {
+			errs[i] = storeOnce(store.store, item.Token, item.Name, item.BeginTime, item.EndTime, item.Labels,
+				item.Value, item.Force)
+		}
+	}
+	store.done(allFailed(errs) == false)
+	return errs
+}
+
+// load several counters' data, the batch fails when all items fail
+func (store *BreakerStore) LoadBatch(keys []*cluster_counter.StoreKey) ([]cluster_counter.CounterValue, []error) {
+	values := make([]cluster_counter.CounterValue, len(keys))
+	errs := make([]error, len(keys))
+	if store.allow() == false {
+		for i := range errs {
+			errs[i] = ErrCircuitOpen
+		}
+		return values, errs
+	}
+
+	if batchStore, ok := store.store.(cluster_counter.BatchDataStoreI); ok {
+		values, errs = batchStore.LoadBatch(keys)
+	} else {
+		for i, key := range keys {
+			values[i], errs[i] = store.store.Load(key.Name, key.BeginTime, key.EndTime, key.Labels)
+		}
+	}
+	store.done(allFailed(errs) == false)
+	return values, errs
+}
+
+// store several counters' data with context, the batch fails when all items fail transiently
+func (store *BreakerStore) StoreBatchV2(ctx context.Context, nodeID string, items []*cluster_counter.StoreItem,
+) []error {
+	errs := make([]error, len(items))
+	if store.allow() == false {
+		for i := range errs {
+			errs[i] = cluster_counter.NewTransientError(ErrCircuitOpen)
+		}
+		return errs
+	}
+
+	errs = store.batchStoreV2.StoreBatchV2(ctx, nodeID, items)
+	store.done(allTransient(errs) == false)
+	return errs
+}
+
+// load several counters' data with context, see StoreBatchV2
+func (store *BreakerStore) LoadBatchV2(ctx context.Context, nodeID string, keys []*cluster_counter.StoreKey,
+) ([]cluster_counter.CounterValue, []error) {
+	values := make([]cluster_counter.CounterValue, len(keys))
+	errs := make([]error, len(keys))
+	if store.allow() == false {
+		for i := range errs {
+			errs[i] = cluster_counter.NewTransientError(ErrCircuitOpen)
+		}
+		return values, errs
+	}
+
+	values, errs = store.batchStoreV2.LoadBatchV2(ctx, nodeID, keys)
+	store.done(allTransient(errs) == false)
+	return values, errs
+}
+
+// windows of counters in the wrapped store, none if it cannot list keys
+func (store *BreakerStore) ListKeys(namePrefix string) ([]*cluster_counter.StoreKey, error) {
+	if adminStore, ok := store.store.(cluster_counter.AdminDataStoreI); ok {
+		return adminStore.ListKeys(namePrefix)
+	}
+	return nil, nil
+}
+
+// remove counter's window from the wrapped store, if it can delete keys
+func (store *BreakerStore) Delete(key *cluster_counter.StoreKey) error {
+	if adminStore, ok := store.store.(cluster_counter.AdminDataStoreI); ok {
+		return adminStore.Delete(key)
+	}
+	return nil
+}
+
+// remove counters' windows from the wrapped store in one call if it supports that, else one by one
+func (store *BreakerStore) DeleteBatch(keys []*cluster_counter.StoreKey) error {
+	if batchStore, ok := store.store.(cluster_counter.BatchAdminDataStoreI); ok {
+		return batchStore.DeleteBatch(keys)
+	}
+	for _, key := range keys {
+		if err := store.Delete(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// whether the wrapped store is considered unavailable
+func (store *BreakerStore) Degraded() bool {
+	return store.State() != StateClosed
+}
+
+// current state of circuit
+func (store *BreakerStore) State() BreakerState {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	return store.state
+}
+
+// whether the call can go through, only one probe at a time when half open
+func (store *BreakerStore) allow() bool {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	switch store.state {
+	case StateOpen:
+		if store.clock.Now().Before(store.openTime.Add(store.openInterval)) {
+			return false
+		}
+		store.state = StateHalfOpen
+		store.successes = 0
+		store.probing = true
+		return true
+	case StateHalfOpen:
+		if store.probing {
+			return false
+		}
+		store.probing = true
+		return true
+	}
+	return true
+}
+
+// record call's result
+func (store *BreakerStore) done(success bool) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	if store.state == StateHalfOpen {
+		store.probing = false
+		if success == false {
+			store.state = StateOpen
+			store.openTime = store.clock.Now()
+			return
+		}
+		store.successes += 1
+		if store.successes >= store.halfOpenSuccesses {
+			store.state = StateClosed
+			store.failures = 0
+		}
+		return
+	}
+
+	if success {
+		store.failures = 0
+		return
+	}
+
+	store.failures += 1
+	if store.state == StateClosed && store.failures >= store.failureThreshold {
+		store.state = StateOpen
+		store.openTime = store.clock.Now()
+	}
+}
+
+func storeOnce(store cluster_counter.DataStoreI, token string, name string, beginTime time.Time,
+	endTime time.Time, lbs map[string]string, value cluster_counter.CounterValue, force bool) error {
+	if idempotentStore, ok := store.(cluster_counter.IdempotentDataStoreI); ok && len(token) > 0 {
+		return idempotentStore.StoreOnce(token, name, beginTime, endTime, lbs, value, force)
+	}
+	return store.Store(name, beginTime, endTime, lbs, value, force)
+}
+
+func allFailed(errs []error) bool {
+	for _, err := range errs {
+		if err == nil {
+			return false
+		}
+	}
+	return len(errs) > 0
+}
+
+func allTransient(errs []error) bool {
+	for _, err := range errs {
+		if cluster_counter.IsTransient(err) == false {
+			return false
+		}
+	}
+	return len(errs) > 0
+}
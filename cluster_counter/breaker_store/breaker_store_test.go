@@ -0,0 +1,150 @@
+package breaker_store
+
+import (
+	"context"
+	"errors"
+	"github.com/boostlearn/go-cluster-limiter/cluster_counter"
+	"github.com/boostlearn/go-cluster-limiter/cluster_counter/clocktest"
+	"github.com/boostlearn/go-cluster-limiter/cluster_counter/memory_store"
+	"testing"
+	"time"
+)
+
+type failingStore struct {
+	fail  bool
+	calls int
+	// returned by Store if set
+	storeErr error
+}
+
+func (store *failingStore) Store(name string, beginTime time.Time, endTime time.Time, lbs map[string]string,
+	value cluster_counter.CounterValue, force bool) error {
+	store.calls++
+	if store.fail {
+		return errors.New("store unavailable")
+	}
+	return store.storeErr
+}
+
+func (store *failingStore) Load(name string, beginTime time.Time, endTime time.Time, lbs map[string]string,
+) (cluster_counter.CounterValue, error) {
+	store.calls++
+	if store.fail {
+		return cluster_counter.CounterValue{}, errors.New("store unavailable")
+	}
+	return cluster_counter.CounterValue{Sum: 1, Count: 1}, nil
+}
+
+func TestBreakerStore_OpenAndRecover(t *testing.T) {
+	inner := &failingStore{fail: true}
+	clock := clocktest.NewFakeClock(time.Now())
+	store, _ := NewStore(inner, &BreakerStoreOpts{FailureThreshold: 3, OpenInterval: 50 * time.Millisecond, Clock: clock})
+
+	for i := 0; i < 3; i++ {
+		_, _ = store.Load("test", time.Time{}, time.Time{}, nil)
+	}
+	if store.State() != StateOpen || store.Degraded() == false {
+		t.Fatal("circuit should be open", store.State())
+	}
+
+	_, err := store.Load("test", time.Time{}, time.Time{}, nil)
+	if err != ErrCircuitOpen || inner.calls != 3 {
+		t.Fatal("open circuit should fail fast", err, inner.calls)
+	}
+
+	clock.Advance(60 * time.Millisecond)
+	inner.fail = false
+	v, err := store.Load("test", time.Time{}, time.Time{}, nil)
+	if err != nil || v.Count != 1 {
+		t.Fatal("half open probe should go through", err)
+	}
+	if store.State() != StateClosed {
+		t.Fatal("circuit should be closed after successful probe", store.State())
+	}
+}
+
+func TestBreakerStore_StoreV2(t *testing.T) {
+	inner := &failingStore{storeErr: cluster_counter.NewPermanentError(errors.New("WRONGTYPE"))}
+	store, _ := NewStore(inner, &BreakerStoreOpts{FailureThreshold: 1})
+	storeV2 := cluster_counter.NewStoreV2(store)
+
+	// kind of wrapped store's error is kept, and the store answering it is available
+	if err := storeV2.StoreV2(context.Background(), "n1", &cluster_counter.StoreItem{}); cluster_counter.IsPermanent(err) == false {
+		t.Fatal("permanent error should stay permanent", err)
+	}
+	if store.State() != StateClosed {
+		t.Fatal("permanent error should not open circuit", store.State())
+	}
+
+	inner.fail = true
+	_ = storeV2.StoreV2(context.Background(), "n1", &cluster_counter.StoreItem{})
+	if err := storeV2.StoreV2(context.Background(), "n1", &cluster_counter.StoreItem{}); cluster_counter.IsTransient(err) == false ||
+		errors.Is(err, ErrCircuitOpen) == false {
+		t.Fatal("open circuit should be transient error", err)
+	}
+}
+
+func TestBreakerStore_CounterDegraded(t *testing.T) {
+	inner := &failingStore{fail: true}
+	clock := clocktest.NewFakeClock(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	store, _ := NewStore(inner, &BreakerStoreOpts{FailureThreshold: 1, Clock: clock})
+
+	factory := cluster_counter.NewFactory(&cluster_counter.ClusterCounterFactoryOpts{Store: store, Clock: clock})
+	factory.Stop()
+	counter, _ := factory.NewClusterCounter(&cluster_counter.ClusterCounterOpts{
+		Name:                       "test",
+		ResetInterval:              time.Hour,
+		InitLocalTrafficProportion: 0.5,
+	})
+
+	if counter.Degraded() == false {
+		t.Fatal("counter should be degraded")
+	}
+
+	counter.Add(1)
+	v, _ := counter.ClusterValue(0)
+	if v.Sum != 2 {
+		t.Fatal("cluster value should be extrapolated from local traffic", v)
+	}
+
+	clock.Advance(10 * time.Second)
+	if counter.Staleness() != 10*time.Second {
+		t.Fatal("staleness should count from initialization without any load", counter.Staleness())
+	}
+
+	// circuit is probed again after open interval of counters' clock
+	inner.fail = false
+	factory.Heartbeat()
+	if counter.Degraded() {
+		t.Fatal("counter should recover after probe", store.State())
+	}
+}
+
+func TestBreakerStore_Purge(t *testing.T) {
+	memoryStore := memory_store.NewStore()
+	store, _ := NewStore(memoryStore, &BreakerStoreOpts{})
+	factory := cluster_counter.NewFactory(&cluster_counter.ClusterCounterFactoryOpts{Store: store})
+	factory.Stop()
+
+	counter, _ := factory.NewClusterCounter(&cluster_counter.ClusterCounterOpts{Name: "test", ResetInterval: time.Hour})
+	counter.Add(1)
+	counter.StoreData()
+	if keys, _ := store.ListKeys("test"); len(keys) != 1 {
+		t.Fatal("keys of wrapped store should be listed", keys)
+	}
+
+	if err := factory.Purge("test"); err != nil {
+		t.Fatal(err)
+	}
+	if keys, _ := memoryStore.ListKeys("test"); len(keys) != 0 {
+		t.Fatal("keys of wrapped store should be deleted", keys)
+	}
+
+	// wrapped store without admin support keeps its data
+	store, _ = NewStore(&failingStore{}, &BreakerStoreOpts{})
+	factory = cluster_counter.NewFactory(&cluster_counter.ClusterCounterFactoryOpts{Store: store})
+	factory.Stop()
+	if err := factory.Purge("test"); err != nil {
+		t.Fatal("purge should be no-op", err)
+	}
+}
@@ -0,0 +1,93 @@
+// manual clock for driving counters and limiters in tests
+package clocktest
+
+import (
+	"github.com/boostlearn/go-cluster-limiter/cluster_counter"
+	"sync"
+	"time"
+)
+
+// clock moved only by Advance and Set
+type FakeClock struct {
+	mu      sync.Mutex
+	now     time.Time
+	tickers []*fakeTicker
+}
+
+// build new clock starting at now
+func NewFakeClock(now time.Time) *FakeClock {
+	return &FakeClock{now: now}
+}
+
+func (clock *FakeClock) Now() time.Time {
+	clock.mu.Lock()
+	defer clock.mu.Unlock()
+
+	return clock.now
+}
+
+func (clock *FakeClock) NewTicker(d time.Duration) cluster_counter.Ticker {
+	if d <= 0 {
+		panic("non-positive interval for NewTicker")
+	}
+
+	clock.mu.Lock()
+	defer clock.mu.Unlock()
+
+	ticker := &fakeTicker{
+		clock:    clock,
+		c:        make(chan time.Time, 1),
+		interval: d,
+		next:     clock.now.Add(d),
+	}
+	clock.tickers = append(clock.tickers, ticker)
+	return ticker
+}
+
+// move clock forward by d, tickers due meanwhile fire; like time.Ticker, ticks are dropped for slow receivers
+func (clock *FakeClock) Advance(d time.Duration) {
+	clock.Set(clock.Now().Add(d))
+}
+
+// move clock to now, never backwards
+func (clock *FakeClock) Set(now time.Time) {
+	clock.mu.Lock()
+	defer clock.mu.Unlock()
+
+	if now.Before(clock.now) {
+		return
+	}
+	clock.now = now
+
+	for _, ticker := range clock.tickers {
+		if ticker.stopped || ticker.next.After(now) {
+			continue
+		}
+		for ticker.next.After(now) == false {
+			ticker.next = ticker.next.Add(ticker.interval)
+		}
+		select {
+		case ticker.c <- now:
+		default:
+		}
+	}
+}
+
+type fakeTicker struct {
+	clock    *FakeClock
+	c        chan time.Time
+	interval time.Duration
+	next     time.Time
+	stopped  bool
+}
+
+func (ticker *fakeTicker) C() <-chan time.Time {
+	return ticker.c
+}
+
+func (ticker *fakeTicker) Stop() {
+	ticker.clock.mu.Lock()
+	defer ticker.clock.mu.Unlock()
+
+	ticker.stopped = true
+}
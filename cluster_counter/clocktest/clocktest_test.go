@@ -0,0 +1,36 @@
+package clocktest
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFakeClock_Ticker(t *testing.T) {
+	clock := NewFakeClock(time.Unix(0, 0))
+	ticker := clock.NewTicker(time.Second)
+
+	clock.Advance(500 * time.Millisecond)
+	select {
+	case <-ticker.C():
+		t.Fatal("ticker should not fire before interval")
+	default:
+	}
+
+	clock.Advance(3 * time.Second)
+	if now := <-ticker.C(); now.Equal(time.Unix(3, 5e8)) == false {
+		t.Fatal("tick time error", now)
+	}
+	select {
+	case <-ticker.C():
+		t.Fatal("missed ticks should be dropped")
+	default:
+	}
+
+	ticker.Stop()
+	clock.Advance(time.Minute)
+	select {
+	case <-ticker.C():
+		t.Fatal("stopped ticker should not fire")
+	default:
+	}
+}
@@ -1,9 +1,11 @@
 package cluster_counter
 
 import (
+	"context"
+	"fmt"
 	"reflect"
-
-	//"fmt"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 )
@@ -29,6 +31,7 @@ type ClusterCounter struct {
 	beginTime     time.Time
 	endTime       time.Time
 	resetInterval time.Duration
+	schedule      *Schedule
 
 	storeInterval time.Duration
 
@@ -38,6 +41,10 @@ type ClusterCounter struct {
 	storeLocalHistory [HistoryMax]CounterValue
 	storeTimeHistory  [HistoryMax]time.Time
 	lastStoreValue    CounterValue
+	inflightValue     CounterValue
+
+	lastCheckpointValue CounterValue
+	lastStoreError      error
 
 	discardPreviousData bool
 	loadInitValue       CounterValue
@@ -45,6 +52,8 @@ type ClusterCounter struct {
 
 	loadHistoryPos     int64
 	lastLoadTime       time.Time
+	lastLoadFailed     bool
+	lastLoadedTime     time.Time
 	loadTimeHistory    [HistoryMax]time.Time
 	loadLocalHistory   [HistoryMax]CounterValue
 	loadClusterHistory [HistoryMax]CounterValue
@@ -62,14 +71,13 @@ func (counter *ClusterCounter) Initialize() {
 	counter.mu.Lock()
 	defer counter.mu.Unlock()
 
-	timeNow := time.Now()
+	timeNow := counter.now()
 	counter.initTime = timeNow
 	counter.expired = false
 
 	counter.resetInterval = counter.resetInterval.Truncate(time.Second)
-	if counter.resetInterval > 0 {
-		counter.beginTime = timeNow.Truncate(counter.resetInterval)
-		counter.endTime = counter.beginTime.Add(counter.resetInterval)
+	if Periodic(counter.resetInterval, counter.schedule) {
+		counter.beginTime, counter.endTime = counter.period(timeNow)
 	}
 
 	if counter.initLocalTrafficProportion == 0.0 {
@@ -86,16 +94,23 @@ func (counter *ClusterCounter) Initialize() {
 
 	if counter.factory != nil && counter.factory.Store != nil && reflect.ValueOf(counter.factory.Store).IsNil() == false {
 		counter.mu.Unlock()
-		value, err := counter.factory.Store.Load(counter.name, counter.beginTime, counter.endTime, counter.lbs)
+		value, err := counter.factory.loadKey(&StoreKey{
+			Name:      counter.name,
+			BeginTime: counter.beginTime,
+			EndTime:   counter.endTime,
+			Labels:    counter.lbs,
+		})
 		counter.mu.Lock()
 
+		counter.lastLoadFailed = err != nil
 		if err == nil {
 			counter.loadClusterHistory[(counter.loadHistoryPos)%HistoryMax] = value
 			counter.loadLocalHistory[(counter.loadHistoryPos)%HistoryMax] = CounterValue{}
-			counter.loadTimeHistory[(counter.loadHistoryPos)%HistoryMax] = time.Now()
+			counter.loadTimeHistory[(counter.loadHistoryPos)%HistoryMax] = counter.now()
 			counter.loadHistoryPos += 1
 			counter.loadInitValue = value
 			counter.hasInitValue = true
+			counter.lastLoadedTime = timeNow
 			counter.lastLoadTime = timeNow.Truncate(counter.storeInterval.Truncate(counter.storeInterval)).Add(counter.storeInterval / 2)
 			return
 		}
@@ -117,27 +132,50 @@ func (counter *ClusterCounter) Expire() bool {
 	counter.mu.Lock()
 	defer counter.mu.Unlock()
 
-	timeNow := time.Now()
-	if counter.resetInterval > 0 {
+	timeNow := counter.now()
+	if Periodic(counter.resetInterval, counter.schedule) {
 		if timeNow.After(counter.endTime) {
 			//fmt.Println(timeNow.Format("2006-01-02 15:04:05 .9999"), counter.endTime.Format("2006-01-02 15:04:05 .9999"))
 			lastBeginTime := counter.beginTime
 			lastEndTime := counter.endTime
-			counter.beginTime = timeNow.Truncate(counter.resetInterval)
-			counter.endTime = counter.beginTime.Add(counter.resetInterval)
+			counter.beginTime, counter.endTime = counter.period(timeNow)
 
 			pushValue := counter.localValue.Sub(counter.lastStoreValue)
+			pushValue = pushValue.Sub(counter.inflightValue)
 			counter.localValue = CounterValue{}
 			counter.lastStoreValue = CounterValue{}
+			counter.inflightValue = CounterValue{}
+			counter.lastCheckpointValue = CounterValue{}
 			counter.loadHistoryPos = 0
 			counter.loadInitValue = CounterValue{}
 			counter.storeHistoryPos = 0
-			if pushValue.Count > 0 && counter.factory != nil && counter.factory.Store != nil &&
+			if (pushValue.Count != 0 || pushValue.Sum != 0) && counter.factory != nil && counter.factory.Store != nil &&
 				reflect.ValueOf(counter.factory.Store).IsNil() == false {
+				item := &StoreItem{
+					StoreKey: StoreKey{
+						Name:      counter.name,
+						BeginTime: lastBeginTime,
+						EndTime:   lastEndTime,
+						Labels:    counter.lbs,
+					},
+					Value:  pushValue,
+					Force:  true,
+					Reason: StoreReasonExpire,
+				}
+				if counter.factory.journal != nil {
+					item.Token = counter.factory.journal.newToken()
+				}
+
 				counter.mu.Unlock()
-				_ = counter.factory.Store.Store(counter.name, lastBeginTime, lastEndTime, counter.lbs,
-					pushValue, true)
+				err := counter.factory.storeItem(counter.factory.ctx, item)
+				// transient failure stays in journal and is replayed on next startup
+				if (err == nil || IsPermanent(err)) && counter.factory.journal != nil {
+					_ = counter.factory.journal.finish(item, nil)
+				}
 				counter.mu.Lock()
+				if err != nil {
+					counter.lastStoreError = err
+				}
 			}
 		}
 		return false
@@ -147,12 +185,29 @@ func (counter *ClusterCounter) Expire() bool {
 	}
 }
 
+// window containing t, or the next one of schedule if t is not active
+func (counter *ClusterCounter) period(t time.Time) (time.Time, time.Time) {
+	if counter.schedule != nil {
+		return counter.schedule.Period(t)
+	}
+	beginTime := t.Truncate(counter.resetInterval)
+	return beginTime, beginTime.Add(counter.resetInterval)
+}
+
+// time of factory's clock
+func (counter *ClusterCounter) now() time.Time {
+	if counter.factory != nil && counter.factory.clock != nil {
+		return counter.factory.clock.Now()
+	}
+	return time.Now()
+}
+
 // add value into counter
 func (counter *ClusterCounter) Add(v float64) {
 	counter.mu.RLock()
 	defer counter.mu.RUnlock()
 
-	timeNow := time.Now()
+	timeNow := counter.now()
 	if timeNow.Before(counter.beginTime) || timeNow.After(counter.endTime) {
 		return
 	}
@@ -161,6 +216,22 @@ func (counter *ClusterCounter) Add(v float64) {
 	counter.localValue.Count += 1
 }
 
+// take back value added at addTime, e.g. a pass which is cancelled.
+// dropped if addTime is not within current window, as the value of a finished window is already stored
+func (counter *ClusterCounter) Refund(v float64, addTime time.Time) {
+	counter.mu.RLock()
+	defer counter.mu.RUnlock()
+
+	timeNow := counter.now()
+	if timeNow.Before(counter.beginTime) || timeNow.After(counter.endTime) ||
+		addTime.Before(counter.beginTime) || addTime.After(counter.endTime) {
+		return
+	}
+
+	counter.localValue.Sum -= v
+	counter.localValue.Count -= 1
+}
+
 // get local value
 // last: A negative number represents the query history data
 func (counter *ClusterCounter) LocalValue(last int) (CounterValue, time.Time) {
@@ -168,7 +239,7 @@ func (counter *ClusterCounter) LocalValue(last int) (CounterValue, time.Time) {
 	defer counter.mu.RUnlock()
 
 	if last == 0 {
-		return counter.localValue, time.Now()
+		return counter.localValue, counter.now()
 	}
 	if last < 0 && last > -HistoryMax && int64(last) > -counter.loadHistoryPos {
 		return counter.loadLocalHistory[(counter.loadHistoryPos+int64(last)+HistoryMax)%HistoryMax],
@@ -184,7 +255,7 @@ func (counter *ClusterCounter) LocalStoreValue(last int) (CounterValue, time.Tim
 	defer counter.mu.RUnlock()
 
 	if last == 0 {
-		return counter.localValue, time.Now()
+		return counter.localValue, counter.now()
 	}
 	if last < 0 && last > -HistoryMax && int64(last) > -counter.storeHistoryPos {
 		return counter.storeLocalHistory[(counter.storeHistoryPos+int64(last)+HistoryMax)%HistoryMax],
@@ -219,7 +290,7 @@ func (counter *ClusterCounter) ClusterValue(last int) (CounterValue, time.Time)
 		if counter.discardPreviousData {
 			clusterPred = clusterPred.Sub(counter.loadInitValue)
 		}
-		return clusterPred, time.Now()
+		return clusterPred, counter.now()
 	}
 
 	if last < 0 && last > -HistoryMax && int64(last) > -counter.loadHistoryPos {
@@ -260,6 +331,32 @@ func (counter *ClusterCounter) LocalTrafficProportion() float64 {
 	return counter.localTrafficProportion
 }
 
+// whether cluster's data can not be loaded now.
+// ClusterValue then keeps adding local traffic since the last successful load, scaled by
+// LocalTrafficProportion, which is only updated by loads and so stays at its last known value;
+// the estimate drifts as other clients' traffic changes, see Staleness
+func (counter *ClusterCounter) Degraded() bool {
+	counter.mu.RLock()
+	defer counter.mu.RUnlock()
+
+	if counter.factory != nil && counter.factory.Degraded() {
+		return true
+	}
+	return counter.lastLoadFailed
+}
+
+// time since cluster's data was last loaded, or since initialization if it never was
+func (counter *ClusterCounter) Staleness() time.Duration {
+	counter.mu.RLock()
+	defer counter.mu.RUnlock()
+
+	lastLoadedTime := counter.lastLoadedTime
+	if lastLoadedTime.IsZero() {
+		lastLoadedTime = counter.initTime
+	}
+	return counter.now().Sub(lastLoadedTime)
+}
+
 func (counter *ClusterCounter) LoadHistorySize() int {
 	if counter.loadHistoryPos < HistoryMax {
 		return int(counter.loadHistoryPos)
@@ -287,46 +384,67 @@ func (counter *ClusterCounter) LoadData() bool {
 	counter.mu.Lock()
 	defer counter.mu.Unlock()
 
+	timeNow := counter.now()
+	key := counter.prepareLoad(timeNow)
+	if key == nil {
+		return false
+	}
+
+	counter.mu.Unlock()
+	value, err := counter.factory.loadKey(key)
+	counter.mu.Lock()
+
+	return counter.finishLoad(timeNow, value, err)
+}
+
+// key to load if loading is due, called with lock held
+func (counter *ClusterCounter) prepareLoad(timeNow time.Time) *StoreKey {
 	if counter.factory == nil || counter.factory.Store == nil ||
 		reflect.ValueOf(counter.factory.Store).IsNil() == true {
-		return false
+		return nil
 	}
 
-	timeNow := time.Now()
 	if timeNow.Before(counter.beginTime) || timeNow.After(counter.endTime) {
-		return false
+		return nil
 	}
 
 	if counter.storeInterval > 0 && (counter.loadHistoryPos == 0 ||
 		timeNow.After(counter.lastLoadTime.Add(counter.storeInterval))) {
-		counter.mu.Unlock()
-		value, err := counter.factory.Store.Load(counter.name, counter.beginTime, counter.endTime,
-			counter.lbs)
-		counter.mu.Lock()
-
-		if err != nil {
-			return false
+		return &StoreKey{
+			Name:      counter.name,
+			BeginTime: counter.beginTime,
+			EndTime:   counter.endTime,
+			Labels:    counter.lbs,
 		}
+	}
+	return nil
+}
 
-		if counter.loadHistoryPos > 0 {
-			counter.loadLocalHistory[counter.loadHistoryPos%HistoryMax] = counter.storeLocalHistory[(counter.storeHistoryPos+-1+HistoryMax)%HistoryMax]
-		} else {
-			counter.loadLocalHistory[counter.loadHistoryPos%HistoryMax] = CounterValue{}
-		}
+// record loaded value, called with lock held
+func (counter *ClusterCounter) finishLoad(timeNow time.Time, value CounterValue, err error) bool {
+	counter.lastLoadFailed = err != nil
+	if err != nil {
+		return false
+	}
 
-		if counter.hasInitValue == false {
-			counter.loadInitValue = value
-			counter.hasInitValue = true
-		}
+	if counter.loadHistoryPos > 0 {
+		counter.loadLocalHistory[counter.loadHistoryPos%HistoryMax] = counter.storeLocalHistory[(counter.storeHistoryPos+-1+HistoryMax)%HistoryMax]
+	} else {
+		counter.loadLocalHistory[counter.loadHistoryPos%HistoryMax] = CounterValue{}
+	}
 
-		counter.loadClusterHistory[counter.loadHistoryPos%HistoryMax] = value
-		counter.loadTimeHistory[counter.loadHistoryPos%HistoryMax] = time.Now()
-		counter.lastLoadTime = timeNow.Truncate(counter.storeInterval.Truncate(counter.storeInterval)).Add(counter.storeInterval / 2)
-		counter.loadHistoryPos += 1
-		counter.updateLocalTrafficProportion()
-		return true
+	if counter.hasInitValue == false {
+		counter.loadInitValue = value
+		counter.hasInitValue = true
 	}
-	return false
+
+	counter.loadClusterHistory[counter.loadHistoryPos%HistoryMax] = value
+	counter.loadTimeHistory[counter.loadHistoryPos%HistoryMax] = counter.now()
+	counter.lastLoadedTime = timeNow
+	counter.lastLoadTime = timeNow.Truncate(counter.storeInterval.Truncate(counter.storeInterval)).Add(counter.storeInterval / 2)
+	counter.loadHistoryPos += 1
+	counter.updateLocalTrafficProportion()
+	return true
 }
 
 func (counter *ClusterCounter) updateLocalTrafficProportion() {
@@ -359,18 +477,31 @@ func (counter *ClusterCounter) StoreData() bool {
 	counter.mu.Lock()
 	defer counter.mu.Unlock()
 
+	item := counter.prepareStore(counter.now())
+	if item == nil {
+		return false
+	}
+
+	counter.mu.Unlock()
+	err := counter.factory.storeItem(counter.factory.ctx, item)
+	counter.mu.Lock()
+
+	return counter.finishStore(item, err)
+}
+
+// data to store if storing is due, called with lock held
+func (counter *ClusterCounter) prepareStore(timeNow time.Time) *StoreItem {
 	if counter.factory == nil || counter.factory.Store == nil ||
 		reflect.ValueOf(counter.factory.Store).IsNil() == true {
-		return false
+		return nil
 	}
 
-	timeNow := time.Now()
 	if timeNow.Before(counter.beginTime) || timeNow.After(counter.endTime) {
-		return false
+		return nil
 	}
 
 	if counter.hasInitValue == false {
-		return false
+		return nil
 	}
 
 	if counter.storeInterval > 0 && (counter.storeHistoryPos == 0 ||
@@ -382,17 +513,139 @@ func (counter *ClusterCounter) StoreData() bool {
 		counter.lastStoreTime = timeNow.Truncate(counter.storeInterval)
 
 		pushValue := counter.localValue.Sub(counter.lastStoreValue)
-		if pushValue.Count > 0 {
-			counter.mu.Unlock()
-			err := counter.factory.Store.Store(counter.name, counter.beginTime, counter.endTime, counter.lbs,
-				pushValue, false)
-			counter.mu.Lock()
-			if err == nil {
-				counter.lastStoreValue = counter.lastStoreValue.Add(pushValue)
-				return true
+		if pushValue.Count != 0 || pushValue.Sum != 0 {
+			item := &StoreItem{
+				StoreKey: StoreKey{
+					Name:      counter.name,
+					BeginTime: counter.beginTime,
+					EndTime:   counter.endTime,
+					Labels:    counter.lbs,
+				},
+				Value:  pushValue,
+				Reason: StoreReasonHeartbeat,
 			}
+			if counter.factory.journal != nil {
+				item.Token = counter.factory.journal.newToken()
+			}
+			counter.inflightValue = pushValue
+			counter.lastCheckpointValue = CounterValue{}
+			return item
+		}
+	}
+	return nil
+}
 
+// record stored value, called with lock held
+// transient failure is retried on next interval, value of permanent failure is dropped
+func (counter *ClusterCounter) finishStore(item *StoreItem, err error) bool {
+	permanent := IsPermanent(err)
+	if err != nil {
+		counter.lastStoreError = err
+	}
+	if counter.factory.journal != nil {
+		if permanent {
+			_ = counter.factory.journal.finish(item, nil)
+		} else {
+			_ = counter.factory.journal.finish(item, err)
 		}
 	}
-	return false
+	if item.BeginTime != counter.beginTime || item.EndTime != counter.endTime {
+		// window was reset by Expire meanwhile
+		return err == nil
+	}
+	counter.inflightValue = CounterValue{}
+	if err != nil && permanent == false {
+		return false
+	}
+	counter.lastStoreValue = counter.lastStoreValue.Add(item.Value)
+	return err == nil
+}
+
+// last error returned by store, nil if never failed
+func (counter *ClusterCounter) LastStoreError() error {
+	counter.mu.RLock()
+	defer counter.mu.RUnlock()
+
+	return counter.lastStoreError
+}
+
+// store all un-flushed local data now, regardless of store interval
+func (counter *ClusterCounter) Flush() error {
+	if counter.factory == nil {
+		return nil
+	}
+	return counter.flush(counter.factory.ctx)
+}
+
+func (counter *ClusterCounter) flush(ctx context.Context) error {
+	counter.mu.Lock()
+	defer counter.mu.Unlock()
+
+	if counter.factory == nil || counter.factory.Store == nil ||
+		reflect.ValueOf(counter.factory.Store).IsNil() == true {
+		return nil
+	}
+
+	pushValue := counter.localValue.Sub(counter.lastStoreValue)
+	pushValue = pushValue.Sub(counter.inflightValue)
+	if pushValue.Count == 0 && pushValue.Sum == 0 {
+		return nil
+	}
+
+	item := &StoreItem{
+		StoreKey: StoreKey{
+			Name:      counter.name,
+			BeginTime: counter.beginTime,
+			EndTime:   counter.endTime,
+			Labels:    counter.lbs,
+		},
+		Value:  pushValue,
+		Force:  true,
+		Reason: StoreReasonFlush,
+	}
+	if counter.factory.journal != nil {
+		item.Token = counter.factory.journal.newToken()
+	}
+	counter.inflightValue = pushValue
+	counter.lastCheckpointValue = CounterValue{}
+
+	counter.mu.Unlock()
+	err := counter.factory.storeItem(ctx, item)
+	counter.mu.Lock()
+
+	counter.finishStore(item, err)
+	return err
+}
+
+// name with labels, e.g. requests{code="200"}
+func (counter *ClusterCounter) fullName() string {
+	if len(counter.lbs) == 0 {
+		return counter.name
+	}
+
+	var labels []string
+	for k, v := range counter.lbs {
+		labels = append(labels, fmt.Sprintf("%v=%q", k, v))
+	}
+	sort.Strings(labels)
+	return counter.name + "{" + strings.Join(labels, ",") + "}"
+}
+
+// record un-flushed delta into journal if it changed, called with lock held
+func (counter *ClusterCounter) checkpoint(j *journal) {
+	pending := counter.localValue.Sub(counter.lastStoreValue)
+	pending = pending.Sub(counter.inflightValue)
+	if pending == counter.lastCheckpointValue {
+		return
+	}
+
+	err := j.checkpoint(StoreKey{
+		Name:      counter.name,
+		BeginTime: counter.beginTime,
+		EndTime:   counter.endTime,
+		Labels:    counter.lbs,
+	}, pending)
+	if err == nil {
+		counter.lastCheckpointValue = pending
+	}
 }
@@ -18,6 +18,7 @@ type ClusterCounterVec struct {
 	beginTime     time.Time
 	endTime       time.Time
 	resetInterval time.Duration
+	schedule      *Schedule
 
 	storeInterval              time.Duration
 	initLocalTrafficProportion float64
@@ -50,6 +51,7 @@ func (counterVec *ClusterCounterVec) WithLabelValues(lbs []string) *ClusterCount
 		beginTime:                  counterVec.beginTime,
 		endTime:                    counterVec.endTime,
 		resetInterval:              counterVec.resetInterval,
+		schedule:                   counterVec.schedule,
 		mu:                         sync.RWMutex{},
 		factory:                    counterVec.factory,
 		storeInterval:              counterVec.storeInterval,
@@ -74,6 +76,24 @@ func (counterVec *ClusterCounterVec) Heartbeat() {
 	})
 }
 
+// iterate counters with labels
+func (counterVec *ClusterCounterVec) rangeCounters(f func(counter *ClusterCounter) bool) {
+	counterVec.counters.Range(func(k interface{}, v interface{}) bool {
+		if counter, ok := v.(*ClusterCounter); ok {
+			return f(counter)
+		}
+		return true
+	})
+}
+
+// time of factory's clock
+func (counterVec *ClusterCounterVec) now() time.Time {
+	if counterVec.factory != nil && counterVec.factory.clock != nil {
+		return counterVec.factory.clock.Now()
+	}
+	return time.Now()
+}
+
 // check whether expired
 func (counterVec *ClusterCounterVec) Expire() bool {
 	counterVec.mu.RLock()
@@ -91,7 +111,13 @@ func (counterVec *ClusterCounterVec) Expire() bool {
 		return true
 	})
 
-	timeNow := time.Now().Truncate(time.Second)
+	timeNow := counterVec.now().Truncate(time.Second)
+	if counterVec.schedule != nil {
+		if timeNow.After(counterVec.endTime) {
+			counterVec.beginTime, counterVec.endTime = counterVec.schedule.Period(timeNow)
+		}
+		return false
+	}
 	if counterVec.resetInterval > 0 {
 		if timeNow.After(counterVec.endTime) {
 			counterVec.beginTime = timeNow.Truncate(counterVec.resetInterval)
@@ -1,7 +1,12 @@
 package cluster_counter
 
 import (
+	"context"
 	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
 	"sync"
 	"time"
 )
@@ -15,6 +20,8 @@ type ClusterCounterOpts struct {
 	BeginTime     time.Time
 	EndTime       time.Time
 	ResetInterval time.Duration
+	// windows follow schedule instead of BeginTime and EndTime or ResetInterval
+	Schedule *Schedule
 
 	DiscardPreviousData bool
 	StoreDataInterval   time.Duration
@@ -28,11 +35,29 @@ type ClusterCounterFactory struct {
 	name  string
 	Store DataStoreI
 
-	ticker            *time.Ticker
+	storeV2      DataStoreV2I
+	batchStoreV2 BatchDataStoreV2I // nil if store handles no batches
+	nodeID       string
+	storeTimeout time.Duration
+	ctx          context.Context
+	cancel       context.CancelFunc
+
+	clock             Clock
+	ticker            Ticker
 	heartbeatInterval time.Duration
+	done              chan struct{}
+	stopOnce          sync.Once
+	loopWg            sync.WaitGroup
+	heartbeatMu       sync.Mutex
+	closed            bool
 
 	clusterCounterVectors sync.Map
 	clusterCounters       sync.Map
+
+	journal            *journal
+	journalErr         error
+	journalInterval    time.Duration
+	lastCheckpointTime time.Time
 }
 
 // options for creating counter's factory
@@ -40,6 +65,19 @@ type ClusterCounterFactoryOpts struct {
 	Name              string
 	HeartbeatInterval time.Duration
 	Store             DataStoreI
+
+	// source of time, default is RealClock
+	Clock Clock
+
+	// identity of this process passed to store, default is hostname:pid
+	NodeID string
+	// deadline of one store call, no deadline if zero
+	StoreTimeout time.Duration
+
+	// file of un-flushed deltas, replayed into store on next startup; one file per process
+	JournalPath     string
+	JournalInterval time.Duration
+	JournalMaxBytes int64
 }
 
 // create new counter's factory
@@ -52,15 +90,236 @@ func NewFactory(opts *ClusterCounterFactoryOpts) *ClusterCounterFactory {
 		opts.HeartbeatInterval = time.Duration(DefaultHeartbeatIntervalMilliseconds) * time.Millisecond
 	}
 
+	if opts.JournalInterval == 0 {
+		opts.JournalInterval = time.Duration(DefaultJournalIntervalMilliseconds) * time.Millisecond
+	}
+
+	if opts.Clock == nil || reflect.ValueOf(opts.Clock).IsNil() {
+		opts.Clock = RealClock
+	}
+
+	if len(opts.NodeID) == 0 {
+		hostname, _ := os.Hostname()
+		opts.NodeID = fmt.Sprintf("%v:%v", hostname, os.Getpid())
+	}
+
 	factory := &ClusterCounterFactory{
 		name:              opts.Name,
 		Store:             opts.Store,
+		clock:             opts.Clock,
+		storeV2:           NewStoreV2(opts.Store),
+		nodeID:            opts.NodeID,
+		storeTimeout:      opts.StoreTimeout,
 		heartbeatInterval: opts.HeartbeatInterval,
+		journalInterval:   opts.JournalInterval,
+	}
+	switch opts.Store.(type) {
+	case BatchDataStoreI, BatchDataStoreV2I:
+		factory.batchStoreV2 = NewBatchStoreV2(opts.Store)
 	}
+	factory.ctx, factory.cancel = context.WithCancel(context.Background())
+
+	if len(opts.JournalPath) > 0 {
+		j, err := openJournal(opts.JournalPath, opts.JournalMaxBytes)
+		if err != nil {
+			factory.journalErr = err
+		} else {
+			factory.journal = j
+			_ = factory.ReplayJournal()
+		}
+	}
+
 	factory.Start()
 	return factory
 }
 
+// error of opening journal, the factory then runs without journal
+func (factory *ClusterCounterFactory) JournalError() error {
+	return factory.journalErr
+}
+
+// store deltas left in journal by previous process, failed ones are kept for next replay
+func (factory *ClusterCounterFactory) ReplayJournal() error {
+	if factory.journal == nil || factory.Store == nil || reflect.ValueOf(factory.Store).IsNil() {
+		return nil
+	}
+
+	var lastErr error
+	for _, item := range factory.journal.replayItems() {
+		ctx, cancel := factory.storeContext(factory.ctx)
+		err := factory.storeV2.StoreV2(ctx, factory.nodeID, item)
+		cancel()
+
+		if IsTransient(err) {
+			lastErr = err
+			continue
+		}
+		// permanent failure will not succeed on next replay either
+		_ = factory.journal.replayed(item)
+		if err != nil {
+			lastErr = err
+		}
+	}
+
+	if err := factory.journal.rewrite(); err != nil {
+		return err
+	}
+	return lastErr
+}
+
+// store one counter's delta, recorded in journal before calling store
+func (factory *ClusterCounterFactory) storeItem(ctx context.Context, item *StoreItem) error {
+	if factory.journal != nil && len(item.Token) > 0 {
+		_ = factory.journal.push(item)
+		_ = factory.journal.flush()
+	}
+
+	ctx, cancel := factory.storeContext(ctx)
+	defer cancel()
+	return factory.storeV2.StoreV2(ctx, factory.nodeID, item)
+}
+
+// load one counter's data, a missing key is zero value
+func (factory *ClusterCounterFactory) loadKey(key *StoreKey) (CounterValue, error) {
+	ctx, cancel := factory.storeContext(factory.ctx)
+	defer cancel()
+
+	value, err := factory.storeV2.LoadV2(ctx, factory.nodeID, key)
+	if IsNotFound(err) {
+		return CounterValue{}, nil
+	}
+	return value, err
+}
+
+// add value of window beginning at beginTime into store, kept until beginTime + retention,
+// so it outlives the window unlike counters' data
+func (factory *ClusterCounterFactory) StoreHistory(name string, lbs map[string]string, beginTime time.Time,
+	retention time.Duration, value CounterValue) error {
+	var token string
+	if factory.journal != nil {
+		token = factory.journal.newToken()
+	}
+	return factory.StoreHistoryOnce(token, name, lbs, beginTime, retention, value)
+}
+
+// add value of window like StoreHistory, once per token: stores ignore a token applied before,
+// e.g. by another node, so the first value stored with it is kept
+func (factory *ClusterCounterFactory) StoreHistoryOnce(token string, name string, lbs map[string]string,
+	beginTime time.Time, retention time.Duration, value CounterValue) error {
+	if factory.Store == nil || reflect.ValueOf(factory.Store).IsNil() {
+		return errors.New("store not set")
+	}
+
+	item := &StoreItem{
+		StoreKey: StoreKey{Name: name, BeginTime: beginTime, EndTime: beginTime.Add(retention), Labels: lbs},
+		Value:    value,
+		Force:    true,
+		Reason:   StoreReasonHistory,
+		Token:    token,
+	}
+
+	err := factory.storeItem(factory.ctx, item)
+	// transient failure stays in journal and is replayed on next startup
+	if (err == nil || IsPermanent(err)) && factory.journal != nil {
+		_ = factory.journal.finish(item, nil)
+	}
+	return err
+}
+
+// set value of window stored like StoreHistory unless it has one, returning the value kept in store,
+// so nodes agree on the first value set. see SetIfAbsentDataStoreI
+func (factory *ClusterCounterFactory) SetHistoryIfAbsent(name string, lbs map[string]string, beginTime time.Time,
+	retention time.Duration, value CounterValue) (CounterValue, error) {
+	if factory.Store == nil || reflect.ValueOf(factory.Store).IsNil() {
+		return CounterValue{}, errors.New("store not set")
+	}
+
+	setStore, ok := factory.Store.(SetIfAbsentDataStoreI)
+	if ok == false {
+		return CounterValue{}, errors.New("store cannot set values if absent")
+	}
+	return setStore.SetIfAbsent(name, beginTime, beginTime.Add(retention), lbs, value)
+}
+
+// load n consecutive windows of interval from beginTime stored by StoreHistory with the same retention.
+// a missing window is zero value
+func (factory *ClusterCounterFactory) LoadHistory(name string, lbs map[string]string, beginTime time.Time,
+	interval time.Duration, retention time.Duration, n int) ([]CounterValue, error) {
+	if factory.Store == nil || reflect.ValueOf(factory.Store).IsNil() {
+		return nil, errors.New("store not set")
+	}
+
+	keys := make([]*StoreKey, n)
+	for i := range keys {
+		windowBegin := beginTime.Add(time.Duration(i) * interval)
+		keys[i] = &StoreKey{Name: name, BeginTime: windowBegin, EndTime: windowBegin.Add(retention), Labels: lbs}
+	}
+
+	values := make([]CounterValue, n)
+	if factory.batchStoreV2 != nil {
+		ctx, cancel := factory.storeContext(factory.ctx)
+		batchValues, errs := factory.batchStoreV2.LoadBatchV2(ctx, factory.nodeID, keys)
+		cancel()
+		for i := range keys {
+			err := batchError(errs, i)
+			if err != nil && IsNotFound(err) == false {
+				return nil, err
+			}
+			if err == nil && i < len(batchValues) {
+				values[i] = batchValues[i]
+			}
+		}
+		return values, nil
+	}
+
+	for i, key := range keys {
+		value, err := factory.loadKey(key)
+		if err != nil {
+			return nil, err
+		}
+		values[i] = value
+	}
+	return values, nil
+}
+
+// context of one store call, canceled on close
+func (factory *ClusterCounterFactory) storeContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if factory.storeTimeout > 0 {
+		return context.WithTimeout(ctx, factory.storeTimeout)
+	}
+	return context.WithCancel(ctx)
+}
+
+// source of time of counters
+func (factory *ClusterCounterFactory) Clock() Clock {
+	return factory.clock
+}
+
+// identity of this process passed to store
+func (factory *ClusterCounterFactory) NodeID() string {
+	return factory.nodeID
+}
+
+// record all counters' un-flushed deltas into journal
+func (factory *ClusterCounterFactory) checkpointJournal() {
+	if factory.journal == nil {
+		return
+	}
+
+	timeNow := factory.clock.Now()
+	if timeNow.Before(factory.lastCheckpointTime.Add(factory.journalInterval)) {
+		return
+	}
+	factory.lastCheckpointTime = timeNow
+
+	for _, counter := range factory.allCounters() {
+		counter.mu.Lock()
+		counter.checkpoint(factory.journal)
+		counter.mu.Unlock()
+	}
+	_ = factory.journal.sync()
+}
+
 // create new counter vector
 func (factory *ClusterCounterFactory) NewClusterCounterVec(opts *ClusterCounterOpts,
 	labelNames []string,
@@ -77,12 +336,19 @@ func (factory *ClusterCounterFactory) NewClusterCounterVec(opts *ClusterCounterO
 		opts.InitLocalTrafficProportion = 1.0
 	}
 
+	if opts.Schedule != nil {
+		if err := opts.Schedule.Validate(); err != nil {
+			return nil, err
+		}
+	}
+
 	clusterCounterVec := &ClusterCounterVec{
 		Options:                    opts,
 		factory:                    factory,
 		beginTime:                  opts.BeginTime,
 		endTime:                    opts.EndTime,
 		resetInterval:              opts.ResetInterval,
+		schedule:                   opts.Schedule,
 		storeInterval:              opts.StoreDataInterval.Truncate(time.Second),
 		name:                       opts.Name,
 		labelNames:                 append([]string{}, labelNames...),
@@ -123,6 +389,12 @@ func (factory *ClusterCounterFactory) NewClusterCounter(opts *ClusterCounterOpts
 		opts.DeclineExpRatio = DefaultDeclineExpRatio
 	}
 
+	if opts.Schedule != nil {
+		if err := opts.Schedule.Validate(); err != nil {
+			return nil, err
+		}
+	}
+
 	clusterCounter := &ClusterCounter{
 		factory: factory,
 		Options: opts,
@@ -131,6 +403,7 @@ func (factory *ClusterCounterFactory) NewClusterCounter(opts *ClusterCounterOpts
 		beginTime:                  opts.BeginTime,
 		endTime:                    opts.EndTime,
 		resetInterval:              opts.ResetInterval,
+		schedule:                   opts.Schedule,
 		storeInterval:              opts.StoreDataInterval.Truncate(time.Second),
 		initLocalTrafficProportion: opts.InitLocalTrafficProportion,
 		discardPreviousData:        opts.DiscardPreviousData,
@@ -154,8 +427,13 @@ func (factory *ClusterCounterFactory) GetClusterCounter(name string) *ClusterCou
 // start update
 func (factory *ClusterCounterFactory) Start() {
 	if factory.ticker == nil {
-		factory.ticker = time.NewTicker(factory.heartbeatInterval)
-		go factory.WatchAndSync()
+		factory.ticker = factory.clock.NewTicker(factory.heartbeatInterval)
+		factory.done = make(chan struct{})
+		factory.loopWg.Add(1)
+		go func() {
+			defer factory.loopWg.Done()
+			factory.WatchAndSync()
+		}()
 	}
 }
 
@@ -163,16 +441,119 @@ func (factory *ClusterCounterFactory) Start() {
 func (factory *ClusterCounterFactory) Stop() {
 	if factory.ticker != nil {
 		factory.ticker.Stop()
+		factory.stopOnce.Do(func() {
+			close(factory.done)
+		})
 	}
 }
 
 func (factory *ClusterCounterFactory) WatchAndSync() {
-	for range factory.ticker.C {
-		factory.Heartbeat()
+	for {
+		select {
+		case <-factory.done:
+			return
+		case <-factory.ticker.C():
+			factory.Heartbeat()
+		}
 	}
 }
 
+// stop update, wait for running heartbeat, then store all counters' un-flushed data
+func (factory *ClusterCounterFactory) Close(ctx context.Context) error {
+	factory.Stop()
+
+	locked := make(chan struct{})
+	go func() {
+		factory.loopWg.Wait()
+		factory.heartbeatMu.Lock()
+		close(locked)
+	}()
+	select {
+	case <-locked:
+	case <-ctx.Done():
+		// abort running store calls
+		factory.cancel()
+		go func() {
+			<-locked
+			factory.heartbeatMu.Unlock()
+		}()
+		return ctx.Err()
+	}
+	defer factory.heartbeatMu.Unlock()
+
+	if factory.closed {
+		return nil
+	}
+	factory.closed = true
+
+	err := factory.Flush(ctx)
+	factory.cancel()
+	if factory.journal != nil {
+		// keep deltas failed to flush for next startup
+		for _, counter := range factory.allCounters() {
+			counter.mu.Lock()
+			counter.checkpoint(factory.journal)
+			counter.mu.Unlock()
+		}
+		if journalErr := factory.journal.close(); journalErr != nil && err == nil {
+			err = journalErr
+		}
+	}
+	return err
+}
+
+// store all counters' un-flushed data now
+func (factory *ClusterCounterFactory) Flush(ctx context.Context) error {
+	var flushErr *FlushError
+	for _, counter := range factory.allCounters() {
+		err := ctx.Err()
+		if err == nil {
+			err = counter.flush(ctx)
+		}
+		if err != nil {
+			if flushErr == nil {
+				flushErr = &FlushError{}
+			}
+			flushErr.Counters = append(flushErr.Counters, counter.fullName())
+			flushErr.Errors = append(flushErr.Errors, err)
+		}
+	}
+
+	if flushErr != nil {
+		return flushErr
+	}
+	return nil
+}
+
+// counters failed to flush
+type FlushError struct {
+	Counters []string
+	Errors   []error
+}
+
+func (flushErr *FlushError) Error() string {
+	var msgs []string
+	for i, name := range flushErr.Counters {
+		msgs = append(msgs, fmt.Sprintf("%v: %v", name, flushErr.Errors[i]))
+	}
+	return fmt.Sprintf("flush %v counters failed: %v", len(flushErr.Counters), strings.Join(msgs, "; "))
+}
+
 func (factory *ClusterCounterFactory) Heartbeat() {
+	factory.heartbeatMu.Lock()
+	defer factory.heartbeatMu.Unlock()
+
+	if factory.closed {
+		return
+	}
+	defer factory.checkpointJournal()
+
+	if factory.batchStoreV2 != nil {
+		factory.batchHeartbeat()
+		factory.expire()
+		return
+	}
+
 	factory.clusterCounterVectors.Range(func(k interface{}, v interface{}) bool {
 		if counterVec, ok := v.(*ClusterCounterVec); ok {
 			counterVec.Heartbeat()
@@ -196,6 +577,127 @@ func (factory *ClusterCounterFactory) Heartbeat() {
 	})
 }
 
+// store and load all due counters in one call each, each call is bound by StoreTimeout and canceled on close
+func (factory *ClusterCounterFactory) batchHeartbeat() {
+	counters := factory.allCounters()
+
+	var storeCounters []*ClusterCounter
+	var storeItems []*StoreItem
+	for _, counter := range counters {
+		counter.mu.Lock()
+		if item := counter.prepareStore(factory.clock.Now()); item != nil {
+			storeCounters = append(storeCounters, counter)
+			storeItems = append(storeItems, item)
+		}
+		counter.mu.Unlock()
+	}
+	if len(storeItems) > 0 {
+		if factory.journal != nil {
+			for _, item := range storeItems {
+				_ = factory.journal.push(item)
+			}
+			_ = factory.journal.flush()
+		}
+
+		ctx, cancel := factory.storeContext(factory.ctx)
+		errs := factory.batchStoreV2.StoreBatchV2(ctx, factory.nodeID, storeItems)
+		cancel()
+		for i, counter := range storeCounters {
+			counter.mu.Lock()
+			counter.finishStore(storeItems[i], batchError(errs, i))
+			counter.mu.Unlock()
+		}
+	}
+
+	timeNow := factory.clock.Now()
+	var loadCounters []*ClusterCounter
+	var loadKeys []*StoreKey
+	for _, counter := range counters {
+		counter.mu.Lock()
+		if key := counter.prepareLoad(timeNow); key != nil {
+			loadCounters = append(loadCounters, counter)
+			loadKeys = append(loadKeys, key)
+		}
+		counter.mu.Unlock()
+	}
+	if len(loadKeys) > 0 {
+		ctx, cancel := factory.storeContext(factory.ctx)
+		values, errs := factory.batchStoreV2.LoadBatchV2(ctx, factory.nodeID, loadKeys)
+		cancel()
+		for i, counter := range loadCounters {
+			var value CounterValue
+			if i < len(values) {
+				value = values[i]
+			}
+			err := batchError(errs, i)
+			if IsNotFound(err) {
+				value, err = CounterValue{}, nil
+			}
+			counter.mu.Lock()
+			counter.finishLoad(timeNow, value, err)
+			counter.mu.Unlock()
+		}
+	}
+}
+
+// all counters, including the ones within vectors
+func (factory *ClusterCounterFactory) allCounters() []*ClusterCounter {
+	var counters []*ClusterCounter
+	factory.clusterCounterVectors.Range(func(k interface{}, v interface{}) bool {
+		if counterVec, ok := v.(*ClusterCounterVec); ok {
+			counterVec.rangeCounters(func(counter *ClusterCounter) bool {
+				counters = append(counters, counter)
+				return true
+			})
+		}
+		return true
+	})
+
+	factory.clusterCounters.Range(func(k interface{}, v interface{}) bool {
+		if counter, ok := v.(*ClusterCounter); ok {
+			counters = append(counters, counter)
+		}
+		return true
+	})
+	return counters
+}
+
+func (factory *ClusterCounterFactory) expire() {
+	factory.clusterCounterVectors.Range(func(k interface{}, v interface{}) bool {
+		if counterVec, ok := v.(*ClusterCounterVec); ok {
+			if counterVec.Expire() {
+				factory.clusterCounters.Delete(k)
+			}
+		}
+		return true
+	})
+
+	factory.clusterCounters.Range(func(k interface{}, v interface{}) bool {
+		if counter, ok := v.(*ClusterCounter); ok {
+			if counter.Expire() {
+				factory.clusterCounters.Delete(k)
+			}
+		}
+		return true
+	})
+}
+
+// error of i-th item, a missing result counts as failure
+func batchError(errs []error, i int) error {
+	if i >= len(errs) {
+		return errors.New("batch result missing")
+	}
+	return errs[i]
+}
+
+// whether the store reports itself unavailable
+func (factory *ClusterCounterFactory) Degraded() bool {
+	if degradedStore, ok := factory.Store.(DegradedStoreI); ok && reflect.ValueOf(degradedStore).IsNil() == false {
+		return degradedStore.Degraded()
+	}
+	return false
+}
+
 func (factory *ClusterCounterFactory) Delete(name string) {
 	factory.clusterCounters.Delete(name)
 }
@@ -203,3 +705,39 @@ func (factory *ClusterCounterFactory) Delete(name string) {
 func (factory *ClusterCounterFactory) DeleteVec(name string) {
 	factory.clusterCounterVectors.Delete(name)
 }
+
+// delete counter or counter vector, and remove all its windows from store and journal.
+// windows are kept in stores that cannot delete keys
+func (factory *ClusterCounterFactory) Purge(name string) error {
+	factory.Delete(name)
+	factory.DeleteVec(name)
+
+	if factory.journal != nil {
+		_ = factory.journal.forget(name)
+	}
+
+	adminStore, ok := factory.Store.(AdminDataStoreI)
+	if ok == false || reflect.ValueOf(adminStore).IsNil() {
+		return nil
+	}
+
+	keys, err := adminStore.ListKeys(name)
+	if err != nil {
+		return err
+	}
+	var nameKeys []*StoreKey
+	for _, key := range keys {
+		if key.Name == name {
+			nameKeys = append(nameKeys, key)
+		}
+	}
+	if batchStore, ok := adminStore.(BatchAdminDataStoreI); ok && len(nameKeys) > 0 {
+		return batchStore.DeleteBatch(nameKeys)
+	}
+	for _, key := range nameKeys {
+		if err := adminStore.Delete(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -1 +1,102 @@
 package cluster_counter
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+type batchStoreForTest struct {
+	values     map[string]CounterValue
+	storeCalls int
+	loadCalls  int
+}
+
+func (store *batchStoreForTest) Store(name string, beginTime time.Time, endTime time.Time, lbs map[string]string,
+	value CounterValue, force bool) error {
+	v := store.values[name]
+	store.values[name] = v.Add(value)
+	return nil
+}
+
+func (store *batchStoreForTest) Load(name string, beginTime time.Time, endTime time.Time, lbs map[string]string,
+) (CounterValue, error) {
+	return store.values[name], nil
+}
+
+func (store *batchStoreForTest) StoreBatch(items []*StoreItem) []error {
+	store.storeCalls++
+	errs := make([]error, len(items))
+	for i, item := range items {
+		errs[i] = store.Store(item.Name, item.BeginTime, item.EndTime, item.Labels, item.Value, item.Force)
+	}
+	return errs
+}
+
+func (store *batchStoreForTest) LoadBatch(keys []*StoreKey) ([]CounterValue, []error) {
+	store.loadCalls++
+	values := make([]CounterValue, len(keys))
+	for i, key := range keys {
+		values[i], _ = store.Load(key.Name, key.BeginTime, key.EndTime, key.Labels)
+	}
+	return values, make([]error, len(keys))
+}
+
+func TestClusterCounterFactory_BatchHeartbeat(t *testing.T) {
+	store := &batchStoreForTest{values: make(map[string]CounterValue)}
+	factory := NewFactory(&ClusterCounterFactoryOpts{Store: store})
+	factory.Stop()
+
+	var counters []*ClusterCounter
+	for i, name := range []string{"a", "b", "c"} {
+		counter, err := factory.NewClusterCounter(&ClusterCounterOpts{Name: name, ResetInterval: time.Hour})
+		if err != nil {
+			t.Fatal(err)
+		}
+		counter.Add(1)
+		counters = append(counters, counter)
+
+		// data of other clients arrives after the initial load, which is due again
+		store.values[name] = CounterValue{Sum: float64(i), Count: int64(i)}
+		counter.lastLoadTime = counter.lastLoadTime.Add(-time.Hour)
+	}
+
+	factory.Heartbeat()
+	if store.storeCalls != 1 {
+		t.Fatal("counters should be stored in one batch", store.storeCalls)
+	}
+	if store.loadCalls != 1 {
+		t.Fatal("counters should be loaded in one batch", store.loadCalls)
+	}
+	for i, name := range []string{"a", "b", "c"} {
+		if store.values[name].Count != int64(i)+1 {
+			t.Fatal("batch store value error", name, store.values[name])
+		}
+		if v, _ := counters[i].ClusterValue(0); v.Count != int64(i)+1 {
+			t.Fatal("batch load value error", name, v)
+		}
+	}
+}
+
+func TestClusterCounterFactory_Close(t *testing.T) {
+	store := &journalStoreForTest{tokens: make(map[string]bool)}
+	factory := NewFactory(&ClusterCounterFactoryOpts{Store: store})
+
+	counter, _ := factory.NewClusterCounter(&ClusterCounterOpts{Name: "test", ResetInterval: time.Hour})
+	counter.Add(1)
+	if err := factory.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if store.value.Count != 1 {
+		t.Fatal("local data should be flushed on close", store.value)
+	}
+
+	failFactory := NewFactory(&ClusterCounterFactoryOpts{Store: store})
+	failCounter, _ := failFactory.NewClusterCounter(&ClusterCounterOpts{Name: "fail", ResetInterval: time.Hour})
+	failCounter.Add(1)
+	store.fail = true
+	err := failFactory.Close(context.Background())
+	if flushErr, ok := err.(*FlushError); ok == false || len(flushErr.Counters) != 1 || flushErr.Counters[0] != "fail" {
+		t.Fatal("close should report counters failed to flush", err)
+	}
+}
@@ -0,0 +1,314 @@
+package file_store
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"github.com/boostlearn/go-cluster-limiter/cluster_counter"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const FileKeySep = "####"
+const DefaultSweepIntervalSeconds = 60
+const DefaultExpireDelaySeconds = 60
+
+// size of one counter's file: sum, count, end time
+const recordSize = 24
+
+// store within one host, shared by processes through files in one directory.
+// each counter's window is one small file, updated under flock so that
+// processes add deltas atomically
+type FileStore struct {
+	dir           string
+	expireDelay   time.Duration
+	sweepInterval time.Duration
+
+	mu            sync.Mutex
+	lastSweepTime time.Time
+}
+
+// options for creating file store
+type FileStoreOpts struct {
+	Dir string
+	// delay of removing window's file after its end time, so that late deltas of the window are kept
+	ExpireDelay   time.Duration
+	SweepInterval time.Duration
+}
+
+// build new store in dir, created if missing
+func NewStore(dir string) (*FileStore, error) {
+	return NewFileStore(&FileStoreOpts{Dir: dir})
+}
+
+// build new store with options
+func NewFileStore(opts *FileStoreOpts) (*FileStore, error) {
+	if opts.ExpireDelay == 0 {
+		opts.ExpireDelay = time.Duration(DefaultExpireDelaySeconds) * time.Second
+	}
+
+	if opts.SweepInterval == 0 {
+		opts.SweepInterval = time.Duration(DefaultSweepIntervalSeconds) * time.Second
+	}
+
+	store := &FileStore{
+		dir:           opts.Dir,
+		expireDelay:   opts.ExpireDelay,
+		sweepInterval: opts.SweepInterval,
+	}
+	for _, dir := range []string{store.counterDir(), store.tokenDir()} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, err
+		}
+	}
+	return store, nil
+}
+
+// store client's data within host
+func (store *FileStore) Store(name string, beginTime time.Time, endTime time.Time, lbs map[string]string,
+	value cluster_counter.CounterValue, force bool) error {
+	store.trySweep()
+
+	return store.update(store.counterPath(name, beginTime, endTime, lbs), func(file *os.File) error {
+		return addRecord(file, value, endTime)
+	})
+}
+
+// store client's data, values with the same token are applied only once
+func (store *FileStore) StoreOnce(token string, name string, beginTime time.Time, endTime time.Time,
+	lbs map[string]string, value cluster_counter.CounterValue, force bool) error {
+	store.trySweep()
+
+	return store.update(store.counterPath(name, beginTime, endTime, lbs), func(file *os.File) error {
+		tokenFile, err := os.OpenFile(store.tokenPath(token), os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+		if os.IsExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		_, err = tokenFile.Write(encodeRecord(cluster_counter.CounterValue{}, cluster_counter.TokenExpireTime(time.Now())))
+		_ = tokenFile.Close()
+		if err == nil {
+			err = addRecord(file, value, endTime)
+		}
+		if err != nil {
+			// value is not applied, so the token can be applied again
+			_ = os.Remove(tokenFile.Name())
+		}
+		return err
+	})
+}
+
+// set data of window unless it has some, returns the data kept
+func (store *FileStore) SetIfAbsent(name string, beginTime time.Time, endTime time.Time, lbs map[string]string,
+	value cluster_counter.CounterValue) (cluster_counter.CounterValue, error) {
+	store.trySweep()
+
+	kept := value
+	err := store.update(store.counterPath(name, beginTime, endTime, lbs), func(file *os.File) error {
+		fileInfo, err := file.Stat()
+		if err != nil {
+			return err
+		}
+		current, recordEndTime, err := readRecord(file)
+		if err != nil {
+			return err
+		}
+		if fileInfo.Size() > 0 && (recordEndTime.After(time.Time{}) == false || time.Now().After(recordEndTime) == false) {
+			kept = current
+			return nil
+		}
+		_, err = file.WriteAt(encodeRecord(value, endTime), 0)
+		return err
+	})
+	return kept, err
+}
+
+// load data of processes within host
+func (store *FileStore) Load(name string, beginTime time.Time, endTime time.Time, lbs map[string]string,
+) (cluster_counter.CounterValue, error) {
+	file, err := os.Open(store.counterPath(name, beginTime, endTime, lbs))
+	if os.IsNotExist(err) {
+		return cluster_counter.CounterValue{}, nil
+	}
+	if err != nil {
+		return cluster_counter.CounterValue{}, err
+	}
+	defer file.Close()
+
+	if err := lockFile(file, false); err != nil {
+		return cluster_counter.CounterValue{}, err
+	}
+	defer unlockFile(file)
+
+	value, recordEndTime, err := readRecord(file)
+	if err != nil {
+		return cluster_counter.CounterValue{}, err
+	}
+	if recordEndTime.After(time.Time{}) && time.Now().After(recordEndTime) {
+		return cluster_counter.CounterValue{}, nil
+	}
+	return value, nil
+}
+
+// remove files of windows ended before expire delay
+func (store *FileStore) Sweep() error {
+	deadline := time.Now().Add(-store.expireDelay)
+	for _, dir := range []string{store.counterDir(), store.tokenDir()} {
+		infos, err := ioutil.ReadDir(dir)
+		if err != nil {
+			return err
+		}
+		for _, info := range infos {
+			_ = store.updateFile(filepath.Join(dir, info.Name()), os.O_RDWR, func(file *os.File) error {
+				_, endTime, err := readRecord(file)
+				if err == nil && endTime.After(time.Time{}) && endTime.Before(deadline) {
+					return os.Remove(file.Name())
+				}
+				return err
+			})
+		}
+	}
+	return nil
+}
+
+func (store *FileStore) trySweep() {
+	store.mu.Lock()
+	timeNow := time.Now()
+	if timeNow.Before(store.lastSweepTime.Add(store.sweepInterval)) {
+		store.mu.Unlock()
+		return
+	}
+	store.lastSweepTime = timeNow
+	store.mu.Unlock()
+
+	_ = store.Sweep()
+}
+
+// open path and run f with exclusive lock; file removed by sweep meanwhile is opened again
+func (store *FileStore) update(path string, f func(file *os.File) error) error {
+	return store.updateFile(path, os.O_RDWR|os.O_CREATE, f)
+}
+
+func (store *FileStore) updateFile(path string, flag int, f func(file *os.File) error) error {
+	for {
+		file, err := os.OpenFile(path, flag, 0644)
+		if err != nil {
+			return err
+		}
+
+		if err := lockFile(file, true); err != nil {
+			_ = file.Close()
+			return err
+		}
+
+		if removed(file, path) {
+			unlockFile(file)
+			_ = file.Close()
+			continue
+		}
+
+		err = f(file)
+		unlockFile(file)
+		_ = file.Close()
+		return err
+	}
+}
+
+// whether file is no longer linked at path
+func removed(file *os.File, path string) bool {
+	fileInfo, err := file.Stat()
+	if err != nil {
+		return true
+	}
+	pathInfo, err := os.Stat(path)
+	if err != nil {
+		return true
+	}
+	return os.SameFile(fileInfo, pathInfo) == false
+}
+
+func addRecord(file *os.File, value cluster_counter.CounterValue, endTime time.Time) error {
+	current, _, err := readRecord(file)
+	if err != nil {
+		return err
+	}
+	current = current.Add(value)
+	_, err = file.WriteAt(encodeRecord(current, endTime), 0)
+	return err
+}
+
+// read record, empty file is zero value
+func readRecord(file *os.File) (cluster_counter.CounterValue, time.Time, error) {
+	buf := make([]byte, recordSize)
+	n, err := file.ReadAt(buf, 0)
+	if n == 0 && err == io.EOF {
+		return cluster_counter.CounterValue{}, time.Time{}, nil
+	}
+	if n != recordSize {
+		return cluster_counter.CounterValue{}, time.Time{}, fmt.Errorf("broken record in %v: %v", file.Name(), err)
+	}
+
+	value := cluster_counter.CounterValue{
+		Sum:   math.Float64frombits(binary.LittleEndian.Uint64(buf[0:8])),
+		Count: int64(binary.LittleEndian.Uint64(buf[8:16])),
+	}
+	var endTime time.Time
+	if nano := int64(binary.LittleEndian.Uint64(buf[16:24])); nano != 0 {
+		endTime = time.Unix(0, nano)
+	}
+	return value, endTime, nil
+}
+
+func encodeRecord(value cluster_counter.CounterValue, endTime time.Time) []byte {
+	buf := make([]byte, recordSize)
+	binary.LittleEndian.PutUint64(buf[0:8], math.Float64bits(value.Sum))
+	binary.LittleEndian.PutUint64(buf[8:16], uint64(value.Count))
+	if endTime.IsZero() == false {
+		binary.LittleEndian.PutUint64(buf[16:24], uint64(endTime.UnixNano()))
+	}
+	return buf
+}
+
+func (store *FileStore) counterDir() string {
+	return filepath.Join(store.dir, "counters")
+}
+
+func (store *FileStore) tokenDir() string {
+	return filepath.Join(store.dir, "tokens")
+}
+
+func (store *FileStore) counterPath(name string, beginTime time.Time, endTime time.Time, lbs map[string]string,
+) string {
+	return filepath.Join(store.counterDir(), hashName(generateFileKey(name, beginTime, endTime, lbs)))
+}
+
+func (store *FileStore) tokenPath(token string) string {
+	return filepath.Join(store.tokenDir(), hashName(token))
+}
+
+// file name safe for any key
+func hashName(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+func generateFileKey(name string, beginTime time.Time, endTime time.Time, lbs map[string]string) string {
+	var labels []string
+	for k, v := range lbs {
+		labels = append(labels, strconv.Quote(k)+"="+strconv.Quote(v))
+	}
+	sort.Strings(labels)
+	return fmt.Sprintf("%v%v%v_%v%v%v", name, FileKeySep, beginTime.UnixNano(), endTime.UnixNano(),
+		FileKeySep, strings.Join(labels, FileKeySep))
+}
@@ -0,0 +1,117 @@
+//go:build !windows
+// +build !windows
+
+package file_store
+
+import (
+	"github.com/boostlearn/go-cluster-limiter/cluster_counter"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestFileStore_StoreAndLoad(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "file_store")
+	defer os.RemoveAll(dir)
+
+	startTime := time.Now().Truncate(time.Second)
+	endTime := startTime.Add(time.Hour)
+	lbs := map[string]string{"a1": "c2", "a2": "c1"}
+
+	// stores on one directory act as processes on one host
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		store, err := NewStore(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				_ = store.Store("test", startTime, endTime, lbs, cluster_counter.CounterValue{Sum: 2, Count: 1}, false)
+			}
+		}()
+	}
+	wg.Wait()
+
+	store, _ := NewStore(dir)
+	v, err := store.Load("test", startTime, endTime, lbs)
+	if err != nil || v.Sum != 400 || v.Count != 200 {
+		t.Fatal("load value error", v, err)
+	}
+
+	for i := 0; i < 2; i++ {
+		_ = store.StoreOnce("t1", "test", startTime, endTime, lbs, cluster_counter.CounterValue{Sum: 1, Count: 1}, true)
+	}
+	v, _ = store.Load("test", startTime, endTime, lbs)
+	if v.Count != 201 {
+		t.Fatal("token should be applied once", v)
+	}
+}
+
+func TestFileStore_StoreOnceFailure(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "file_store")
+	defer os.RemoveAll(dir)
+
+	store, _ := NewStore(dir)
+	startTime := time.Now().Truncate(time.Second)
+	endTime := startTime.Add(time.Hour)
+
+	// broken record fails the store
+	path := store.counterPath("test", startTime, endTime, nil)
+	_ = ioutil.WriteFile(path, []byte("broken"), 0644)
+	if err := store.StoreOnce("t1", "test", startTime, endTime, nil, cluster_counter.CounterValue{Sum: 1, Count: 1}, true); err == nil {
+		t.Fatal("broken record should fail the store")
+	}
+
+	// failed token is applied on retry
+	_ = os.Remove(path)
+	_ = store.StoreOnce("t1", "test", startTime, endTime, nil, cluster_counter.CounterValue{Sum: 1, Count: 1}, true)
+	if v, _ := store.Load("test", startTime, endTime, nil); v.Count != 1 {
+		t.Fatal("token of failed store should be applied on retry", v)
+	}
+}
+
+func TestFileStore_SetIfAbsent(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "file_store")
+	defer os.RemoveAll(dir)
+
+	store, _ := NewStore(dir)
+	startTime := time.Now().Truncate(time.Second)
+	endTime := startTime.Add(time.Hour)
+	for i := 1; i <= 2; i++ {
+		kept, err := store.SetIfAbsent("test", startTime, endTime, nil, cluster_counter.CounterValue{Sum: float64(i), Count: 1})
+		if err != nil || kept.Sum != 1 {
+			t.Fatal("first value should be kept", kept, err)
+		}
+	}
+	if v, _ := store.Load("test", startTime, endTime, nil); v.Sum != 1 || v.Count != 1 {
+		t.Fatal("value should be set once", v)
+	}
+}
+
+func TestFileStore_Expire(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "file_store")
+	defer os.RemoveAll(dir)
+
+	store, _ := NewFileStore(&FileStoreOpts{Dir: dir, ExpireDelay: time.Millisecond})
+	startTime := time.Now().Add(-10 * time.Second)
+	endTime := time.Now().Add(-time.Second)
+	_ = store.Store("test", startTime, endTime, nil, cluster_counter.CounterValue{Sum: 100, Count: 1}, true)
+
+	v, _ := store.Load("test", startTime, endTime, nil)
+	if v.Count != 0 {
+		t.Fatal("expired data should not be loaded")
+	}
+
+	if err := store.Sweep(); err != nil {
+		t.Fatal(err)
+	}
+	infos, _ := ioutil.ReadDir(store.counterDir())
+	if len(infos) != 0 {
+		t.Fatal("expired file should be removed", len(infos))
+	}
+}
@@ -0,0 +1,27 @@
+//go:build !windows
+// +build !windows
+
+package file_store
+
+import (
+	"os"
+	"syscall"
+)
+
+// lock whole file, shared by readers or exclusive by one writer, among processes
+func lockFile(file *os.File, exclusive bool) error {
+	how := syscall.LOCK_SH
+	if exclusive {
+		how = syscall.LOCK_EX
+	}
+	for {
+		err := syscall.Flock(int(file.Fd()), how)
+		if err != syscall.EINTR {
+			return err
+		}
+	}
+}
+
+func unlockFile(file *os.File) {
+	_ = syscall.Flock(int(file.Fd()), syscall.LOCK_UN)
+}
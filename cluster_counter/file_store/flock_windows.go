@@ -0,0 +1,18 @@
+//go:build windows
+// +build windows
+
+package file_store
+
+import (
+	"errors"
+	"os"
+)
+
+var errNotSupported = errors.New("file store is not supported on windows")
+
+func lockFile(file *os.File, exclusive bool) error {
+	return errNotSupported
+}
+
+func unlockFile(file *os.File) {
+}
@@ -0,0 +1,393 @@
+package gossip_store
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/boostlearn/go-cluster-limiter/cluster_counter"
+	"math/rand"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const GossipKeySep = "####"
+const DefaultGossipIntervalMilliseconds = 500
+const DefaultGossipFanout = 3
+const DefaultDialTimeoutMilliseconds = 500
+
+// options for creating gossip store
+type GossipStoreOpts struct {
+	// unique within cluster for one process's lifetime, default: hostname:pid:start time
+	NodeID string
+	// tcp address to listen on, e.g. "0.0.0.0:7946"
+	BindAddr string
+	// addresses of known peers, the others are learnt from gossip
+	Peers []string
+
+	GossipInterval time.Duration
+	Fanout         int
+	DialTimeout    time.Duration
+}
+
+// contribution of one node to one counter
+type contribution struct {
+	Value   cluster_counter.CounterValue
+	Version int64
+}
+
+// counter's data known by this node
+type gossipEntry struct {
+	Name          string
+	BeginTime     time.Time
+	EndTime       time.Time
+	Labels        map[string]string
+	Contributions map[string]contribution
+}
+
+type gossipMessage struct {
+	NodeID  string
+	Addr    string
+	Peers   []string
+	Entries []*gossipEntry
+}
+
+// peer-to-peer store: nodes exchange their own contributions with anti-entropy,
+// merges keep the newest version of each node's contribution, so they are idempotent.
+type GossipStore struct {
+	mu      sync.RWMutex
+	nodeID  string
+	addr    string
+	peers   map[string]bool
+	entries map[string]*gossipEntry
+
+	gossipInterval time.Duration
+	fanout         int
+	dialTimeout    time.Duration
+
+	listener net.Listener
+	ticker   *time.Ticker
+	done     chan struct{}
+	wg       sync.WaitGroup
+}
+
+// build new gossip store and start exchanging data with peers
+func NewStore(opts *GossipStoreOpts) (*GossipStore, error) {
+	if opts == nil || len(opts.BindAddr) == 0 {
+		return nil, errors.New("bind address cannot be nil")
+	}
+
+	if len(opts.NodeID) == 0 {
+		hostname, _ := os.Hostname()
+		opts.NodeID = fmt.Sprintf("%v:%v:%v", hostname, os.Getpid(), time.Now().UnixNano())
+	}
+
+	if opts.GossipInterval == 0 {
+		opts.GossipInterval = DefaultGossipIntervalMilliseconds * time.Millisecond
+	}
+
+	if opts.Fanout <= 0 {
+		opts.Fanout = DefaultGossipFanout
+	}
+
+	if opts.DialTimeout == 0 {
+		opts.DialTimeout = DefaultDialTimeoutMilliseconds * time.Millisecond
+	}
+
+	listener, err := net.Listen("tcp", opts.BindAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	store := &GossipStore{
+		nodeID:         opts.NodeID,
+		addr:           listener.Addr().String(),
+		peers:          make(map[string]bool),
+		entries:        make(map[string]*gossipEntry),
+		gossipInterval: opts.GossipInterval,
+		fanout:         opts.Fanout,
+		dialTimeout:    opts.DialTimeout,
+		listener:       listener,
+		done:           make(chan struct{}),
+	}
+	for _, peer := range opts.Peers {
+		store.AddPeer(peer)
+	}
+
+	store.ticker = time.NewTicker(store.gossipInterval)
+	store.wg.Add(2)
+	go store.serve()
+	go store.gossip()
+	return store, nil
+}
+
+// node's id within cluster
+func (store *GossipStore) NodeID() string {
+	return store.nodeID
+}
+
+// address that peers can reach this node on
+func (store *GossipStore) Addr() string {
+	return store.addr
+}
+
+// add peer's address
+func (store *GossipStore) AddPeer(addr string) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	if len(addr) > 0 && addr != store.addr {
+		store.peers[addr] = true
+	}
+}
+
+// known peers' addresses
+func (store *GossipStore) Peers() []string {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	var peers []string
+	for peer := range store.peers {
+		peers = append(peers, peer)
+	}
+	sort.Strings(peers)
+	return peers
+}
+
+// stop gossip and close listener
+func (store *GossipStore) Close() error {
+	select {
+	case <-store.done:
+		return nil
+	default:
+	}
+
+	close(store.done)
+	store.ticker.Stop()
+	err := store.listener.Close()
+	store.wg.Wait()
+	return err
+}
+
+// store client's data within cluster
+func (store *GossipStore) Store(name string, beginTime time.Time, endTime time.Time, lbs map[string]string,
+	value cluster_counter.CounterValue, force bool) error {
+	key := generateGossipKey(name, beginTime, endTime, lbs)
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	entry, ok := store.entries[key]
+	if ok == false {
+		labels := make(map[string]string)
+		for k, v := range lbs {
+			labels[k] = v
+		}
+		entry = &gossipEntry{
+			Name:          name,
+			BeginTime:     beginTime,
+			EndTime:       endTime,
+			Labels:        labels,
+			Contributions: make(map[string]contribution),
+		}
+		store.entries[key] = entry
+	}
+
+	local := entry.Contributions[store.nodeID]
+	local.Value = local.Value.Add(value)
+	local.Version += 1
+	entry.Contributions[store.nodeID] = local
+	return nil
+}
+
+// load cluster's data for clients
+func (store *GossipStore) Load(name string, beginTime time.Time, endTime time.Time, lbs map[string]string,
+) (cluster_counter.CounterValue, error) {
+	key := generateGossipKey(name, beginTime, endTime, lbs)
+
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	var counterValue cluster_counter.CounterValue
+	if entry, ok := store.entries[key]; ok {
+		for _, c := range entry.Contributions {
+			counterValue = counterValue.Add(c.Value)
+		}
+	}
+	return counterValue, nil
+}
+
+// accept peers' sync requests
+func (store *GossipStore) serve() {
+	defer store.wg.Done()
+
+	for {
+		conn, err := store.listener.Accept()
+		if err != nil {
+			select {
+			case <-store.done:
+				return
+			default:
+			}
+			continue
+		}
+
+		store.wg.Add(1)
+		go func() {
+			defer store.wg.Done()
+			defer conn.Close()
+
+			_ = conn.SetDeadline(time.Now().Add(store.dialTimeout + store.gossipInterval))
+			var msg gossipMessage
+			if err := json.NewDecoder(conn).Decode(&msg); err != nil {
+				return
+			}
+			store.merge(&msg)
+			_ = json.NewEncoder(conn).Encode(store.snapshot())
+		}()
+	}
+}
+
+// push-pull with random peers every interval
+func (store *GossipStore) gossip() {
+	defer store.wg.Done()
+
+	for {
+		select {
+		case <-store.done:
+			return
+		case <-store.ticker.C:
+			store.expire()
+			for _, peer := range store.choosePeers() {
+				_ = store.syncWith(peer)
+			}
+		}
+	}
+}
+
+func (store *GossipStore) choosePeers() []string {
+	peers := store.Peers()
+	rand.Shuffle(len(peers), func(i, j int) { peers[i], peers[j] = peers[j], peers[i] })
+	if len(peers) > store.fanout {
+		peers = peers[:store.fanout]
+	}
+	return peers
+}
+
+func (store *GossipStore) syncWith(peer string) error {
+	conn, err := net.DialTimeout("tcp", peer, store.dialTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_ = conn.SetDeadline(time.Now().Add(store.dialTimeout + store.gossipInterval))
+	if err = json.NewEncoder(conn).Encode(store.snapshot()); err != nil {
+		return err
+	}
+
+	var msg gossipMessage
+	if err = json.NewDecoder(conn).Decode(&msg); err != nil {
+		return err
+	}
+	store.merge(&msg)
+	return nil
+}
+
+// copy of all data known by this node
+func (store *GossipStore) snapshot() *gossipMessage {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	msg := &gossipMessage{NodeID: store.nodeID, Addr: store.addr}
+	for peer := range store.peers {
+		msg.Peers = append(msg.Peers, peer)
+	}
+	for _, entry := range store.entries {
+		contributions := make(map[string]contribution)
+		for nodeID, c := range entry.Contributions {
+			contributions[nodeID] = c
+		}
+		msg.Entries = append(msg.Entries, &gossipEntry{
+			Name:          entry.Name,
+			BeginTime:     entry.BeginTime,
+			EndTime:       entry.EndTime,
+			Labels:        entry.Labels,
+			Contributions: contributions,
+		})
+	}
+	return msg
+}
+
+// merge peer's data, keep newest version of each node's contribution
+func (store *GossipStore) merge(msg *gossipMessage) {
+	timeNow := time.Now()
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	if len(msg.Addr) > 0 && msg.Addr != store.addr {
+		store.peers[msg.Addr] = true
+	}
+	for _, peer := range msg.Peers {
+		if len(peer) > 0 && peer != store.addr {
+			store.peers[peer] = true
+		}
+	}
+
+	for _, remote := range msg.Entries {
+		if remote == nil || (remote.EndTime.After(time.Time{}) && timeNow.After(remote.EndTime)) {
+			continue
+		}
+
+		key := generateGossipKey(remote.Name, remote.BeginTime, remote.EndTime, remote.Labels)
+		entry, ok := store.entries[key]
+		if ok == false {
+			entry = &gossipEntry{
+				Name:          remote.Name,
+				BeginTime:     remote.BeginTime,
+				EndTime:       remote.EndTime,
+				Labels:        remote.Labels,
+				Contributions: make(map[string]contribution),
+			}
+			store.entries[key] = entry
+		}
+
+		for nodeID, c := range remote.Contributions {
+			if nodeID == store.nodeID {
+				continue
+			}
+			if local, ok := entry.Contributions[nodeID]; ok == false || c.Version > local.Version {
+				entry.Contributions[nodeID] = c
+			}
+		}
+	}
+}
+
+// drop data out of time range
+func (store *GossipStore) expire() {
+	timeNow := time.Now()
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	for key, entry := range store.entries {
+		if entry.EndTime.After(time.Time{}) && timeNow.After(entry.EndTime) {
+			delete(store.entries, key)
+		}
+	}
+}
+
+func generateGossipKey(name string, beginTime time.Time, endTime time.Time, lbs map[string]string) string {
+	var labels []string
+	for k, v := range lbs {
+		labels = append(labels, strconv.Quote(k)+"="+strconv.Quote(v))
+	}
+	sort.Stable(sort.StringSlice(labels))
+	return fmt.Sprintf("%v%v%v_%v%v%v", name, GossipKeySep, beginTime.UnixNano(), endTime.UnixNano(),
+		GossipKeySep, strings.Join(labels, GossipKeySep))
+}
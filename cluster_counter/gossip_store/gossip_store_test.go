@@ -0,0 +1,81 @@
+package gossip_store
+
+import (
+	"github.com/boostlearn/go-cluster-limiter/cluster_counter"
+	"testing"
+	"time"
+)
+
+func TestGossipStore_Merge(t *testing.T) {
+	store := &GossipStore{
+		nodeID:  "a",
+		peers:   make(map[string]bool),
+		entries: make(map[string]*gossipEntry),
+	}
+
+	beginTime := time.Now().Truncate(time.Second)
+	endTime := beginTime.Add(time.Minute)
+	_ = store.Store("test", beginTime, endTime, nil, cluster_counter.CounterValue{Sum: 1, Count: 1}, false)
+
+	msg := &gossipMessage{
+		NodeID: "b",
+		Entries: []*gossipEntry{{
+			Name:      "test",
+			BeginTime: beginTime,
+			EndTime:   endTime,
+			Contributions: map[string]contribution{
+				"a": {Value: cluster_counter.CounterValue{Sum: 100, Count: 100}, Version: 100},
+				"b": {Value: cluster_counter.CounterValue{Sum: 2, Count: 2}, Version: 1},
+			},
+		}},
+	}
+	store.merge(msg)
+	store.merge(msg)
+
+	v, _ := store.Load("test", beginTime, endTime, nil)
+	if v.Sum != 3 || v.Count != 3 {
+		t.Fatal("merge should be idempotent", v)
+	}
+}
+
+func TestGossipStore_Cluster(t *testing.T) {
+	var stores []*GossipStore
+	for i := 0; i < 3; i++ {
+		var peers []string
+		if i > 0 {
+			peers = append(peers, stores[i-1].Addr())
+		}
+		store, err := NewStore(&GossipStoreOpts{
+			BindAddr:       "127.0.0.1:0",
+			Peers:          peers,
+			GossipInterval: 20 * time.Millisecond,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer store.Close()
+		stores = append(stores, store)
+	}
+
+	beginTime := time.Now().Truncate(time.Second)
+	endTime := beginTime.Add(time.Minute)
+	lbs := map[string]string{"a": "b"}
+	for i, store := range stores {
+		_ = store.Store("test", beginTime, endTime, lbs,
+			cluster_counter.CounterValue{Sum: float64(i + 1), Count: 1}, false)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for _, store := range stores {
+		for {
+			v, _ := store.Load("test", beginTime, endTime, lbs)
+			if v.Sum == 6 && v.Count == 3 {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatal("gossip not converged", store.NodeID(), v)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+}
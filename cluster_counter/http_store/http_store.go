@@ -0,0 +1,252 @@
+package http_store
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/boostlearn/go-cluster-limiter/cluster_counter"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const DefaultTimeoutMilliseconds = 100
+
+// store backed by counter-store-server
+type HttpStore struct {
+	client  *http.Client
+	baseUrl string
+}
+
+// build new store from server's address, e.g. "http://127.0.0.1:8080"
+func NewStore(address string, timeout time.Duration) (*HttpStore, error) {
+	if timeout == 0 {
+		timeout = DefaultTimeoutMilliseconds * time.Millisecond
+	}
+	return NewHttpStore(&http.Client{Timeout: timeout}, address)
+}
+
+// build new store from http client
+func NewHttpStore(client *http.Client, address string) (*HttpStore, error) {
+	if len(address) == 0 {
+		return nil, errors.New("address cannot be nil")
+	}
+	if strings.HasPrefix(address, "http://") == false && strings.HasPrefix(address, "https://") == false {
+		address = "http://" + address
+	}
+	return &HttpStore{client: client, baseUrl: strings.TrimRight(address, "/")}, nil
+}
+
+// store client's data within cluster
+func (store *HttpStore) Store(name string, beginTime time.Time, endTime time.Time, lbs map[string]string,
+	value cluster_counter.CounterValue, force bool) error {
+	req := &StoreRequest{
+		Name:      name,
+		BeginTime: beginTime,
+		EndTime:   endTime,
+		Labels:    lbs,
+		Value:     value,
+		Force:     force,
+	}
+	var resp StoreResponse
+	if err := store.post(context.Background(), StorePath, req, &resp); err != nil {
+		return err
+	}
+	if len(resp.Error) > 0 {
+		return errors.New(resp.Error)
+	}
+	return nil
+}
+
+// store client's data, values with the same token are applied only once
+func (store *HttpStore) StoreOnce(token string, name string, beginTime time.Time, endTime time.Time,
+	lbs map[string]string, value cluster_counter.CounterValue, force bool) error {
+	req := &StoreRequest{
+		Name:      name,
+		BeginTime: beginTime,
+		EndTime:   endTime,
+		Labels:    lbs,
+		Value:     value,
+		Force:     force,
+		Token:     token,
+	}
+	var resp StoreResponse
+	if err := store.post(context.Background(), StorePath, req, &resp); err != nil {
+		return err
+	}
+	if len(resp.Error) > 0 {
+		return errors.New(resp.Error)
+	}
+	return nil
+}
+
+// set client's data unless the window has some, returns the data kept by server
+func (store *HttpStore) SetIfAbsent(name string, beginTime time.Time, endTime time.Time, lbs map[string]string,
+	value cluster_counter.CounterValue) (cluster_counter.CounterValue, error) {
+	req := &StoreRequest{
+		Name:      name,
+		BeginTime: beginTime,
+		EndTime:   endTime,
+		Labels:    lbs,
+		Value:     value,
+		Force:     true,
+	}
+	var resp LoadResponse
+	if err := store.post(context.Background(), SetIfAbsentPath, req, &resp); err != nil {
+		return cluster_counter.CounterValue{}, err
+	}
+	if len(resp.Error) > 0 {
+		return resp.Value, errors.New(resp.Error)
+	}
+	return resp.Value, nil
+}
+
+// load cluster's data for clients
+func (store *HttpStore) Load(name string, beginTime time.Time, endTime time.Time, lbs map[string]string,
+) (cluster_counter.CounterValue, error) {
+	req := &LoadRequest{
+		Name:      name,
+		BeginTime: beginTime,
+		EndTime:   endTime,
+		Labels:    lbs,
+	}
+	var resp LoadResponse
+	if err := store.post(context.Background(), LoadPath, req, &resp); err != nil {
+		return cluster_counter.CounterValue{}, err
+	}
+	if len(resp.Error) > 0 {
+		return resp.Value, errors.New(resp.Error)
+	}
+	return resp.Value, nil
+}
+
+// store several counters' data in one request
+func (store *HttpStore) StoreBatch(items []*cluster_counter.StoreItem) []error {
+	return store.storeBatch(context.Background(), items)
+}
+
+// store several counters' data in one request bound to ctx, errors without kind are transient
+func (store *HttpStore) StoreBatchV2(ctx context.Context, nodeID string, items []*cluster_counter.StoreItem) []error {
+	errs := store.storeBatch(ctx, items)
+	for i, err := range errs {
+		errs[i] = cluster_counter.WrapStoreError(err)
+	}
+	return errs
+}
+
+func (store *HttpStore) storeBatch(ctx context.Context, items []*cluster_counter.StoreItem) []error {
+	reqs := make([]*StoreRequest, len(items))
+	for i, item := range items {
+		reqs[i] = &StoreRequest{
+			Name:      item.Name,
+			BeginTime: item.BeginTime,
+			EndTime:   item.EndTime,
+			Labels:    item.Labels,
+			Value:     item.Value,
+			Force:     item.Force,
+			Token:     item.Token,
+		}
+	}
+
+	errs := make([]error, len(items))
+	var responses []*StoreResponse
+	err := store.post(ctx, StoreBatchPath, reqs, &responses)
+	if err == nil && len(responses) != len(reqs) {
+		err = fmt.Errorf("batch size mismatch: %v != %v", len(responses), len(reqs))
+	}
+	if err != nil {
+		for i := range errs {
+			errs[i] = err
+		}
+		return errs
+	}
+
+	for i, resp := range responses {
+		if resp != nil && len(resp.Error) > 0 {
+			errs[i] = errors.New(resp.Error)
+		}
+	}
+	return errs
+}
+
+// load several counters' data in one request
+func (store *HttpStore) LoadBatch(keys []*cluster_counter.StoreKey) ([]cluster_counter.CounterValue, []error) {
+	return store.loadBatch(context.Background(), keys)
+}
+
+// load several counters' data in one request bound to ctx, errors without kind are transient
+func (store *HttpStore) LoadBatchV2(ctx context.Context, nodeID string, keys []*cluster_counter.StoreKey,
+) ([]cluster_counter.CounterValue, []error) {
+	values, errs := store.loadBatch(ctx, keys)
+	for i, err := range errs {
+		errs[i] = cluster_counter.WrapStoreError(err)
+	}
+	return values, errs
+}
+
+func (store *HttpStore) loadBatch(ctx context.Context, keys []*cluster_counter.StoreKey,
+) ([]cluster_counter.CounterValue, []error) {
+	reqs := make([]*LoadRequest, len(keys))
+	for i, key := range keys {
+		reqs[i] = &LoadRequest{
+			Name:      key.Name,
+			BeginTime: key.BeginTime,
+			EndTime:   key.EndTime,
+			Labels:    key.Labels,
+		}
+	}
+
+	values := make([]cluster_counter.CounterValue, len(keys))
+	errs := make([]error, len(keys))
+	var responses []*LoadResponse
+	err := store.post(ctx, LoadBatchPath, reqs, &responses)
+	if err == nil && len(responses) != len(reqs) {
+		err = fmt.Errorf("batch size mismatch: %v != %v", len(responses), len(reqs))
+	}
+	if err != nil {
+		for i := range errs {
+			errs[i] = err
+		}
+		return values, errs
+	}
+
+	for i, resp := range responses {
+		if resp == nil {
+			errs[i] = errors.New("empty response")
+			continue
+		}
+		values[i] = resp.Value
+		if len(resp.Error) > 0 {
+			errs[i] = errors.New(resp.Error)
+		}
+	}
+	return values, errs
+}
+
+func (store *HttpStore) post(ctx context.Context, path string, req interface{}, resp interface{}) error {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, store.baseUrl+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	httpResp, err := store.client.Do(httpReq)
+	if err != nil {
+		return err
+	}
+	defer httpResp.Body.Close()
+
+	if httpResp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(io.LimitReader(httpResp.Body, 1024))
+		return fmt.Errorf("store server error: %v %v", httpResp.Status, strings.TrimSpace(string(msg)))
+	}
+	return json.NewDecoder(httpResp.Body).Decode(resp)
+}
@@ -0,0 +1,118 @@
+package http_store
+
+import (
+	"github.com/boostlearn/go-cluster-limiter/cluster_counter"
+	"github.com/boostlearn/go-cluster-limiter/cluster_counter/memory_store"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestHttpStore_StoreAndLoad(t *testing.T) {
+	server := httptest.NewServer(NewServer(memory_store.NewStore()))
+	defer server.Close()
+
+	store, err := NewStore(server.URL, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	startTime := time.Now().Truncate(time.Second)
+	endTime := startTime.Add(10 * time.Second)
+	lbs := map[string]string{"a1": "c2"}
+
+	for i := 0; i < 2; i++ {
+		err = store.Store("test", startTime, endTime, lbs, cluster_counter.CounterValue{Sum: 100, Count: 1}, false)
+		if err != nil {
+			t.Fatal("store data error", err)
+		}
+	}
+
+	v, err := store.Load("test", startTime, endTime, lbs)
+	if err != nil {
+		t.Fatal("load data error", err)
+	}
+	if v.Sum != 200 || v.Count != 2 {
+		t.Fatal("query value error", v)
+	}
+}
+
+func TestHttpStore_Batch(t *testing.T) {
+	server := httptest.NewServer(NewServer(memory_store.NewStore()))
+	defer server.Close()
+
+	store, _ := NewStore(server.URL, time.Second)
+	var _ cluster_counter.BatchDataStoreI = store
+
+	startTime := time.Now().Truncate(time.Second)
+	endTime := startTime.Add(10 * time.Second)
+	keys := []*cluster_counter.StoreKey{
+		{Name: "a", BeginTime: startTime, EndTime: endTime},
+		{Name: "b", BeginTime: startTime, EndTime: endTime},
+	}
+	errs := store.StoreBatch([]*cluster_counter.StoreItem{
+		{StoreKey: *keys[0], Value: cluster_counter.CounterValue{Sum: 1, Count: 1}},
+		{StoreKey: *keys[1], Value: cluster_counter.CounterValue{Sum: 2, Count: 1}},
+	})
+	if len(errs) != 2 || errs[0] != nil || errs[1] != nil {
+		t.Fatal("store batch error", errs)
+	}
+
+	values, errs := store.LoadBatch(keys)
+	if len(values) != 2 || errs[0] != nil || errs[1] != nil {
+		t.Fatal("load batch error", errs)
+	}
+	if values[0].Sum != 1 || values[1].Sum != 2 {
+		t.Fatal("query value error", values)
+	}
+}
+
+// store without StoreOnce
+type plainStoreForTest struct {
+	store *memory_store.MemoryStore
+}
+
+func (store *plainStoreForTest) Store(name string, beginTime time.Time, endTime time.Time, lbs map[string]string,
+	value cluster_counter.CounterValue, force bool) error {
+	return store.store.Store(name, beginTime, endTime, lbs, value, force)
+}
+
+func (store *plainStoreForTest) Load(name string, beginTime time.Time, endTime time.Time, lbs map[string]string,
+) (cluster_counter.CounterValue, error) {
+	return store.store.Load(name, beginTime, endTime, lbs)
+}
+
+func TestHttpStore_StoreOnce(t *testing.T) {
+	server := httptest.NewServer(NewServer(&plainStoreForTest{store: memory_store.NewStore()}))
+	defer server.Close()
+
+	store, _ := NewStore(server.URL, time.Second)
+	startTime := time.Now().Truncate(time.Second)
+	endTime := startTime.Add(10 * time.Second)
+	for i := 0; i < 2; i++ {
+		if err := store.StoreOnce("t1", "test", startTime, endTime, nil, cluster_counter.CounterValue{Sum: 1, Count: 1}, false); err != nil {
+			t.Fatal("store data error", err)
+		}
+	}
+
+	v, _ := store.Load("test", startTime, endTime, nil)
+	if v.Sum != 1 {
+		t.Fatal("token should be applied once by server", v)
+	}
+}
+
+func TestHttpStore_SetIfAbsent(t *testing.T) {
+	startTime := time.Now().Truncate(time.Second)
+	endTime := startTime.Add(10 * time.Second)
+	for _, backend := range []cluster_counter.DataStoreI{memory_store.NewStore(), &plainStoreForTest{store: memory_store.NewStore()}} {
+		server := httptest.NewServer(NewServer(backend))
+		store, _ := NewStore(server.URL, time.Second)
+		for i := 1; i <= 2; i++ {
+			kept, err := store.SetIfAbsent("test", startTime, endTime, nil, cluster_counter.CounterValue{Sum: float64(i), Count: 1})
+			if err != nil || kept.Sum != 1 {
+				t.Fatal("first value should be kept", kept, err)
+			}
+		}
+		server.Close()
+	}
+}
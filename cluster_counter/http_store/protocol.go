@@ -0,0 +1,43 @@
+package http_store
+
+import (
+	"github.com/boostlearn/go-cluster-limiter/cluster_counter"
+	"time"
+)
+
+const StorePath = "/store"
+const LoadPath = "/load"
+const StoreBatchPath = "/store_batch"
+const LoadBatchPath = "/load_batch"
+
+// takes StoreRequest without token and returns LoadResponse with the value kept
+const SetIfAbsentPath = "/set_if_absent"
+
+// body of store request
+type StoreRequest struct {
+	Name      string
+	BeginTime time.Time
+	EndTime   time.Time
+	Labels    map[string]string
+	Value     cluster_counter.CounterValue
+	Force     bool
+	// applied only once when not empty and backend supports it
+	Token string `json:",omitempty"`
+}
+
+type StoreResponse struct {
+	Error string `json:",omitempty"`
+}
+
+// body of load request
+type LoadRequest struct {
+	Name      string
+	BeginTime time.Time
+	EndTime   time.Time
+	Labels    map[string]string
+}
+
+type LoadResponse struct {
+	Value cluster_counter.CounterValue
+	Error string `json:",omitempty"`
+}
@@ -0,0 +1,208 @@
+package http_store
+
+import (
+	"encoding/json"
+	"github.com/boostlearn/go-cluster-limiter/cluster_counter"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const MaxRequestBodyBytes = 16 << 20
+
+// serve store's Store and Load over http.
+// tokens are applied once, and values set if absent, by the store if it can, or else by the server,
+// which then should be the only one in front of the store
+type Server struct {
+	store cluster_counter.DataStoreI
+	mux   *http.ServeMux
+	clock cluster_counter.Clock
+
+	mu            sync.Mutex
+	tokens        map[string]time.Time
+	lastSweepTime time.Time
+	setMu         sync.Mutex
+}
+
+// build http handler for store
+func NewServer(store cluster_counter.DataStoreI) *Server {
+	return NewServerWithClock(store, cluster_counter.RealClock)
+}
+
+// build http handler for store, tokens expire by clock
+func NewServerWithClock(store cluster_counter.DataStoreI, clock cluster_counter.Clock) *Server {
+	server := &Server{store: store, mux: http.NewServeMux(), clock: clock, tokens: make(map[string]time.Time)}
+	server.mux.HandleFunc(StorePath, server.handleStore)
+	server.mux.HandleFunc(LoadPath, server.handleLoad)
+	server.mux.HandleFunc(StoreBatchPath, server.handleStoreBatch)
+	server.mux.HandleFunc(LoadBatchPath, server.handleLoadBatch)
+	server.mux.HandleFunc(SetIfAbsentPath, server.handleSetIfAbsent)
+	return server
+}
+
+func (server *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	server.mux.ServeHTTP(w, r)
+}
+
+func (server *Server) handleStore(w http.ResponseWriter, r *http.Request) {
+	var req StoreRequest
+	if decodeRequest(w, r, &req) == false {
+		return
+	}
+	writeResponse(w, server.storeOne(&req))
+}
+
+func (server *Server) handleLoad(w http.ResponseWriter, r *http.Request) {
+	var req LoadRequest
+	if decodeRequest(w, r, &req) == false {
+		return
+	}
+	writeResponse(w, server.loadOne(&req))
+}
+
+func (server *Server) handleStoreBatch(w http.ResponseWriter, r *http.Request) {
+	var reqs []*StoreRequest
+	if decodeRequest(w, r, &reqs) == false {
+		return
+	}
+	responses := make([]*StoreResponse, len(reqs))
+	for i, req := range reqs {
+		responses[i] = server.storeOne(req)
+	}
+	writeResponse(w, responses)
+}
+
+func (server *Server) handleLoadBatch(w http.ResponseWriter, r *http.Request) {
+	var reqs []*LoadRequest
+	if decodeRequest(w, r, &reqs) == false {
+		return
+	}
+	responses := make([]*LoadResponse, len(reqs))
+	for i, req := range reqs {
+		responses[i] = server.loadOne(req)
+	}
+	writeResponse(w, responses)
+}
+
+func (server *Server) handleSetIfAbsent(w http.ResponseWriter, r *http.Request) {
+	var req StoreRequest
+	if decodeRequest(w, r, &req) == false {
+		return
+	}
+
+	resp := &LoadResponse{}
+	var err error
+	if setStore, ok := server.store.(cluster_counter.SetIfAbsentDataStoreI); ok {
+		resp.Value, err = setStore.SetIfAbsent(req.Name, req.BeginTime, req.EndTime, req.Labels, req.Value)
+	} else {
+		resp.Value, err = server.setIfAbsent(&req)
+	}
+	if err != nil {
+		resp.Error = err.Error()
+	}
+	writeResponse(w, resp)
+}
+
+// set value unless window has one, for store which cannot do it itself; a zero value counts as none
+func (server *Server) setIfAbsent(req *StoreRequest) (cluster_counter.CounterValue, error) {
+	server.setMu.Lock()
+	defer server.setMu.Unlock()
+
+	value, err := server.store.Load(req.Name, req.BeginTime, req.EndTime, req.Labels)
+	if err != nil || value != (cluster_counter.CounterValue{}) {
+		return value, err
+	}
+	if err := server.store.Store(req.Name, req.BeginTime, req.EndTime, req.Labels, req.Value, true); err != nil {
+		return value, err
+	}
+	return req.Value, nil
+}
+
+func (server *Server) storeOne(req *StoreRequest) *StoreResponse {
+	resp := &StoreResponse{}
+	if req == nil {
+		resp.Error = "empty request"
+		return resp
+	}
+	var err error
+	if idempotentStore, ok := server.store.(cluster_counter.IdempotentDataStoreI); ok && len(req.Token) > 0 {
+		err = idempotentStore.StoreOnce(req.Token, req.Name, req.BeginTime, req.EndTime, req.Labels, req.Value,
+			req.Force)
+	} else if len(req.Token) > 0 {
+		err = server.storeOnce(req)
+	} else {
+		err = server.store.Store(req.Name, req.BeginTime, req.EndTime, req.Labels, req.Value, req.Force)
+	}
+	if err != nil {
+		resp.Error = err.Error()
+	}
+	return resp
+}
+
+// store request once per token for store which is not idempotent itself
+func (server *Server) storeOnce(req *StoreRequest) error {
+	server.mu.Lock()
+	timeNow := server.clock.Now()
+	server.sweep(timeNow)
+	if expireTime, ok := server.tokens[req.Token]; ok && timeNow.After(expireTime) == false {
+		server.mu.Unlock()
+		return nil
+	}
+	server.tokens[req.Token] = cluster_counter.TokenExpireTime(timeNow)
+	server.mu.Unlock()
+
+	err := server.store.Store(req.Name, req.BeginTime, req.EndTime, req.Labels, req.Value, req.Force)
+	if err != nil {
+		// failed value is not applied, so it can be retried with the same token
+		server.mu.Lock()
+		delete(server.tokens, req.Token)
+		server.mu.Unlock()
+	}
+	return err
+}
+
+// drop expired tokens, called with lock held
+func (server *Server) sweep(timeNow time.Time) {
+	if timeNow.Before(server.lastSweepTime.Add(time.Second)) {
+		return
+	}
+	server.lastSweepTime = timeNow
+
+	for token, expireTime := range server.tokens {
+		if timeNow.After(expireTime) {
+			delete(server.tokens, token)
+		}
+	}
+}
+
+func (server *Server) loadOne(req *LoadRequest) *LoadResponse {
+	resp := &LoadResponse{}
+	if req == nil {
+		resp.Error = "empty request"
+		return resp
+	}
+	value, err := server.store.Load(req.Name, req.BeginTime, req.EndTime, req.Labels)
+	if err != nil {
+		resp.Error = err.Error()
+	}
+	resp.Value = value
+	return resp
+}
+
+func decodeRequest(w http.ResponseWriter, r *http.Request, req interface{}) bool {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return false
+	}
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, MaxRequestBodyBytes)).Decode(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+func writeResponse(w http.ResponseWriter, resp interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(resp)
+}
@@ -0,0 +1,352 @@
+package cluster_counter
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const DefaultJournalIntervalMilliseconds = 1000
+const DefaultJournalMaxBytes = 16 << 20
+
+const (
+	journalOpPending = "pending" // latest un-flushed delta of counter's window
+	journalOpPush    = "push"    // delta about to be stored, covers all pending delta before it
+	journalOpAck     = "ack"     // push stored
+	journalOpAbort   = "abort"   // push failed, delta is still pending in memory
+)
+
+type journalRecord struct {
+	Op        string
+	Token     string
+	Name      string            `json:",omitempty"`
+	BeginTime time.Time         `json:",omitempty"`
+	EndTime   time.Time         `json:",omitempty"`
+	Labels    map[string]string `json:",omitempty"`
+	Value     CounterValue
+}
+
+// append-only file of deltas not stored yet, replayed into the store on next startup
+// records are flushed to the OS before each store call and synced to disk every checkpoint
+type journal struct {
+	mu       sync.Mutex
+	path     string
+	file     *os.File
+	writer   *bufio.Writer
+	size     int64
+	maxBytes int64
+
+	tokenPrefix string
+	seq         int64
+
+	pending map[string]*journalRecord
+	pushes  map[string]*journalRecord
+}
+
+// open journal and read records left by previous process
+func openJournal(path string, maxBytes int64) (*journal, error) {
+	if maxBytes <= 0 {
+		maxBytes = DefaultJournalMaxBytes
+	}
+
+	hostname, _ := os.Hostname()
+	j := &journal{
+		path:        path,
+		maxBytes:    maxBytes,
+		tokenPrefix: fmt.Sprintf("%v:%v:%v", hostname, os.Getpid(), time.Now().UnixNano()),
+		pending:     make(map[string]*journalRecord),
+		pushes:      make(map[string]*journalRecord),
+	}
+
+	if err := j.read(); err != nil {
+		return nil, err
+	}
+	if err := j.rewrite(); err != nil {
+		return nil, err
+	}
+	return j, nil
+}
+
+func (j *journal) read() error {
+	file, err := os.Open(j.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16<<20)
+	for scanner.Scan() {
+		var record journalRecord
+		if json.Unmarshal(scanner.Bytes(), &record) != nil {
+			// partial line written by a crash
+			continue
+		}
+		j.apply(&record)
+	}
+	return scanner.Err()
+}
+
+// update live state with one record
+func (j *journal) apply(record *journalRecord) {
+	switch record.Op {
+	case journalOpPending:
+		key := journalKey(record)
+		if record.Value.Count == 0 && record.Value.Sum == 0 {
+			delete(j.pending, key)
+		} else {
+			j.pending[key] = record
+		}
+	case journalOpPush:
+		delete(j.pending, journalKey(record))
+		j.pushes[record.Token] = record
+	case journalOpAck, journalOpAbort:
+		delete(j.pushes, record.Token)
+	}
+}
+
+func (j *journal) newToken() string {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	j.seq += 1
+	return j.tokenPrefix + ":" + strconv.FormatInt(j.seq, 10)
+}
+
+func (j *journal) append(record *journalRecord) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if j.writer == nil {
+		return errors.New("journal closed")
+	}
+	j.apply(record)
+
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	n, err := j.writer.Write(append(data, '\n'))
+	j.size += int64(n)
+	return err
+}
+
+// record latest un-flushed delta of counter's window
+func (j *journal) checkpoint(key StoreKey, value CounterValue) error {
+	return j.append(&journalRecord{
+		Op:        journalOpPending,
+		Token:     j.newToken(),
+		Name:      key.Name,
+		BeginTime: key.BeginTime,
+		EndTime:   key.EndTime,
+		Labels:    key.Labels,
+		Value:     value,
+	})
+}
+
+// record delta about to be stored
+func (j *journal) push(item *StoreItem) error {
+	return j.append(&journalRecord{
+		Op:        journalOpPush,
+		Token:     item.Token,
+		Name:      item.Name,
+		BeginTime: item.BeginTime,
+		EndTime:   item.EndTime,
+		Labels:    item.Labels,
+		Value:     item.Value,
+	})
+}
+
+// record result of push
+func (j *journal) finish(item *StoreItem, err error) error {
+	if err == nil {
+		return j.append(&journalRecord{Op: journalOpAck, Token: item.Token})
+	}
+	return j.append(&journalRecord{Op: journalOpAbort, Token: item.Token})
+}
+
+// write buffered records to the OS
+func (j *journal) flush() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	return j.writer.Flush()
+}
+
+// write buffered records to disk, compact file when too large
+func (j *journal) sync() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if j.size > j.maxBytes {
+		return j.rewriteLocked()
+	}
+	if err := j.writer.Flush(); err != nil {
+		return err
+	}
+	return j.file.Sync()
+}
+
+// records to replay into store: pushes without result and latest pending deltas
+func (j *journal) replayItems() []*StoreItem {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	var records []*journalRecord
+	for _, record := range j.pushes {
+		records = append(records, record)
+	}
+	for _, record := range j.pending {
+		records = append(records, record)
+	}
+	sort.Slice(records, func(a, b int) bool { return records[a].Token < records[b].Token })
+
+	var items []*StoreItem
+	for _, record := range records {
+		items = append(items, &StoreItem{
+			StoreKey: StoreKey{
+				Name:      record.Name,
+				BeginTime: record.BeginTime,
+				EndTime:   record.EndTime,
+				Labels:    record.Labels,
+			},
+			Value:  record.Value,
+			Force:  true,
+			Token:  record.Token,
+			Reason: StoreReasonReplay,
+		})
+	}
+	return items
+}
+
+// forget replayed record
+func (j *journal) replayed(item *StoreItem) error {
+	j.mu.Lock()
+	record, ok := j.pushes[item.Token]
+	if ok == false {
+		key := journalKey(&journalRecord{
+			Name:      item.Name,
+			BeginTime: item.BeginTime,
+			EndTime:   item.EndTime,
+			Labels:    item.Labels,
+		})
+		if pending, ok := j.pending[key]; ok && pending.Token == item.Token {
+			record = pending
+		}
+	}
+	j.mu.Unlock()
+
+	if record == nil {
+		return nil
+	}
+	if record.Op == journalOpPush {
+		return j.append(&journalRecord{Op: journalOpAck, Token: record.Token})
+	}
+	cleared := *record
+	cleared.Value = CounterValue{}
+	return j.append(&cleared)
+}
+
+// drop all records of counter
+func (j *journal) forget(name string) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	for _, records := range []map[string]*journalRecord{j.pushes, j.pending} {
+		for key, record := range records {
+			if record.Name == name {
+				delete(records, key)
+			}
+		}
+	}
+	return j.rewriteLocked()
+}
+
+func (j *journal) rewrite() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	return j.rewriteLocked()
+}
+
+// replace file with live records only
+func (j *journal) rewriteLocked() error {
+	if j.writer != nil {
+		_ = j.writer.Flush()
+	}
+	if j.file != nil {
+		_ = j.file.Close()
+		j.file = nil
+	}
+
+	tmpPath := j.path + ".tmp"
+	tmpFile, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+
+	writer := bufio.NewWriter(tmpFile)
+	var size int64
+	for _, records := range []map[string]*journalRecord{j.pushes, j.pending} {
+		for _, record := range records {
+			data, _ := json.Marshal(record)
+			n, _ := writer.Write(append(data, '\n'))
+			size += int64(n)
+		}
+	}
+	err = writer.Flush()
+	if err == nil {
+		err = tmpFile.Sync()
+	}
+	_ = tmpFile.Close()
+	if err == nil {
+		err = os.Rename(tmpPath, j.path)
+	}
+	if err != nil {
+		return err
+	}
+
+	j.file, err = os.OpenFile(j.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	j.writer = bufio.NewWriter(j.file)
+	j.size = size
+	return nil
+}
+
+func (j *journal) close() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if j.file == nil {
+		return nil
+	}
+	err := j.writer.Flush()
+	if err == nil {
+		err = j.file.Sync()
+	}
+	_ = j.file.Close()
+	j.file = nil
+	return err
+}
+
+func journalKey(record *journalRecord) string {
+	var labels []string
+	for k, v := range record.Labels {
+		labels = append(labels, strconv.Quote(k)+"="+strconv.Quote(v))
+	}
+	sort.Strings(labels)
+	return fmt.Sprintf("%v####%v_%v####%v", record.Name, record.BeginTime.UnixNano(), record.EndTime.UnixNano(),
+		strings.Join(labels, "####"))
+}
@@ -0,0 +1,122 @@
+package cluster_counter
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type journalStoreForTest struct {
+	fail   bool
+	value  CounterValue
+	tokens map[string]bool
+}
+
+func (store *journalStoreForTest) Store(name string, beginTime time.Time, endTime time.Time, lbs map[string]string,
+	value CounterValue, force bool) error {
+	if store.fail {
+		return errors.New("store unavailable")
+	}
+	store.value = store.value.Add(value)
+	return nil
+}
+
+func (store *journalStoreForTest) StoreOnce(token string, name string, beginTime time.Time, endTime time.Time,
+	lbs map[string]string, value CounterValue, force bool) error {
+	if store.fail {
+		return errors.New("store unavailable")
+	}
+	if store.tokens[token] {
+		return nil
+	}
+	store.tokens[token] = true
+	return store.Store(name, beginTime, endTime, lbs, value, force)
+}
+
+func (store *journalStoreForTest) Load(name string, beginTime time.Time, endTime time.Time, lbs map[string]string,
+) (CounterValue, error) {
+	if store.fail {
+		return CounterValue{}, errors.New("store unavailable")
+	}
+	return store.value, nil
+}
+
+func TestJournal_ReplayAfterCrash(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "journal")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "counter.journal")
+
+	store := &journalStoreForTest{tokens: make(map[string]bool)}
+	factory := NewFactory(&ClusterCounterFactoryOpts{Store: store, JournalPath: path})
+	factory.Stop()
+	if factory.JournalError() != nil {
+		t.Fatal(factory.JournalError())
+	}
+
+	counter, _ := factory.NewClusterCounter(&ClusterCounterOpts{Name: "test", ResetInterval: time.Hour})
+	store.fail = true
+	counter.Add(2)
+	counter.Add(3)
+	factory.Heartbeat()
+	if store.value.Count != 0 {
+		t.Fatal("store should be unavailable")
+	}
+
+	// process crashed, the next one replays journal
+	store.fail = false
+	factory2 := NewFactory(&ClusterCounterFactoryOpts{Store: store, JournalPath: path})
+	factory2.Stop()
+	if store.value.Sum != 5 || store.value.Count != 2 {
+		t.Fatal("pending delta should be replayed", store.value)
+	}
+
+	factory3 := NewFactory(&ClusterCounterFactoryOpts{Store: store, JournalPath: path})
+	factory3.Stop()
+	if store.value.Sum != 5 {
+		t.Fatal("replayed delta should be removed from journal", store.value)
+	}
+}
+
+func TestJournal_OpenError(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "journal")
+	defer os.RemoveAll(dir)
+
+	factory := NewFactory(&ClusterCounterFactoryOpts{JournalPath: filepath.Join(dir, "missing", "counter.journal")})
+	factory.Stop()
+	if factory.JournalError() == nil {
+		t.Fatal("error of opening journal should be reported")
+	}
+}
+
+func TestJournal_ReplayIdempotent(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "journal")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "counter.journal")
+
+	j, err := openJournal(path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	item := &StoreItem{
+		StoreKey: StoreKey{Name: "test", BeginTime: time.Now(), EndTime: time.Now().Add(time.Hour)},
+		Value:    CounterValue{Sum: 1, Count: 1},
+		Token:    j.newToken(),
+	}
+	_ = j.push(item)
+	_ = j.close()
+	unacked, _ := ioutil.ReadFile(path)
+
+	store := &journalStoreForTest{tokens: make(map[string]bool)}
+	for i := 0; i < 2; i++ {
+		// the push may have reached store before crash, replay it twice
+		_ = ioutil.WriteFile(path, unacked, 0644)
+		factory := NewFactory(&ClusterCounterFactoryOpts{Store: store, JournalPath: path})
+		factory.Stop()
+	}
+	if store.value.Count != 1 {
+		t.Fatal("replay should be idempotent", store.value)
+	}
+}
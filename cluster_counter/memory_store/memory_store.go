@@ -0,0 +1,229 @@
+package memory_store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/boostlearn/go-cluster-limiter/cluster_counter"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const MemoryKeySep = "####"
+
+type memoryValue struct {
+	key     cluster_counter.StoreKey
+	value   cluster_counter.CounterValue
+	endTime time.Time
+}
+
+// store within one process, shared by factories to simulate a cluster
+type MemoryStore struct {
+	mu     sync.Mutex
+	values map[string]*memoryValue
+	tokens map[string]time.Time
+	clock  cluster_counter.Clock
+
+	lastSweepTime time.Time
+}
+
+// build new store in memory
+func NewStore() *MemoryStore {
+	return NewStoreWithClock(cluster_counter.RealClock)
+}
+
+// build new store in memory, keys expire by clock, which should be the same as counters'
+func NewStoreWithClock(clock cluster_counter.Clock) *MemoryStore {
+	return &MemoryStore{values: make(map[string]*memoryValue), tokens: make(map[string]time.Time), clock: clock}
+}
+
+// store client's data within cluster
+func (store *MemoryStore) Store(name string, beginTime time.Time, endTime time.Time, lbs map[string]string,
+	value cluster_counter.CounterValue, force bool) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	store.add(name, beginTime, endTime, lbs, value)
+	return nil
+}
+
+// store client's data, values with the same token are applied only once
+func (store *MemoryStore) StoreOnce(token string, name string, beginTime time.Time, endTime time.Time,
+	lbs map[string]string, value cluster_counter.CounterValue, force bool) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	if _, ok := store.tokens[token]; ok {
+		return nil
+	}
+	store.tokens[token] = cluster_counter.TokenExpireTime(store.clock.Now())
+	store.add(name, beginTime, endTime, lbs, value)
+	return nil
+}
+
+// set client's data unless the window has some, returns the data kept
+func (store *MemoryStore) SetIfAbsent(name string, beginTime time.Time, endTime time.Time, lbs map[string]string,
+	value cluster_counter.CounterValue) (cluster_counter.CounterValue, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	v, ok := store.values[generateMemoryKey(name, beginTime, endTime, lbs)]
+	if ok && (v.endTime.After(time.Time{}) == false || store.clock.Now().After(v.endTime) == false) {
+		return v.value, nil
+	}
+	store.add(name, beginTime, endTime, lbs, value)
+	return value, nil
+}
+
+func (store *MemoryStore) add(name string, beginTime time.Time, endTime time.Time, lbs map[string]string,
+	value cluster_counter.CounterValue) {
+	key := generateMemoryKey(name, beginTime, endTime, lbs)
+
+	timeNow := store.clock.Now()
+	store.sweep(timeNow)
+
+	v, ok := store.values[key]
+	if ok == false || (v.endTime.After(time.Time{}) && timeNow.After(v.endTime)) {
+		v = &memoryValue{
+			key:     cluster_counter.StoreKey{Name: name, BeginTime: beginTime, EndTime: endTime, Labels: copyLabels(lbs)},
+			endTime: endTime,
+		}
+		store.values[key] = v
+	}
+	v.value = v.value.Add(value)
+}
+
+// load cluster's data for clients
+func (store *MemoryStore) Load(name string, beginTime time.Time, endTime time.Time, lbs map[string]string,
+) (cluster_counter.CounterValue, error) {
+	key := generateMemoryKey(name, beginTime, endTime, lbs)
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	v, ok := store.values[key]
+	if ok == false {
+		return cluster_counter.CounterValue{}, nil
+	}
+	if v.endTime.After(time.Time{}) && store.clock.Now().After(v.endTime) {
+		delete(store.values, key)
+		return cluster_counter.CounterValue{}, nil
+	}
+	return v.value, nil
+}
+
+// store with context, values with token are applied only once
+func (store *MemoryStore) StoreV2(ctx context.Context, nodeID string, item *cluster_counter.StoreItem) error {
+	if err := ctx.Err(); err != nil {
+		return cluster_counter.NewTransientError(err)
+	}
+
+	if len(item.Token) > 0 {
+		return store.StoreOnce(item.Token, item.Name, item.BeginTime, item.EndTime, item.Labels, item.Value, item.Force)
+	}
+	return store.Store(item.Name, item.BeginTime, item.EndTime, item.Labels, item.Value, item.Force)
+}
+
+// load with context, missing or expired key is not found error
+func (store *MemoryStore) LoadV2(ctx context.Context, nodeID string, key *cluster_counter.StoreKey,
+) (cluster_counter.CounterValue, error) {
+	if err := ctx.Err(); err != nil {
+		return cluster_counter.CounterValue{}, cluster_counter.NewTransientError(err)
+	}
+
+	memoryKey := generateMemoryKey(key.Name, key.BeginTime, key.EndTime, key.Labels)
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	v, ok := store.values[memoryKey]
+	if ok == false || (v.endTime.After(time.Time{}) && store.clock.Now().After(v.endTime)) {
+		return cluster_counter.CounterValue{}, cluster_counter.NewNotFoundError(errors.New("key not found"))
+	}
+	return v.value, nil
+}
+
+// unexpired windows of counters whose name starts with namePrefix
+func (store *MemoryStore) ListKeys(namePrefix string) ([]*cluster_counter.StoreKey, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	timeNow := store.clock.Now()
+	var keys []*cluster_counter.StoreKey
+	for _, v := range store.values {
+		if v.endTime.After(time.Time{}) && timeNow.After(v.endTime) {
+			continue
+		}
+		if strings.HasPrefix(v.key.Name, namePrefix) {
+			key := v.key
+			key.Labels = copyLabels(v.key.Labels)
+			keys = append(keys, &key)
+		}
+	}
+	return keys, nil
+}
+
+// remove counter's window
+func (store *MemoryStore) Delete(key *cluster_counter.StoreKey) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	delete(store.values, generateMemoryKey(key.Name, key.BeginTime, key.EndTime, key.Labels))
+	return nil
+}
+
+// number of unexpired keys
+func (store *MemoryStore) Len() int {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	timeNow := store.clock.Now()
+	size := 0
+	for _, v := range store.values {
+		if v.endTime.After(time.Time{}) && timeNow.After(v.endTime) {
+			continue
+		}
+		size++
+	}
+	return size
+}
+
+// remove expired keys, at most once per second
+func (store *MemoryStore) sweep(timeNow time.Time) {
+	if timeNow.Before(store.lastSweepTime.Add(time.Second)) {
+		return
+	}
+	store.lastSweepTime = timeNow
+
+	for key, v := range store.values {
+		if v.endTime.After(time.Time{}) && timeNow.After(v.endTime) {
+			delete(store.values, key)
+		}
+	}
+	for token, expireTime := range store.tokens {
+		if timeNow.After(expireTime) {
+			delete(store.tokens, token)
+		}
+	}
+}
+
+func copyLabels(lbs map[string]string) map[string]string {
+	labels := make(map[string]string, len(lbs))
+	for k, v := range lbs {
+		labels[k] = v
+	}
+	return labels
+}
+
+func generateMemoryKey(name string, beginTime time.Time, endTime time.Time, lbs map[string]string) string {
+	var labels []string
+	for k, v := range lbs {
+		labels = append(labels, strconv.Quote(k)+"="+strconv.Quote(v))
+	}
+	sort.Stable(sort.StringSlice(labels))
+	return fmt.Sprintf("%v%v%v_%v%v%v", name, MemoryKeySep, beginTime.UnixNano(), endTime.UnixNano(),
+		MemoryKeySep, strings.Join(labels, MemoryKeySep))
+}
@@ -0,0 +1,177 @@
+package memory_store
+
+import (
+	"context"
+	"github.com/boostlearn/go-cluster-limiter/cluster_counter"
+	"github.com/boostlearn/go-cluster-limiter/cluster_counter/clocktest"
+	"testing"
+	"time"
+)
+
+func TestMemoryStore_StoreAndLoad(t *testing.T) {
+	store := NewStore()
+
+	startTime := time.Now().Truncate(time.Second)
+	endTime := startTime.Add(10 * time.Second)
+	lbs := make(map[string]string)
+	lbs["a1"] = "c2"
+	lbs["a2"] = "c1"
+
+	err := store.Store("test", startTime, endTime, lbs, cluster_counter.CounterValue{Sum: 100, Count: 1}, false)
+	if err != nil {
+		t.Fatal("store data error", err)
+	}
+
+	v, err := store.Load("test", startTime, endTime, lbs)
+	if err != nil {
+		t.Fatal("load data error", err)
+	}
+	if v.Sum != 100 || v.Count != 1 {
+		t.Fatal("query value error")
+	}
+
+	_ = store.Store("test", startTime, endTime, lbs, cluster_counter.CounterValue{Sum: 200, Count: 1}, false)
+	v2, _ := store.Load("test", startTime, endTime, lbs)
+	if v2.Sum != 300 || v2.Count != 2 {
+		t.Fatal("merge data error")
+	}
+
+	swapped := map[string]string{"a1": "c1", "a2": "c2"}
+	v3, _ := store.Load("test", startTime, endTime, swapped)
+	if v3.Count != 0 {
+		t.Fatal("labels should not collide")
+	}
+}
+
+func TestMemoryStore_Expire(t *testing.T) {
+	store := NewStore()
+
+	startTime := time.Now().Add(-10 * time.Second)
+	endTime := time.Now().Add(-time.Second)
+	_ = store.Store("test", startTime, endTime, nil, cluster_counter.CounterValue{Sum: 100, Count: 1}, true)
+
+	v, _ := store.Load("test", startTime, endTime, nil)
+	if v.Count != 0 || store.Len() != 0 {
+		t.Fatal("expired data should be dropped")
+	}
+}
+
+func TestMemoryStore_Cluster(t *testing.T) {
+	store := NewStore()
+
+	var counters []*cluster_counter.ClusterCounter
+	for i := 0; i < 2; i++ {
+		factory := cluster_counter.NewFactory(&cluster_counter.ClusterCounterFactoryOpts{
+			Name:  "test",
+			Store: store,
+		})
+		factory.Stop()
+
+		counter, err := factory.NewClusterCounter(&cluster_counter.ClusterCounterOpts{
+			Name:          "test",
+			ResetInterval: time.Hour,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		counters = append(counters, counter)
+	}
+
+	counters[0].Add(1)
+	counters[0].Add(1)
+	counters[1].Add(1)
+	for _, counter := range counters {
+		counter.StoreData()
+	}
+	beginTime := time.Now().Truncate(time.Hour)
+	v, _ := store.Load("test", beginTime, beginTime.Add(time.Hour), nil)
+	if v.Count != 3 {
+		t.Fatal("cluster value error", v)
+	}
+}
+
+func TestMemoryStore_StoreOnce(t *testing.T) {
+	store := NewStore()
+
+	startTime := time.Now().Truncate(time.Second)
+	endTime := startTime.Add(10 * time.Second)
+	for i := 0; i < 2; i++ {
+		_ = store.StoreOnce("token-1", "test", startTime, endTime, nil, cluster_counter.CounterValue{Sum: 1, Count: 1}, true)
+	}
+	_ = store.StoreOnce("token-2", "test", startTime, endTime, nil, cluster_counter.CounterValue{Sum: 1, Count: 1}, true)
+
+	v, _ := store.Load("test", startTime, endTime, nil)
+	if v.Count != 2 {
+		t.Fatal("token should be applied once", v)
+	}
+}
+
+func TestMemoryStore_SetIfAbsent(t *testing.T) {
+	store := NewStore()
+
+	startTime := time.Now().Truncate(time.Second)
+	endTime := startTime.Add(10 * time.Second)
+	for i := 1; i <= 2; i++ {
+		kept, err := store.SetIfAbsent("test", startTime, endTime, nil, cluster_counter.CounterValue{Sum: float64(i), Count: 1})
+		if err != nil || kept.Sum != 1 {
+			t.Fatal("first value should be kept", kept, err)
+		}
+	}
+	if v, _ := store.Load("test", startTime, endTime, nil); v.Sum != 1 || v.Count != 1 {
+		t.Fatal("value should be set once", v)
+	}
+}
+
+func TestMemoryStore_TokenExpire(t *testing.T) {
+	clock := clocktest.NewFakeClock(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	store := NewStoreWithClock(clock)
+
+	// window of limiter's counters lasts for centuries, tokens do not
+	startTime := time.Date(1900, 1, 1, 0, 0, 0, 0, time.UTC)
+	endTime := time.Date(3000, 1, 1, 0, 0, 0, 0, time.UTC)
+	_ = store.StoreOnce("token-1", "test", startTime, endTime, nil, cluster_counter.CounterValue{Sum: 1, Count: 1}, true)
+
+	clock.Advance(cluster_counter.DefaultTokenExpireSeconds*time.Second + time.Second)
+	_ = store.Store("test", startTime, endTime, nil, cluster_counter.CounterValue{}, true)
+	if len(store.tokens) != 0 {
+		t.Fatal("token should expire after fixed horizon", store.tokens)
+	}
+}
+
+func TestMemoryStore_LoadV2(t *testing.T) {
+	store := NewStore()
+
+	key := &cluster_counter.StoreKey{Name: "test", BeginTime: time.Now(), EndTime: time.Now().Add(time.Hour)}
+	if _, err := store.LoadV2(context.Background(), "n1", key); cluster_counter.IsNotFound(err) == false {
+		t.Fatal("missing key should be not found", err)
+	}
+
+	item := &cluster_counter.StoreItem{StoreKey: *key, Value: cluster_counter.CounterValue{Sum: 1, Count: 1}, Token: "t1"}
+	_ = store.StoreV2(context.Background(), "n1", item)
+	_ = store.StoreV2(context.Background(), "n1", item)
+	v, err := store.LoadV2(context.Background(), "n1", key)
+	if err != nil || v.Count != 1 {
+		t.Fatal("load value error", v, err)
+	}
+}
+
+func TestMemoryStore_ListKeysAndDelete(t *testing.T) {
+	store := NewStore()
+
+	startTime := time.Now().Truncate(time.Second)
+	endTime := startTime.Add(time.Hour)
+	lbs := map[string]string{"a": "b"}
+	for _, name := range []string{"test:1", "test:2", "other"} {
+		_ = store.Store(name, startTime, endTime, lbs, cluster_counter.CounterValue{Sum: 1, Count: 1}, false)
+	}
+
+	keys, _ := store.ListKeys("test:")
+	if len(keys) != 2 || keys[0].Labels["a"] != "b" {
+		t.Fatal("list keys error", keys)
+	}
+
+	_ = store.Delete(keys[0])
+	if keys, _ = store.ListKeys(""); len(keys) != 2 {
+		t.Fatal("key should be deleted", keys)
+	}
+}
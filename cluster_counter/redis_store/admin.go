@@ -0,0 +1,154 @@
+package redis_store
+
+import (
+	"errors"
+	"github.com/boostlearn/go-cluster-limiter/cluster_counter"
+	"github.com/go-redis/redis"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+const RedisScanCount = 1000
+
+// windows of counters whose name starts with namePrefix, found by SCAN on every master.
+// legacy keys are listed while they are read, with label values named by position, see SetReadLegacyKeys
+func (store *RedisStore) ListKeys(namePrefix string) ([]*cluster_counter.StoreKey, error) {
+	pattern := escapeGlob(store.keyPrefix) + "{" + RedisKeyVersion + RedisKeyFieldSep +
+		escapeGlob(url.QueryEscape(namePrefix)) + "*}"
+
+	var mu sync.Mutex
+	var keys []*cluster_counter.StoreKey
+	err := store.scan(pattern, func(redisKey string) {
+		key, err := store.decodeKey(redisKey)
+		if err != nil {
+			return
+		}
+		mu.Lock()
+		keys = append(keys, key)
+		mu.Unlock()
+	})
+	if err != nil || store.readLegacy() == false {
+		return keys, err
+	}
+
+	legacyPattern := escapeGlob(store.keyPrefix+namePrefix) + "*" + escapeGlob(RedisLegacySumSuffix)
+	err = store.scan(legacyPattern, func(redisKey string) {
+		key, err := decodeLegacyRedisKey(strings.TrimSuffix(strings.TrimPrefix(redisKey, store.keyPrefix),
+			RedisLegacySumSuffix))
+		if err != nil {
+			return
+		}
+		mu.Lock()
+		keys = append(keys, key)
+		mu.Unlock()
+	})
+	return keys, err
+}
+
+// remove counter's window with its legacy keys and applied tokens.
+// tokens are found by SCAN, so it walks the whole keyspace; use DeleteBatch for many windows
+func (store *RedisStore) Delete(key *cluster_counter.StoreKey) error {
+	return store.DeleteBatch([]*cluster_counter.StoreKey{key})
+}
+
+// remove counters' windows with their legacy keys and applied tokens,
+// walking the keyspace once for each counter name instead of once for each window
+func (store *RedisStore) DeleteBatch(keys []*cluster_counter.StoreKey) error {
+	var redisKeys []string
+	owners := make(map[string]bool)
+	patterns := make(map[string]bool)
+	for _, key := range keys {
+		redisKey := store.redisKey(key.Name, key.BeginTime, key.EndTime, key.Labels)
+		redisKeys = append(redisKeys, redisKey)
+		owners[tokenKey(redisKey, "")] = true
+		patterns[escapeGlob(store.keyPrefix+"{"+RedisKeyVersion+RedisKeyFieldSep+url.QueryEscape(key.Name)+
+			RedisKeyFieldSep)+"*"+escapeGlob(tokenKey("}", ""))+"*"] = true
+
+		if store.legacySupported() {
+			legacyKey := store.legacyRedisKey(key.Name, key.BeginTime, key.EndTime, key.Labels)
+			redisKeys = append(redisKeys, legacyKey+RedisLegacySumSuffix, legacyKey+RedisLegacyCountSuffix)
+			owners[tokenKey(legacyKey, "")] = true
+			patterns[escapeGlob(store.keyPrefix+key.Name+RedisKeySep)+"*"+escapeGlob(tokenKey("", ""))+"*"] = true
+		}
+	}
+
+	var mu sync.Mutex
+	for pattern := range patterns {
+		err := store.scan(pattern, func(redisKey string) {
+			if ownedToken(redisKey, owners) == false {
+				return
+			}
+			mu.Lock()
+			redisKeys = append(redisKeys, redisKey)
+			mu.Unlock()
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	// keys may live in different slots of redis cluster, so delete them one by one
+	pipe := store.client.Pipeline()
+	for _, k := range redisKeys {
+		pipe.Del(k)
+	}
+	_, err := pipe.Exec()
+	return err
+}
+
+// whether token's key belongs to one of the counters' keys, given as token key prefixes
+func ownedToken(redisKey string, owners map[string]bool) bool {
+	sep := tokenKey("", "")
+	for i := strings.Index(redisKey, sep); i >= 0; {
+		if owners[redisKey[:i+len(sep)]] {
+			return true
+		}
+		next := strings.Index(redisKey[i+1:], sep)
+		if next < 0 {
+			break
+		}
+		i += next + 1
+	}
+	return false
+}
+
+// call fn with every key matching pattern, on every master or shard
+func (store *RedisStore) scan(pattern string, fn func(redisKey string)) error {
+	scan := func(client *redis.Client) error {
+		iter := client.Scan(0, pattern, RedisScanCount).Iterator()
+		for iter.Next() {
+			fn(iter.Val())
+		}
+		return iter.Err()
+	}
+
+	switch client := store.client.(type) {
+	case *redis.ClusterClient:
+		return client.ForEachMaster(scan)
+	case *redis.Ring:
+		return client.ForEachShard(scan)
+	case *redis.Client:
+		return scan(client)
+	}
+	return errors.New("unsupported redis client")
+}
+
+// parse full redis key with prefix and hash tag
+func (store *RedisStore) decodeKey(redisKey string) (*cluster_counter.StoreKey, error) {
+	key := strings.TrimPrefix(redisKey, store.keyPrefix)
+	key = strings.TrimSuffix(strings.TrimPrefix(key, "{"), "}")
+	return decodeRedisKey(key)
+}
+
+// escape special characters of SCAN's glob pattern
+func escapeGlob(s string) string {
+	var builder strings.Builder
+	for _, c := range s {
+		if strings.ContainsRune(`*?[]\`, c) {
+			builder.WriteByte('\\')
+		}
+		builder.WriteRune(c)
+	}
+	return builder.String()
+}
@@ -0,0 +1,148 @@
+package redis_store
+
+import (
+	"errors"
+	"fmt"
+	"github.com/boostlearn/go-cluster-limiter/cluster_counter"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// version of key scheme, the first field of every key
+const RedisKeyVersion = "v2"
+const RedisKeyFieldSep = "|"
+const RedisKeyLabelSep = ","
+
+// key of counter's window: v2|name|begin_end|k1=v1,k2=v2
+// name, label names and values are escaped, labels are sorted by name, times are unix milliseconds
+func generateRedisKey(name string, beginTime time.Time, endTime time.Time, lbs map[string]string) string {
+	var labels []string
+	for k, v := range lbs {
+		labels = append(labels, url.QueryEscape(k)+"="+url.QueryEscape(v))
+	}
+	sort.Strings(labels)
+	return strings.Join([]string{
+		RedisKeyVersion,
+		url.QueryEscape(name),
+		fmt.Sprintf("%v_%v", unixMilli(beginTime), unixMilli(endTime)),
+		strings.Join(labels, RedisKeyLabelSep),
+	}, RedisKeyFieldSep)
+}
+
+// parse key built by generateRedisKey
+func decodeRedisKey(key string) (*cluster_counter.StoreKey, error) {
+	fields := strings.Split(key, RedisKeyFieldSep)
+	if len(fields) != 4 || fields[0] != RedisKeyVersion {
+		return nil, errors.New("unknown key version: " + key)
+	}
+
+	name, err := url.QueryUnescape(fields[1])
+	if err != nil {
+		return nil, err
+	}
+
+	times := strings.Split(fields[2], "_")
+	if len(times) != 2 {
+		return nil, errors.New("bad window: " + key)
+	}
+	beginMilli, err := strconv.ParseInt(times[0], 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	endMilli, err := strconv.ParseInt(times[1], 10, 64)
+	if err != nil {
+		return nil, err
+	}
+
+	lbs := make(map[string]string)
+	if len(fields[3]) > 0 {
+		for _, label := range strings.Split(fields[3], RedisKeyLabelSep) {
+			pair := strings.SplitN(label, "=", 2)
+			if len(pair) != 2 {
+				return nil, errors.New("bad label: " + key)
+			}
+			k, err := url.QueryUnescape(pair[0])
+			if err != nil {
+				return nil, err
+			}
+			v, err := url.QueryUnescape(pair[1])
+			if err != nil {
+				return nil, err
+			}
+			lbs[k] = v
+		}
+	}
+
+	return &cluster_counter.StoreKey{
+		Name:      name,
+		BeginTime: fromUnixMilli(beginMilli),
+		EndTime:   fromUnixMilli(endMilli),
+		Labels:    lbs,
+	}, nil
+}
+
+// key scheme before v2: label names are dropped and values are not escaped, so distinct series may collide.
+// only used during upgrade, see SetWriteLegacyKeys and SetReadLegacyKeys
+func generateLegacyRedisKey(name string, beginTime time.Time, endTime time.Time, lbs map[string]string) string {
+	var labels []string
+	for _, v := range lbs {
+		labels = append(labels, v)
+	}
+	sort.Stable(sort.StringSlice(labels))
+	key := fmt.Sprintf("%v%v%v_%v%v%v", name, RedisKeySep, beginTime.Unix(), endTime.Unix(), RedisKeySep, strings.Join(labels, RedisKeySep))
+	return key
+}
+
+// parse key built by generateLegacyRedisKey, label names were not kept so values are labeled by position;
+// generateLegacyRedisKey builds the same key from the result
+func decodeLegacyRedisKey(key string) (*cluster_counter.StoreKey, error) {
+	fields := strings.Split(key, RedisKeySep)
+	if len(fields) < 3 {
+		return nil, errors.New("bad legacy key: " + key)
+	}
+
+	times := strings.Split(fields[1], "_")
+	if len(times) != 2 {
+		return nil, errors.New("bad window: " + key)
+	}
+	beginUnix, err := strconv.ParseInt(times[0], 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	endUnix, err := strconv.ParseInt(times[1], 10, 64)
+	if err != nil {
+		return nil, err
+	}
+
+	lbs := make(map[string]string)
+	if len(fields) > 3 || len(fields[2]) > 0 {
+		for i, v := range fields[2:] {
+			lbs[strconv.Itoa(i)] = v
+		}
+	}
+
+	return &cluster_counter.StoreKey{
+		Name:      fields[0],
+		BeginTime: time.Unix(beginUnix, 0),
+		EndTime:   time.Unix(endUnix, 0),
+		Labels:    lbs,
+	}, nil
+}
+
+// milliseconds since epoch, zero time is 0
+func unixMilli(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+func fromUnixMilli(milli int64) time.Time {
+	if milli == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, milli*int64(time.Millisecond))
+}
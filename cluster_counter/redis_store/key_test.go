@@ -0,0 +1,84 @@
+package redis_store
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestRedisKey_Collision(t *testing.T) {
+	beginTime := time.Unix(100, 0)
+	endTime := time.Unix(200, 0)
+
+	pairs := [][2]map[string]string{
+		{{"a": "x", "b": "y"}, {"a": "y", "b": "x"}},
+		{{"a": "x####y"}, {"a": "x", "b": "y"}},
+		{{"a": "x,b=y"}, {"a": "x", "b": "y"}},
+	}
+	for _, pair := range pairs {
+		if generateRedisKey("test", beginTime, endTime, pair[0]) == generateRedisKey("test", beginTime, endTime, pair[1]) {
+			t.Fatal("keys of different labels collide", pair)
+		}
+	}
+}
+
+func TestRedisKey_Decode(t *testing.T) {
+	beginTime := time.Unix(100, 5e6)
+	endTime := time.Unix(200, 0)
+	lbs := map[string]string{"a|b": "c=d", "{e}": "f,g%", "h": ""}
+
+	key, err := decodeRedisKey(generateRedisKey("te|st", beginTime, endTime, lbs))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key.Name != "te|st" || key.BeginTime.Equal(beginTime) == false || key.EndTime.Equal(endTime) == false ||
+		reflect.DeepEqual(key.Labels, lbs) == false {
+		t.Fatal("decode key error", key)
+	}
+
+	if _, err := decodeRedisKey(generateLegacyRedisKey("test", beginTime, endTime, lbs)); err == nil {
+		t.Fatal("legacy key should not be decoded")
+	}
+}
+
+func TestRedisKey_DecodeLegacy(t *testing.T) {
+	beginTime := time.Unix(100, 0)
+	endTime := time.Unix(200, 0)
+	for _, lbs := range []map[string]string{nil, {"a": "y", "b": "x"}} {
+		legacyKey := generateLegacyRedisKey("test", beginTime, endTime, lbs)
+		key, err := decodeLegacyRedisKey(legacyKey)
+		if err != nil || key.Name != "test" || len(key.Labels) != len(lbs) {
+			t.Fatal("decode legacy key error", key, err)
+		}
+		if generateLegacyRedisKey(key.Name, key.BeginTime, key.EndTime, key.Labels) != legacyKey {
+			t.Fatal("decoded legacy key should build the same key", key)
+		}
+	}
+}
+
+func TestRedisStore_DecodeKey(t *testing.T) {
+	store := &RedisStore{keyPrefix: "bl*cl:"}
+	lbs := map[string]string{"a": "b"}
+	key, err := store.decodeKey(store.redisKey("test", time.Unix(0, 0), time.Unix(10, 0), lbs))
+	if err != nil || key.Name != "test" || key.Labels["a"] != "b" {
+		t.Fatal("decode key error", key, err)
+	}
+
+	if pattern := escapeGlob(store.keyPrefix); pattern != `bl\*cl:` {
+		t.Fatal("escape glob error", pattern)
+	}
+}
+
+func TestRedisStore_OwnedToken(t *testing.T) {
+	store := &RedisStore{keyPrefix: "blcl:"}
+	redisKey := store.redisKey("test", time.Unix(0, 0), time.Unix(10, 0), nil)
+	otherKey := store.redisKey("test", time.Unix(10, 0), time.Unix(20, 0), nil)
+	owners := map[string]bool{tokenKey(redisKey, ""): true}
+
+	if ownedToken(tokenKey(redisKey, "a:tk:b"), owners) == false {
+		t.Fatal("token of deleted window should be found")
+	}
+	if ownedToken(tokenKey(otherKey, "a"), owners) || ownedToken(redisKey, owners) {
+		t.Fatal("keys of other windows should be kept")
+	}
+}
@@ -1,20 +1,109 @@
 package redis_store
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"github.com/boostlearn/go-cluster-limiter/cluster_counter"
 	"github.com/go-redis/redis"
-	"sort"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 )
 
 const RedisKeySep = "####"
+const RedisSumField = "sum"
+const RedisCountField = "cnt"
+const RedisLegacySumField = "lsum"
+const RedisLegacyCountField = "lcnt"
+const RedisLegacySumSuffix = ":" + RedisSumField
+const RedisLegacyCountSuffix = ":" + RedisCountField
+
+// add value into counter's hash and refresh its ttl atomically
+// KEYS[1]: counter's hash; ARGV: sum, count, ttl in milliseconds
+var storeScript = redis.NewScript(`
+redis.call('HINCRBYFLOAT', KEYS[1], '` + RedisSumField + `', ARGV[1])
+redis.call('HINCRBY', KEYS[1], '` + RedisCountField + `', ARGV[2])
+if tonumber(ARGV[3]) > 0 then
+	redis.call('PEXPIRE', KEYS[1], ARGV[3])
+end
+return 1
+`)
+
+// same as storeScript, but applied only once for each token
+// KEYS[1]: counter's hash, KEYS[2]: token's key; ARGV: sum, count, ttl, token's ttl in milliseconds
+var storeOnceScript = redis.NewScript(`
+if not redis.call('SET', KEYS[2], '1', 'NX', 'PX', ARGV[4]) then
+	return 0
+end
+redis.call('HINCRBYFLOAT', KEYS[1], '` + RedisSumField + `', ARGV[1])
+redis.call('HINCRBY', KEYS[1], '` + RedisCountField + `', ARGV[2])
+if tonumber(ARGV[3]) > 0 then
+	redis.call('PEXPIRE', KEYS[1], ARGV[3])
+end
+return 1
+`)
+
+// add value into counter's hash and also into the two string keys of counter written before hash layout,
+// see SetWriteLegacyKeys. the part also in string keys is kept in hash's legacy fields, so it is counted once
+// when both are read
+// KEYS[1]: counter's hash, KEYS[2]: sum's key, KEYS[3]: count's key; ARGV: sum, count, ttl in milliseconds
+var legacyStoreScript = redis.NewScript(`
+redis.call('HINCRBYFLOAT', KEYS[1], '` + RedisSumField + `', ARGV[1])
+redis.call('HINCRBY', KEYS[1], '` + RedisCountField + `', ARGV[2])
+redis.call('HINCRBYFLOAT', KEYS[1], '` + RedisLegacySumField + `', ARGV[1])
+redis.call('HINCRBY', KEYS[1], '` + RedisLegacyCountField + `', ARGV[2])
+redis.call('INCRBYFLOAT', KEYS[2], ARGV[1])
+redis.call('INCRBY', KEYS[3], ARGV[2])
+if tonumber(ARGV[3]) > 0 then
+	redis.call('PEXPIRE', KEYS[1], ARGV[3])
+	redis.call('PEXPIRE', KEYS[2], ARGV[3])
+	redis.call('PEXPIRE', KEYS[3], ARGV[3])
+end
+return 1
+`)
+
+// same as legacyStoreScript, but applied only once for each token
+// KEYS[1]: counter's hash, KEYS[2]: sum's key, KEYS[3]: count's key, KEYS[4]: token's key;
+// ARGV: sum, count, ttl, token's ttl in milliseconds
+var legacyStoreOnceScript = redis.NewScript(`
+if not redis.call('SET', KEYS[4], '1', 'NX', 'PX', ARGV[4]) then
+	return 0
+end
+redis.call('HINCRBYFLOAT', KEYS[1], '` + RedisSumField + `', ARGV[1])
+redis.call('HINCRBY', KEYS[1], '` + RedisCountField + `', ARGV[2])
+redis.call('HINCRBYFLOAT', KEYS[1], '` + RedisLegacySumField + `', ARGV[1])
+redis.call('HINCRBY', KEYS[1], '` + RedisLegacyCountField + `', ARGV[2])
+redis.call('INCRBYFLOAT', KEYS[2], ARGV[1])
+redis.call('INCRBY', KEYS[3], ARGV[2])
+if tonumber(ARGV[3]) > 0 then
+	redis.call('PEXPIRE', KEYS[1], ARGV[3])
+	redis.call('PEXPIRE', KEYS[2], ARGV[3])
+	redis.call('PEXPIRE', KEYS[3], ARGV[3])
+end
+return 1
+`)
+
+// set value of counter's hash unless it has one, legacy keys are not written
+// KEYS[1]: counter's hash; ARGV: sum, count, ttl in milliseconds. returns sum and count kept
+var setIfAbsentScript = redis.NewScript(`
+if redis.call('HSETNX', KEYS[1], '` + RedisSumField + `', ARGV[1]) == 0 then
+	return redis.call('HMGET', KEYS[1], '` + RedisSumField + `', '` + RedisCountField + `')
+end
+redis.call('HSET', KEYS[1], '` + RedisCountField + `', ARGV[2])
+if tonumber(ARGV[3]) > 0 then
+	redis.call('PEXPIRE', KEYS[1], ARGV[3])
+end
+return {ARGV[1], ARGV[2]}
+`)
 
 type RedisStore struct {
-	client    *redis.Client
+	client    redis.UniversalClient
 	keyPrefix string
+	// flags of legacy keys, set atomically while the store is in use
+	readLegacyKeys  int32
+	writeLegacyKeys int32
 }
 
 // build new store from redis's address
@@ -32,8 +121,39 @@ func NewStore(address string, pass string, keyPrefix string) (*RedisStore, error
 	return NewRedisStore(cli, keyPrefix)
 }
 
-// // build new store from redis cli
-func NewRedisStore(cli *redis.Client, keyPrefix string) (*RedisStore, error) {
+// build new store from redis cluster's addresses
+func NewClusterStore(addresses []string, pass string, keyPrefix string) (*RedisStore, error) {
+	options := &redis.ClusterOptions{
+		Addrs:        addresses,
+		Password:     pass,
+		DialTimeout:  1 * time.Second,
+		ReadTimeout:  100 * time.Millisecond,
+		WriteTimeout: 100 * time.Millisecond,
+	}
+	cli := redis.NewClusterClient(options)
+
+	return NewRedisStore(cli, keyPrefix)
+}
+
+// build new store from sentinels' addresses of failover group
+func NewFailoverStore(masterName string, sentinelAddresses []string, pass string, keyPrefix string,
+) (*RedisStore, error) {
+	options := &redis.FailoverOptions{
+		MasterName:    masterName,
+		SentinelAddrs: sentinelAddresses,
+		Password:      pass,
+		DB:            0,
+		DialTimeout:   1 * time.Second,
+		ReadTimeout:   100 * time.Millisecond,
+		WriteTimeout:  100 * time.Millisecond,
+	}
+	cli := redis.NewFailoverClient(options)
+
+	return NewRedisStore(cli, keyPrefix)
+}
+
+// build new store from redis cli: *redis.Client, *redis.ClusterClient or *redis.Ring
+func NewRedisStore(cli redis.UniversalClient, keyPrefix string) (*RedisStore, error) {
 	_, err := cli.Ping().Result()
 	if err != nil {
 		return nil, err
@@ -44,55 +164,393 @@ func NewRedisStore(cli *redis.Client, keyPrefix string) (*RedisStore, error) {
 // store client's data within cluster
 func (store *RedisStore) Store(name string, beginTime time.Time, endTime time.Time, lbs map[string]string,
 	value cluster_counter.CounterValue, force bool) error {
-	redisKey := store.keyPrefix + generateRedisKey(name, beginTime, endTime, lbs)
+	script, keys, args := store.storeCommand(name, beginTime, endTime, lbs, "", value)
+	return script.Run(store.client, keys, args...).Err()
+}
 
-	_ = store.client.IncrByFloat(redisKey+":sum", value.Sum)
-	result := store.client.IncrBy(redisKey+":cnt", int64(value.Count))
-	if endTime.After(beginTime) {
-		store.client.Expire(redisKey+":sum", endTime.Sub(beginTime))
-		store.client.Expire(redisKey+":cnt", endTime.Sub(beginTime))
+// store client's data, values with the same token are applied only once
+func (store *RedisStore) StoreOnce(token string, name string, beginTime time.Time, endTime time.Time,
+	lbs map[string]string, value cluster_counter.CounterValue, force bool) error {
+	script, keys, args := store.storeCommand(name, beginTime, endTime, lbs, token, value)
+	return script.Run(store.client, keys, args...).Err()
+}
+
+// set client's data unless counter's hash has some, returns the data kept
+func (store *RedisStore) SetIfAbsent(name string, beginTime time.Time, endTime time.Time, lbs map[string]string,
+	value cluster_counter.CounterValue) (cluster_counter.CounterValue, error) {
+	_, keys, args := store.storeCommand(name, beginTime, endTime, lbs, "", value)
+	reply, err := setIfAbsentScript.Run(store.client, keys[:1], args...).Result()
+	if err != nil {
+		return cluster_counter.CounterValue{}, classifyError(err)
 	}
-	return result.Err()
+	fields, ok := reply.([]interface{})
+	if ok == false {
+		return cluster_counter.CounterValue{}, cluster_counter.NewPermanentError(errors.New("unexpected reply type"))
+	}
+	kept, err := parseCounterValue(fields)
+	if err != nil {
+		return kept, cluster_counter.NewPermanentError(err)
+	}
+	return kept, nil
 }
 
 // load cluster's data for clients
 func (store *RedisStore) Load(name string, beginTime time.Time, endTime time.Time, lbs map[string]string,
 ) (cluster_counter.CounterValue, error) {
-	key := store.keyPrefix + generateRedisKey(name, beginTime, endTime, lbs)
+	values, _, errs := store.loadValues(store.client, []*cluster_counter.StoreKey{
+		{Name: name, BeginTime: beginTime, EndTime: endTime, Labels: lbs}})
+	return values[0], errs[0]
+}
 
-	var counterValue cluster_counter.CounterValue
-	var err error
-	result := store.client.Get(key + ":sum")
-	err = result.Err()
+// store with context, values with token are applied only once
+func (store *RedisStore) StoreV2(ctx context.Context, nodeID string, item *cluster_counter.StoreItem) error {
+	if err := ctx.Err(); err != nil {
+		return cluster_counter.NewTransientError(err)
+	}
+
+	script, keys, args := store.storeCommand(item.Name, item.BeginTime, item.EndTime, item.Labels, item.Token,
+		item.Value)
+	return classifyError(script.Run(withContext(store.client, ctx), keys, args...).Err())
+}
+
+// load with context, missing key is not found error
+func (store *RedisStore) LoadV2(ctx context.Context, nodeID string, key *cluster_counter.StoreKey,
+) (cluster_counter.CounterValue, error) {
+	if err := ctx.Err(); err != nil {
+		return cluster_counter.CounterValue{}, cluster_counter.NewTransientError(err)
+	}
+
+	values, found, errs := store.loadValues(withContext(store.client, ctx), []*cluster_counter.StoreKey{key})
+	if errs[0] != nil {
+		return values[0], errs[0]
+	}
+	if found[0] == false {
+		return values[0], cluster_counter.NewNotFoundError(errors.New("key not found: " +
+			store.redisKey(key.Name, key.BeginTime, key.EndTime, key.Labels)))
+	}
+	return values[0], nil
+}
+
+// client bound to ctx, clients of unknown type are used as is.
+// go-redis v6 keeps ctx but applies neither its deadline nor its cancellation to network I/O,
+// so ctx is only checked before each call and StoreTimeout of factory is not enforced;
+// bound calls with ReadTimeout and WriteTimeout of the client instead
+func withContext(cli redis.UniversalClient, ctx context.Context) redis.UniversalClient {
+	switch c := cli.(type) {
+	case *redis.Client:
+		return c.WithContext(ctx)
+	case *redis.ClusterClient:
+		return c.WithContext(ctx)
+	case *redis.Ring:
+		return c.WithContext(ctx)
+	}
+	return cli
+}
+
+// replies of redis server that fail again on retry: key of another type,
+// or script still missing after its source was sent
+var permanentReplyPrefixes = []string{"WRONGTYPE", "NOSCRIPT"}
+
+// error replied by redis server is transient, e.g. "OOM command not allowed" or "ERR max number of clients reached",
+// unless it is known to be permanent; network errors are transient
+func classifyError(err error) error {
 	if err == nil {
-		t, err := result.Result()
-		if err == nil {
-			value, _ := strconv.ParseFloat(t, 64)
-			counterValue.Sum = value
+		return nil
+	}
+	if err == redis.Nil {
+		return cluster_counter.NewNotFoundError(err)
+	}
+
+	msg := err.Error()
+	prefix := msg
+	if pos := strings.IndexByte(msg, ' '); pos >= 0 {
+		prefix = msg[:pos]
+	}
+	for _, permanentPrefix := range permanentReplyPrefixes {
+		if prefix == permanentPrefix {
+			return cluster_counter.NewPermanentError(err)
 		}
 	}
-	result = store.client.Get(key + ":cnt")
-	err = result.Err()
-	if err == nil {
-		t, err := result.Result()
-		if err == nil {
-			counterValue.Count, err = strconv.ParseInt(t, 10, 64)
+	return cluster_counter.NewTransientError(err)
+}
 
+// store several counters' data with one pipeline
+func (store *RedisStore) StoreBatch(items []*cluster_counter.StoreItem) []error {
+	return store.storeItems(store.client, items)
+}
+
+// store several counters' data with one pipeline and context, errors are typed
+func (store *RedisStore) StoreBatchV2(ctx context.Context, nodeID string, items []*cluster_counter.StoreItem) []error {
+	if err := ctx.Err(); err != nil {
+		errs := make([]error, len(items))
+		for i := range errs {
+			errs[i] = cluster_counter.NewTransientError(err)
 		}
+		return errs
 	}
-	if err == redis.Nil {
-		return counterValue, nil
+	return store.storeItems(withContext(store.client, ctx), items)
+}
+
+func (store *RedisStore) storeItems(client redis.UniversalClient, items []*cluster_counter.StoreItem) []error {
+	errs := store.storeBatch(client, items, false)
+
+	// script is not cached on some nodes yet, send its source for those items
+	var retryItems []*cluster_counter.StoreItem
+	var retryPos []int
+	for i, err := range errs {
+		if err != nil && strings.HasPrefix(err.Error(), "NOSCRIPT ") {
+			retryItems = append(retryItems, items[i])
+			retryPos = append(retryPos, i)
+		}
+	}
+	if len(retryItems) > 0 {
+		retryErrs := store.storeBatch(client, retryItems, true)
+		for i, pos := range retryPos {
+			errs[pos] = retryErrs[i]
+		}
+	}
+
+	for i, err := range errs {
+		errs[i] = classifyError(err)
+	}
+	return errs
+}
+
+func (store *RedisStore) storeBatch(client redis.UniversalClient, items []*cluster_counter.StoreItem,
+	withSource bool) []error {
+	pipe := client.Pipeline()
+	cmds := make([]*redis.Cmd, len(items))
+	for i, item := range items {
+		script, keys, args := store.storeCommand(item.Name, item.BeginTime, item.EndTime, item.Labels, item.Token,
+			item.Value)
+		if withSource {
+			cmds[i] = script.Eval(pipe, keys, args...)
+		} else {
+			cmds[i] = script.EvalSha(pipe, keys, args...)
+		}
+	}
+	_, _ = pipe.Exec()
+
+	errs := make([]error, len(items))
+	for i, cmd := range cmds {
+		errs[i] = cmd.Err()
 	}
+	return errs
+}
+
+// load several counters' data with one pipeline
+func (store *RedisStore) LoadBatch(keys []*cluster_counter.StoreKey) ([]cluster_counter.CounterValue, []error) {
+	values, _, errs := store.loadValues(store.client, keys)
+	return values, errs
+}
+
+// load several counters' data with one pipeline and context, errors are typed and a missing key is zero value
+func (store *RedisStore) LoadBatchV2(ctx context.Context, nodeID string, keys []*cluster_counter.StoreKey,
+) ([]cluster_counter.CounterValue, []error) {
+	if err := ctx.Err(); err != nil {
+		errs := make([]error, len(keys))
+		for i := range errs {
+			errs[i] = cluster_counter.NewTransientError(err)
+		}
+		return make([]cluster_counter.CounterValue, len(keys)), errs
+	}
+	values, _, errs := store.loadValues(withContext(store.client, ctx), keys)
+	return values, errs
+}
+
+// script, keys and arguments adding value into counter, only once for token if not empty
+func (store *RedisStore) storeCommand(name string, beginTime time.Time, endTime time.Time, lbs map[string]string,
+	token string, value cluster_counter.CounterValue) (*redis.Script, []string, []interface{}) {
+	var ttl int64
+	if endTime.After(beginTime) {
+		ttl = int64(endTime.Sub(beginTime) / time.Millisecond)
+	}
+	args := []interface{}{strconv.FormatFloat(value.Sum, 'f', -1, 64), value.Count, ttl}
+	if len(token) > 0 {
+		args = append(args, int64(cluster_counter.DefaultTokenExpireSeconds*time.Second/time.Millisecond))
+	}
+
+	redisKey := store.redisKey(name, beginTime, endTime, lbs)
+	if atomic.LoadInt32(&store.writeLegacyKeys) != 0 {
+		legacyKey := store.legacyRedisKey(name, beginTime, endTime, lbs)
+		keys := []string{redisKey, legacyKey + RedisLegacySumSuffix, legacyKey + RedisLegacyCountSuffix}
+		if len(token) > 0 {
+			return legacyStoreOnceScript, append(keys, tokenKey(redisKey, token)), args
+		}
+		return legacyStoreScript, keys, args
+	}
+
+	if len(token) > 0 {
+		return storeOnceScript, []string{redisKey, tokenKey(redisKey, token)}, args
+	}
+	return storeScript, []string{redisKey}, args
+}
+
+// read legacy keys and add them to values, off by default and only for *redis.Client.
+// turn it on while upgrading from earlier versions. legacy keys are read in the same pipeline as hashes, so each load costs one round trip but twice the commands.
+// keys written by earlier versions, or while legacy keys are written, live until their windows end;
+// turn it off after SetWriteLegacyKeys(false) once those windows ended. windows of limiters' counters never end,
+// so keep it on for them, or delete their data before
+func (store *RedisStore) SetReadLegacyKeys(readLegacyKeys bool) {
+	atomic.StoreInt32(&store.readLegacyKeys, flag(readLegacyKeys && store.legacySupported()))
+}
+
+// write counters into the string keys of earlier versions as well as hash, off by default and only for *redis.Client.
+// turn it on during a rolling upgrade so that processes of earlier versions still see values of upgraded ones,
+// and off once all processes are upgraded
+func (store *RedisStore) SetWriteLegacyKeys(writeLegacyKeys bool) {
+	atomic.StoreInt32(&store.writeLegacyKeys, flag(writeLegacyKeys && store.legacySupported()))
+}
+
+func (store *RedisStore) readLegacy() bool {
+	return atomic.LoadInt32(&store.readLegacyKeys) != 0
+}
+
+func flag(on bool) int32 {
+	if on {
+		return 1
+	}
+	return 0
+}
+
+// earlier versions supported only *redis.Client, and their keys share no hash tag
+func (store *RedisStore) legacySupported() bool {
+	_, ok := store.client.(*redis.Client)
+	return ok
+}
+
+// load keys with one pipeline, and whether any data is found for each key
+func (store *RedisStore) loadValues(client redis.UniversalClient, keys []*cluster_counter.StoreKey,
+) ([]cluster_counter.CounterValue, []bool, []error) {
+	pipe := client.Pipeline()
+	cmds := make([]*redis.SliceCmd, len(keys))
+	var legacyCmds [][2]*redis.StringCmd
+	for i, key := range keys {
+		redisKey := store.redisKey(key.Name, key.BeginTime, key.EndTime, key.Labels)
+		cmds[i] = pipe.HMGet(redisKey, RedisSumField, RedisCountField, RedisLegacySumField, RedisLegacyCountField)
+	}
+	if store.readLegacy() {
+		legacyCmds = make([][2]*redis.StringCmd, len(keys))
+		for i, key := range keys {
+			legacyKey := store.legacyRedisKey(key.Name, key.BeginTime, key.EndTime, key.Labels)
+			legacyCmds[i] = [2]*redis.StringCmd{
+				pipe.Get(legacyKey + RedisLegacySumSuffix), pipe.Get(legacyKey + RedisLegacyCountSuffix)}
+		}
+	}
+	_, _ = pipe.Exec()
+
+	values := make([]cluster_counter.CounterValue, len(keys))
+	found := make([]bool, len(keys))
+	errs := make([]error, len(keys))
+	for i := range keys {
+		var legacyPart cluster_counter.CounterValue
+		values[i], legacyPart, found[i], errs[i] = parseCmd(cmds[i])
+		if legacyCmds == nil || errs[i] != nil {
+			continue
+		}
+		legacyValue, legacyFound, err := parseLegacyCmds(legacyCmds[i])
+		if err != nil {
+			errs[i] = err
+			continue
+		}
+		// values written into both layouts are counted once
+		values[i] = values[i].Add(legacyValue)
+		values[i] = values[i].Sub(legacyPart)
+		found[i] = found[i] || legacyFound
+	}
+	return values, found, errs
+}
+
+// parse HMGET's reply of counter's hash, and the part of value also written into legacy keys
+func parseCmd(cmd *redis.SliceCmd) (cluster_counter.CounterValue, cluster_counter.CounterValue, bool, error) {
+	var value, legacyPart cluster_counter.CounterValue
+	fields, err := cmd.Result()
+	if err != nil {
+		return value, legacyPart, false, classifyError(err)
+	}
+	if len(fields) != 4 {
+		return value, legacyPart, false, cluster_counter.NewPermanentError(
+			fmt.Errorf("unexpected field number: %v", len(fields)))
+	}
+	found := fields[0] != nil || fields[1] != nil
+
+	value, err = parseCounterValue(fields[:2])
+	if err == nil {
+		legacyPart, err = parseCounterValue(fields[2:])
+	}
+	if err != nil {
+		return value, legacyPart, found, cluster_counter.NewPermanentError(err)
+	}
+	return value, legacyPart, found, nil
+}
+
+// parse GET's replies of legacy sum and count keys
+func parseLegacyCmds(cmds [2]*redis.StringCmd) (cluster_counter.CounterValue, bool, error) {
+	fields := make([]interface{}, len(cmds))
+	for i, cmd := range cmds {
+		s, err := cmd.Result()
+		if err == redis.Nil {
+			continue
+		}
+		if err != nil {
+			return cluster_counter.CounterValue{}, false, classifyError(err)
+		}
+		fields[i] = s
+	}
+	found := fields[0] != nil || fields[1] != nil
 
-	return counterValue, err
+	value, err := parseCounterValue(fields)
+	if err != nil {
+		return value, found, cluster_counter.NewPermanentError(err)
+	}
+	return value, found, nil
 }
 
-func generateRedisKey(name string, beginTime time.Time, endTime time.Time, lbs map[string]string) string {
-	var labels []string
-	for _, v := range lbs {
-		labels = append(labels, v)
+// parse HMGET's reply of sum and count, missing fields are zero
+func parseCounterValue(fields []interface{}) (cluster_counter.CounterValue, error) {
+	var counterValue cluster_counter.CounterValue
+	if len(fields) != 2 {
+		return counterValue, fmt.Errorf("unexpected field number: %v", len(fields))
 	}
-	sort.Stable(sort.StringSlice(labels))
-	key := fmt.Sprintf("%v%v%v_%v%v%v", name, RedisKeySep, beginTime.Unix(), endTime.Unix(), RedisKeySep, strings.Join(labels, RedisKeySep))
-	return key
+
+	if fields[0] != nil {
+		s, ok := fields[0].(string)
+		if ok == false {
+			return counterValue, errors.New("unexpected sum type")
+		}
+		sum, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return counterValue, err
+		}
+		counterValue.Sum = sum
+	}
+
+	if fields[1] != nil {
+		s, ok := fields[1].(string)
+		if ok == false {
+			return counterValue, errors.New("unexpected count type")
+		}
+		count, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return counterValue, err
+		}
+		counterValue.Count = count
+	}
+	return counterValue, nil
+}
+
+// counter's key, wrapped in a hash tag so that all keys of one counter share one slot in redis cluster
+func (store *RedisStore) redisKey(name string, beginTime time.Time, endTime time.Time, lbs map[string]string) string {
+	return store.keyPrefix + "{" + generateRedisKey(name, beginTime, endTime, lbs) + "}"
+}
+
+// counter's key before hash layout, its sum and count are kept in string keys with suffixes
+func (store *RedisStore) legacyRedisKey(name string, beginTime time.Time, endTime time.Time, lbs map[string]string,
+) string {
+	return store.keyPrefix + generateLegacyRedisKey(name, beginTime, endTime, lbs)
+}
+
+// key marking token as applied, shares hash tag with counter's key
+func tokenKey(redisKey string, token string) string {
+	return redisKey + ":tk:" + token
 }
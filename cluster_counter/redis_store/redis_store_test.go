@@ -1,7 +1,12 @@
 package redis_store
 
 import (
+	"errors"
+	"fmt"
 	"github.com/boostlearn/go-cluster-limiter/cluster_counter"
+	"github.com/go-redis/redis"
+	"io"
+	"strings"
 	"testing"
 	"time"
 )
@@ -55,3 +60,133 @@ func TestRedisStore_LoadAndLoad(t *testing.T) {
 		t.Fatal("merge data error")
 	}
 }
+
+// store on local redis, test is skipped if redis is not available
+func newStoreForTest(t *testing.T) *RedisStore {
+	store, err := NewStore("127.0.0.1:6379", "", "blcltest:")
+	if err != nil {
+		t.Skip("redis is not available", err)
+	}
+	return store
+}
+
+func TestRedisStore_LegacyKeys(t *testing.T) {
+	store := newStoreForTest(t)
+	beginTime := time.Now().Truncate(time.Second)
+	endTime := beginTime.Add(10 * time.Second)
+	lbs := map[string]string{"a": "x"}
+	store.SetReadLegacyKeys(true)
+	store.SetWriteLegacyKeys(true)
+
+	// values are written into string keys of earlier versions
+	if err := store.Store("legacy", beginTime, endTime, lbs, cluster_counter.CounterValue{Sum: 1.5, Count: 1}, false); err != nil {
+		t.Fatal(err)
+	}
+	legacyKey := fmt.Sprintf("blcltest:legacy####%v_%v####x", beginTime.Unix(), endTime.Unix())
+	if sum, _ := store.client.Get(legacyKey + ":sum").Result(); sum != "1.5" {
+		t.Fatal("legacy sum key error", sum)
+	}
+	if count, _ := store.client.Get(legacyKey + ":cnt").Result(); count != "1" {
+		t.Fatal("legacy count key error", count)
+	}
+
+	// values of both layouts are merged
+	store.SetWriteLegacyKeys(false)
+	if err := store.Store("legacy", beginTime, endTime, lbs, cluster_counter.CounterValue{Sum: 2, Count: 1}, false); err != nil {
+		t.Fatal(err)
+	}
+	v, err := store.Load("legacy", beginTime, endTime, lbs)
+	if err != nil || v.Sum != 3.5 || v.Count != 2 {
+		t.Fatal("values of both layouts should be merged", v, err)
+	}
+
+	// values written into legacy keys are also in hash
+	store.SetReadLegacyKeys(false)
+	v, err = store.Load("legacy", beginTime, endTime, lbs)
+	if err != nil || v.Sum != 3.5 || v.Count != 2 {
+		t.Fatal("hash should hold values of both layouts", v, err)
+	}
+}
+
+func TestRedisStore_LegacyKeyFormat(t *testing.T) {
+	store := &RedisStore{keyPrefix: "blcl:"}
+	key := store.legacyRedisKey("test", time.Unix(10, 0), time.Unix(20, 0), map[string]string{"b": "y", "a": "x"})
+	if key+RedisLegacySumSuffix != "blcl:test####10_20####x####y:sum" || key+RedisLegacyCountSuffix != "blcl:test####10_20####x####y:cnt" {
+		t.Fatal("legacy key should be the key of earlier versions", key)
+	}
+}
+
+func TestRedisStore_ReadLegacyKeys(t *testing.T) {
+	store := newStoreForTest(t)
+	store.SetReadLegacyKeys(true)
+	beginTime := time.Now().Truncate(time.Second)
+	endTime := beginTime.Add(10 * time.Second)
+	lbs := map[string]string{"a": "x"}
+
+	// keys as written by earlier versions
+	legacyKey := fmt.Sprintf("blcltest:seed####%v_%v####x", beginTime.Unix(), endTime.Unix())
+	store.client.Set(legacyKey+":sum", "2.5", 10*time.Second)
+	store.client.Set(legacyKey+":cnt", "2", 10*time.Second)
+
+	_ = store.Store("seed", beginTime, endTime, lbs, cluster_counter.CounterValue{Sum: 1, Count: 1}, false)
+	v, err := store.Load("seed", beginTime, endTime, lbs)
+	if err != nil || v.Sum != 3.5 || v.Count != 3 {
+		t.Fatal("legacy keys should be added", v, err)
+	}
+
+	store.SetReadLegacyKeys(false)
+	v, err = store.Load("seed", beginTime, endTime, lbs)
+	if err != nil || v.Sum != 1 || v.Count != 1 {
+		t.Fatal("legacy keys should not be read", v, err)
+	}
+}
+
+func TestParseCounterValue(t *testing.T) {
+	v, err := parseCounterValue([]interface{}{"1.5", "3"})
+	if err != nil || v.Sum != 1.5 || v.Count != 3 {
+		t.Fatal("parse value error", v, err)
+	}
+
+	v, err = parseCounterValue([]interface{}{nil, nil})
+	if err != nil || v.Sum != 0 || v.Count != 0 {
+		t.Fatal("missing fields should be zero", v, err)
+	}
+
+	_, err = parseCounterValue([]interface{}{"x", "1"})
+	if err == nil {
+		t.Fatal("should report parse error")
+	}
+}
+
+func TestRedisStore_HashTag(t *testing.T) {
+	store := &RedisStore{keyPrefix: "blcl:"}
+	key := store.redisKey("test", time.Unix(0, 0), time.Unix(10, 0), map[string]string{"a": "b"})
+	if strings.HasPrefix(key, "blcl:{") == false || strings.HasSuffix(key, "}") == false {
+		t.Fatal("key should be wrapped in hash tag", key)
+	}
+}
+
+func TestClassifyError(t *testing.T) {
+	cases := map[string]cluster_counter.StoreErrorKind{
+		"WRONGTYPE Operation against a key holding the wrong kind of value": cluster_counter.StoreErrorPermanent,
+		"NOSCRIPT No matching script. Please use EVAL.":                     cluster_counter.StoreErrorPermanent,
+		"ERR Error running script":                                          cluster_counter.StoreErrorTransient,
+		"OOM command not allowed when used memory > 'maxmemory'.":           cluster_counter.StoreErrorTransient,
+		"ERR max number of clients reached":                                 cluster_counter.StoreErrorTransient,
+		"LOADING Redis is loading the dataset in memory":                    cluster_counter.StoreErrorTransient,
+		"dial tcp 127.0.0.1:6379: connect: connection refused":              cluster_counter.StoreErrorTransient,
+		"EOF": cluster_counter.StoreErrorTransient,
+	}
+	for msg, kind := range cases {
+		err := errors.New(msg)
+		if msg == "EOF" {
+			err = io.EOF
+		}
+		if got := cluster_counter.StoreErrorKindOf(classifyError(err)); got != kind {
+			t.Fatal("classify error", msg, got)
+		}
+	}
+	if cluster_counter.IsNotFound(classifyError(redis.Nil)) == false {
+		t.Fatal("nil reply should be not found")
+	}
+}
@@ -0,0 +1,352 @@
+package cluster_counter
+
+import (
+	"errors"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const scheduleSearchYears = 5
+
+// calendar of windows in a time zone, e.g. active 9:00-18:00 on weekdays, or reset at local midnight
+type Schedule struct {
+	// IANA name of time zone, default is UTC
+	TimeZone string
+	// active days, every day if empty
+	Weekdays []time.Weekday
+	// active hours as offsets from local midnight, whole day if both are zero.
+	// a window ending before it begins lasts into the next day
+	ActiveBegin time.Duration
+	ActiveEnd   time.Duration
+	// resets in cron format "minute hour day-of-month month day-of-week", e.g. "0 0 * * *" for local midnight.
+	// each active window is a period if empty
+	Reset string
+
+	once     sync.Once
+	err      error
+	location *time.Location
+	weekdays [7]bool
+	cron     *cronSpec
+}
+
+// check and compile schedule, called before use
+func (schedule *Schedule) Validate() error {
+	schedule.once.Do(func() {
+		schedule.err = schedule.compile()
+	})
+	return schedule.err
+}
+
+func (schedule *Schedule) compile() error {
+	schedule.location = time.UTC
+	if len(schedule.TimeZone) > 0 {
+		location, err := time.LoadLocation(schedule.TimeZone)
+		if err != nil {
+			return err
+		}
+		schedule.location = location
+	}
+
+	if schedule.ActiveBegin < 0 || schedule.ActiveBegin >= 24*time.Hour ||
+		schedule.ActiveEnd < 0 || schedule.ActiveEnd > 24*time.Hour {
+		return errors.New("active hours should be within a day")
+	}
+
+	for i := range schedule.weekdays {
+		schedule.weekdays[i] = len(schedule.Weekdays) == 0
+	}
+	for _, weekday := range schedule.Weekdays {
+		if weekday < time.Sunday || weekday > time.Saturday {
+			return errors.New("invalid weekday")
+		}
+		schedule.weekdays[weekday] = true
+	}
+
+	if len(schedule.Reset) > 0 {
+		cron, err := parseCron(schedule.Reset)
+		if err != nil {
+			return err
+		}
+		schedule.cron = cron
+		if _, ok := cron.next(time.Date(2000, 1, 1, 0, 0, 0, 0, schedule.location)); ok == false {
+			return errors.New("cron spec never fires: " + schedule.Reset)
+		}
+	}
+	return nil
+}
+
+// time zone of schedule
+func (schedule *Schedule) Location() *time.Location {
+	_ = schedule.Validate()
+	return schedule.location
+}
+
+// whether schedule limits active days or hours
+func (schedule *Schedule) restricted() bool {
+	return len(schedule.Weekdays) > 0 || schedule.ActiveBegin != 0 || schedule.ActiveEnd != 0
+}
+
+// active window beginning on the local day of day, false if the day is not active
+func (schedule *Schedule) dayWindow(day time.Time) (time.Time, time.Time, bool) {
+	day = day.In(schedule.location)
+	if schedule.weekdays[day.Weekday()] == false {
+		return time.Time{}, time.Time{}, false
+	}
+
+	// wall clock times of the day, so windows keep their hours on days of summer time change
+	endDay := day.Day()
+	if schedule.ActiveEnd <= schedule.ActiveBegin {
+		endDay++
+	}
+	return schedule.clockTime(day, day.Day(), schedule.ActiveBegin), schedule.clockTime(day, endDay, schedule.ActiveEnd), true
+}
+
+// local time at offset from midnight of the day of month
+func (schedule *Schedule) clockTime(t time.Time, day int, offset time.Duration) time.Time {
+	return time.Date(t.Year(), t.Month(), day, int(offset/time.Hour), int(offset%time.Hour/time.Minute),
+		int(offset%time.Minute/time.Second), int(offset%time.Second), schedule.location)
+}
+
+// local midnight of days after the day of t
+func (schedule *Schedule) addDays(t time.Time, days int) time.Time {
+	t = t.In(schedule.location)
+	return time.Date(t.Year(), t.Month(), t.Day()+days, 0, 0, 0, 0, schedule.location)
+}
+
+// whether t is within active days and hours
+func (schedule *Schedule) Active(t time.Time) bool {
+	if schedule.Validate() != nil {
+		return false
+	}
+	if schedule.restricted() == false {
+		return true
+	}
+
+	for days := -1; days <= 0; days++ {
+		beginTime, endTime, ok := schedule.dayWindow(schedule.addDays(t, days))
+		if ok && t.Before(beginTime) == false && t.Before(endTime) {
+			return true
+		}
+	}
+	return false
+}
+
+// active time within [beginTime, endTime)
+func (schedule *Schedule) ActiveDuration(beginTime time.Time, endTime time.Time) time.Duration {
+	if schedule.Validate() != nil || endTime.After(beginTime) == false {
+		return 0
+	}
+	if schedule.restricted() == false {
+		return endTime.Sub(beginTime)
+	}
+
+	var active time.Duration
+	for day := schedule.addDays(beginTime, -1); day.Before(endTime); day = schedule.addDays(day, 1) {
+		windowBegin, windowEnd, ok := schedule.dayWindow(day)
+		if ok == false {
+			continue
+		}
+		if windowBegin.Before(beginTime) {
+			windowBegin = beginTime
+		}
+		if windowEnd.After(endTime) {
+			windowEnd = endTime
+		}
+		if windowEnd.After(windowBegin) {
+			active += windowEnd.Sub(windowBegin)
+		}
+	}
+	return active
+}
+
+// period containing t, between the resets around t, or the active window containing or following t
+func (schedule *Schedule) Period(t time.Time) (time.Time, time.Time) {
+	if schedule.Validate() != nil {
+		return t, t
+	}
+
+	if schedule.cron != nil {
+		beginTime, _ := schedule.cron.prev(t.In(schedule.location))
+		endTime, _ := schedule.cron.next(t.In(schedule.location))
+		return beginTime, endTime
+	}
+
+	for days := -1; days <= 7; days++ {
+		beginTime, endTime, ok := schedule.dayWindow(schedule.addDays(t, days))
+		if ok && t.Before(endTime) {
+			return beginTime, endTime
+		}
+	}
+	return t, t
+}
+
+// share of active time of [beginTime, completionTime] passed at t, so a limiter spends only in active hours
+func (schedule *Schedule) Progress(beginTime time.Time, completionTime time.Time, t time.Time) float64 {
+	total := schedule.ActiveDuration(beginTime, completionTime)
+	if total <= 0 {
+		x := float64(t.Sub(beginTime)) / float64(completionTime.Sub(beginTime))
+		return ClampProgress(x)
+	}
+	return ClampProgress(float64(schedule.ActiveDuration(beginTime, t)) / float64(total))
+}
+
+// whether windows or periods are renewed, by a reset interval or a schedule
+func Periodic(interval time.Duration, schedule *Schedule) bool {
+	return interval > 0 || schedule != nil
+}
+
+// progress within [0, 1], 0 if not a number
+func ClampProgress(x float64) float64 {
+	if x > 1 {
+		return 1
+	}
+	if x < 0 || math.IsNaN(x) {
+		return 0
+	}
+	return x
+}
+
+// minimal cron spec, fields are sets of allowed values
+type cronSpec struct {
+	minutes  [60]bool
+	hours    [24]bool
+	days     [32]bool
+	months   [13]bool
+	weekdays [7]bool
+
+	daysStar     bool
+	weekdaysStar bool
+}
+
+// parse "minute hour day-of-month month day-of-week", each field is *, a value, a range a-b,
+// optionally with step /n, or a comma separated list of them
+func parseCron(spec string) (*cronSpec, error) {
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return nil, errors.New("cron spec should have 5 fields: " + spec)
+	}
+
+	cron := &cronSpec{
+		daysStar:     fields[2] == "*",
+		weekdaysStar: fields[4] == "*",
+	}
+	weekdays := make([]bool, 8)
+	for _, field := range []struct {
+		spec     string
+		min, max int
+		set      []bool
+	}{
+		{fields[0], 0, 59, cron.minutes[:]},
+		{fields[1], 0, 23, cron.hours[:]},
+		{fields[2], 1, 31, cron.days[:]},
+		{fields[3], 1, 12, cron.months[:]},
+		{fields[4], 0, 7, weekdays},
+	} {
+		if err := parseCronField(field.spec, field.min, field.max, field.set); err != nil {
+			return nil, errors.New("invalid cron spec " + spec + ": " + err.Error())
+		}
+	}
+
+	// both 0 and 7 are sunday
+	copy(cron.weekdays[:], weekdays)
+	cron.weekdays[0] = weekdays[0] || weekdays[7]
+	return cron, nil
+}
+
+func parseCronField(spec string, min int, max int, set []bool) error {
+	for _, part := range strings.Split(spec, ",") {
+		step := 1
+		if pos := strings.Index(part, "/"); pos >= 0 {
+			var err error
+			step, err = strconv.Atoi(part[pos+1:])
+			if err != nil || step <= 0 {
+				return errors.New("invalid step " + part)
+			}
+			part = part[:pos]
+		}
+
+		low, high := min, max
+		if part != "*" {
+			bounds := strings.SplitN(part, "-", 2)
+			var err error
+			low, err = strconv.Atoi(bounds[0])
+			if err != nil {
+				return errors.New("invalid value " + part)
+			}
+			high = low
+			if len(bounds) == 2 {
+				high, err = strconv.Atoi(bounds[1])
+				if err != nil {
+					return errors.New("invalid value " + part)
+				}
+			} else if step > 1 {
+				high = max
+			}
+		}
+		if low < min || high > max || low > high {
+			return errors.New("value out of range " + part)
+		}
+
+		for v := low; v <= high; v += step {
+			set[v] = true
+		}
+	}
+	return nil
+}
+
+// day of month and day of week match either if both are restricted, as cron does
+func (cron *cronSpec) matchDay(t time.Time) bool {
+	day := cron.days[t.Day()]
+	weekday := cron.weekdays[t.Weekday()]
+	if cron.daysStar == false && cron.weekdaysStar == false {
+		return day || weekday
+	}
+	return day && weekday
+}
+
+// first firing time after t
+func (cron *cronSpec) next(t time.Time) (time.Time, bool) {
+	loc := t.Location()
+	limit := t.AddDate(scheduleSearchYears, 0, 0)
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	for t.Before(limit) {
+		switch {
+		case cron.months[t.Month()] == false:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, loc)
+		case cron.matchDay(t) == false:
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, loc)
+		case cron.hours[t.Hour()] == false:
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, loc)
+		case cron.minutes[t.Minute()] == false:
+			t = t.Add(time.Minute)
+		default:
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// last firing time not after t
+func (cron *cronSpec) prev(t time.Time) (time.Time, bool) {
+	loc := t.Location()
+	limit := t.AddDate(-scheduleSearchYears, 0, 0)
+	t = t.Truncate(time.Minute)
+	for t.After(limit) {
+		switch {
+		case cron.months[t.Month()] == false:
+			t = time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, loc).Add(-time.Minute)
+		case cron.matchDay(t) == false:
+			t = time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, loc).Add(-time.Minute)
+		case cron.hours[t.Hour()] == false:
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), 0, 0, 0, loc).Add(-time.Minute)
+		case cron.minutes[t.Minute()] == false:
+			t = t.Add(-time.Minute)
+		default:
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
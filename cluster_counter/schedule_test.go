@@ -0,0 +1,100 @@
+package cluster_counter
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSchedule_Reset(t *testing.T) {
+	if _, err := parseCron("0 0 * *"); err == nil {
+		t.Fatal("cron spec with 4 fields should be invalid")
+	}
+	if _, err := parseCron("60 0 * * *"); err == nil {
+		t.Fatal("minute out of range should be invalid")
+	}
+	if err := (&Schedule{Reset: "0 0 30 2 *"}).Validate(); err == nil {
+		t.Fatal("cron spec never firing should be invalid")
+	}
+
+	// 2020-01-01 is wednesday
+	schedule := &Schedule{Reset: "30 9 * * 1-5"}
+	beginTime, endTime := schedule.Period(time.Date(2020, 1, 3, 12, 0, 0, 0, time.UTC))
+	if beginTime != time.Date(2020, 1, 3, 9, 30, 0, 0, time.UTC) || endTime != time.Date(2020, 1, 6, 9, 30, 0, 0, time.UTC) {
+		t.Fatal("period between resets error", beginTime, endTime)
+	}
+
+	schedule = &Schedule{Reset: "*/15 * * * *"}
+	beginTime, endTime = schedule.Period(time.Date(2020, 1, 3, 12, 15, 0, 0, time.UTC))
+	if beginTime != time.Date(2020, 1, 3, 12, 15, 0, 0, time.UTC) || endTime.Sub(beginTime) != 15*time.Minute {
+		t.Fatal("period of step error", beginTime, endTime)
+	}
+}
+
+func TestSchedule_Active(t *testing.T) {
+	schedule := &Schedule{
+		Weekdays:    []time.Weekday{time.Monday, time.Tuesday, time.Wednesday, time.Thursday, time.Friday},
+		ActiveBegin: 9 * time.Hour,
+		ActiveEnd:   18 * time.Hour,
+	}
+	friday := time.Date(2020, 1, 3, 0, 0, 0, 0, time.UTC)
+	if schedule.Active(friday.Add(10*time.Hour)) == false || schedule.Active(friday.Add(20*time.Hour)) {
+		t.Fatal("active hours error")
+	}
+	if schedule.Active(friday.Add(34 * time.Hour)) {
+		t.Fatal("saturday should not be active")
+	}
+
+	// the next active window is on monday
+	beginTime, endTime := schedule.Period(friday.Add(20 * time.Hour))
+	if beginTime != friday.Add(81*time.Hour) || endTime != friday.Add(90*time.Hour) {
+		t.Fatal("next active window error", beginTime, endTime)
+	}
+
+	if d := schedule.ActiveDuration(friday, friday.Add(7*24*time.Hour)); d != 45*time.Hour {
+		t.Fatal("active duration of a week error", d)
+	}
+	if p := schedule.Progress(friday, friday.Add(24*time.Hour), friday.Add(12*time.Hour)); p != 1.0/3 {
+		t.Fatal("progress should count active hours only", p)
+	}
+
+	overnight := &Schedule{ActiveBegin: 22 * time.Hour, ActiveEnd: 6 * time.Hour}
+	if overnight.Active(friday.Add(2*time.Hour)) == false || overnight.Active(friday.Add(12*time.Hour)) {
+		t.Fatal("overnight window error")
+	}
+}
+
+// clock stopped at a time
+type stoppedClockForTest time.Time
+
+func (clock stoppedClockForTest) Now() time.Time {
+	return time.Time(clock)
+}
+
+func (clock stoppedClockForTest) NewTicker(d time.Duration) Ticker {
+	return RealClock.NewTicker(d)
+}
+
+func TestClusterCounter_ExpireWithSchedule(t *testing.T) {
+	timeNow := time.Date(2020, 1, 1, 10, 59, 59, 0, time.UTC)
+	counter := &ClusterCounter{
+		schedule: &Schedule{Reset: "0 * * * *"},
+		factory:  &ClusterCounterFactory{clock: stoppedClockForTest(timeNow)},
+	}
+	if counter.Expire() {
+		t.Fatal("counter with schedule should not expire")
+	}
+
+	if counter.beginTime != timeNow.Truncate(time.Hour) || counter.endTime != timeNow.Truncate(time.Hour).Add(time.Hour) {
+		t.Fatal("window should follow schedule", counter.beginTime, counter.endTime)
+	}
+}
+
+func TestSchedule_SummerTime(t *testing.T) {
+	// clocks go forward at 01:00 UTC on 2020-03-29 in London
+	schedule := &Schedule{TimeZone: "Europe/London", ActiveBegin: 9 * time.Hour, ActiveEnd: 18 * time.Hour}
+	beginTime, endTime := schedule.Period(time.Date(2020, 3, 29, 0, 0, 0, 0, time.UTC))
+	if beginTime.Equal(time.Date(2020, 3, 29, 8, 0, 0, 0, time.UTC)) == false ||
+		endTime.Equal(time.Date(2020, 3, 29, 17, 0, 0, 0, time.UTC)) == false {
+		t.Fatal("active window should keep local hours", beginTime, endTime)
+	}
+}
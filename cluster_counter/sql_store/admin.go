@@ -0,0 +1,94 @@
+package sql_store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/boostlearn/go-cluster-limiter/cluster_counter"
+	"strconv"
+	"strings"
+)
+
+// windows of counters whose name starts with namePrefix
+func (store *SqlStore) ListKeys(namePrefix string) ([]*cluster_counter.StoreKey, error) {
+	rows, err := store.db.QueryContext(context.Background(), store.bind(fmt.Sprintf(
+		"SELECT name, labels, begin_time, end_time FROM %v WHERE name LIKE ? ESCAPE '!'", store.table)),
+		escapeLike(namePrefix)+"%")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var keys []*cluster_counter.StoreKey
+	for rows.Next() {
+		var name, labels string
+		var beginMilli, endMilli int64
+		if err := rows.Scan(&name, &labels, &beginMilli, &endMilli); err != nil {
+			return nil, err
+		}
+		lbs, err := decodeLabels(labels)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, &cluster_counter.StoreKey{
+			Name:      name,
+			BeginTime: fromUnixMilli(beginMilli),
+			EndTime:   fromUnixMilli(endMilli),
+			Labels:    lbs,
+		})
+	}
+	return keys, rows.Err()
+}
+
+// remove counter's window
+func (store *SqlStore) Delete(key *cluster_counter.StoreKey) error {
+	_, err := store.db.ExecContext(context.Background(), store.bind(fmt.Sprintf(
+		"DELETE FROM %v WHERE counter_key = ?", store.table)),
+		counterKey(key.Name, key.BeginTime, key.EndTime, encodeLabels(key.Labels)))
+	return err
+}
+
+// escape wildcards of LIKE with '!'
+func escapeLike(s string) string {
+	replacer := strings.NewReplacer("!", "!!", "%", "!%", "_", "!_")
+	return replacer.Replace(s)
+}
+
+// parse labels built by encodeLabels
+func decodeLabels(labels string) (map[string]string, error) {
+	lbs := make(map[string]string)
+	for len(labels) > 0 {
+		k, rest, err := readQuoted(labels)
+		if err != nil {
+			return nil, err
+		}
+		if strings.HasPrefix(rest, "=") == false {
+			return nil, errors.New("bad labels: " + labels)
+		}
+		v, rest, err := readQuoted(rest[1:])
+		if err != nil {
+			return nil, err
+		}
+		lbs[k] = v
+
+		labels = strings.TrimPrefix(rest, SqlLabelSep)
+	}
+	return lbs, nil
+}
+
+// unquote the quoted string at the beginning of s
+func readQuoted(s string) (string, string, error) {
+	if strings.HasPrefix(s, `"`) == false {
+		return "", s, errors.New("bad quoted string: " + s)
+	}
+	for i := 1; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case '"':
+			value, err := strconv.Unquote(s[:i+1])
+			return value, s[i+1:], err
+		}
+	}
+	return "", s, errors.New("bad quoted string: " + s)
+}
@@ -0,0 +1,102 @@
+package sql_store
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+)
+
+// schema changes in order, version i+1 is migrations[i]; only append new ones.
+// statements should be idempotent, MySQL commits schema changes outside of the migration's transaction
+var migrations = []func(store *SqlStore) []string{
+	func(store *SqlStore) []string {
+		return store.createTable(store.table, "counter_key CHAR(64) NOT NULL PRIMARY KEY, "+
+			"name VARCHAR(255) NOT NULL, "+
+			"labels TEXT NOT NULL, "+
+			"begin_time BIGINT NOT NULL, "+
+			"end_time BIGINT NOT NULL, "+
+			"value_sum DOUBLE PRECISION NOT NULL, "+
+			"value_count BIGINT NOT NULL, "+
+			"update_time BIGINT NOT NULL", "end_time")
+	},
+	func(store *SqlStore) []string {
+		return store.createTable(store.table+"_token", "token VARCHAR(191) NOT NULL PRIMARY KEY, "+
+			"end_time BIGINT NOT NULL", "end_time")
+	},
+}
+
+// statements creating table and its index on indexColumn if they do not exist;
+// MySQL has no CREATE INDEX IF NOT EXISTS, so the index is declared within the table there
+func (store *SqlStore) createTable(table string, columns string, indexColumn string) []string {
+	index := table + "_" + indexColumn
+	if store.dialect == DialectMySQL {
+		return []string{fmt.Sprintf("CREATE TABLE IF NOT EXISTS %v (%v, INDEX %v (%v))", table, columns, index, indexColumn)}
+	}
+	return []string{
+		fmt.Sprintf("CREATE TABLE IF NOT EXISTS %v (%v)", table, columns),
+		fmt.Sprintf("CREATE INDEX IF NOT EXISTS %v ON %v (%v)", index, table, indexColumn),
+	}
+}
+
+// latest schema version known by this package
+func LatestSchemaVersion() int {
+	return len(migrations)
+}
+
+// schema version of the database, 0 if not created
+func (store *SqlStore) SchemaVersion(ctx context.Context) (int, error) {
+	if _, err := store.db.ExecContext(ctx, fmt.Sprintf(
+		"CREATE TABLE IF NOT EXISTS %v_schema (version INT NOT NULL PRIMARY KEY)", store.table)); err != nil {
+		return 0, err
+	}
+
+	var version sql.NullInt64
+	err := store.db.QueryRowContext(ctx, fmt.Sprintf("SELECT MAX(version) FROM %v_schema", store.table)).Scan(&version)
+	if err != nil {
+		return 0, err
+	}
+	return int(version.Int64), nil
+}
+
+// create tables or upgrade them to the latest schema version
+func (store *SqlStore) Migrate(ctx context.Context) error {
+	version, err := store.SchemaVersion(ctx)
+	if err != nil {
+		return err
+	}
+	if version > len(migrations) {
+		return fmt.Errorf("schema version %v is newer than supported %v", version, len(migrations))
+	}
+
+	for i := version; i < len(migrations); i++ {
+		if err := store.migrate(ctx, i+1); err != nil {
+			// version is unique, another process may have applied it
+			if current, versionErr := store.SchemaVersion(ctx); versionErr == nil && current > i {
+				i = current - 1
+				continue
+			}
+			return fmt.Errorf("migrate to version %v: %v", i+1, err)
+		}
+	}
+	return nil
+}
+
+// apply one migration and record its version within one transaction
+func (store *SqlStore) migrate(ctx context.Context, version int) error {
+	tx, err := store.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	for _, stmt := range migrations[version-1](store) {
+		if _, err := tx.ExecContext(ctx, stmt); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.ExecContext(ctx, store.bind(fmt.Sprintf(
+		"INSERT INTO %v_schema (version) VALUES (?)", store.table)), version); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
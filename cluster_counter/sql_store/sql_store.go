@@ -0,0 +1,342 @@
+package sql_store
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/boostlearn/go-cluster-limiter/cluster_counter"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const DefaultTable = "cluster_counter"
+const DefaultCleanupIntervalSeconds = 60
+const DefaultRetentionSeconds = 3600
+const SqlLabelSep = ","
+
+type Dialect int
+
+const (
+	DialectMySQL Dialect = iota
+	DialectPostgres
+	DialectSQLite
+)
+
+// dialect of database/sql's driver name
+func DialectOf(driverName string) (Dialect, error) {
+	switch driverName {
+	case "mysql":
+		return DialectMySQL, nil
+	case "postgres", "pgx":
+		return DialectPostgres, nil
+	case "sqlite", "sqlite3":
+		return DialectSQLite, nil
+	}
+	return DialectMySQL, errors.New("unsupported sql driver: " + driverName)
+}
+
+// options for creating sql store
+type SqlStoreOpts struct {
+	Dialect Dialect
+	Table   string
+
+	// interval of removing expired windows, never removed if negative
+	CleanupInterval time.Duration
+	// how long a window is kept after its end time
+	Retention time.Duration
+}
+
+// store of counters' data in mysql, postgres or sqlite, one row for each counter's window
+type SqlStore struct {
+	db      *sql.DB
+	dialect Dialect
+	table   string
+
+	retention time.Duration
+	done      chan struct{}
+	closeOnce sync.Once
+	wg        sync.WaitGroup
+}
+
+// build new store from database/sql's driver name and data source name, schema is created if missing
+func NewStore(driverName string, dataSourceName string, table string) (*SqlStore, error) {
+	dialect, err := DialectOf(driverName)
+	if err != nil {
+		return nil, err
+	}
+
+	db, err := sql.Open(driverName, dataSourceName)
+	if err != nil {
+		return nil, err
+	}
+
+	store, err := NewSqlStore(db, &SqlStoreOpts{Dialect: dialect, Table: table})
+	if err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	return store, nil
+}
+
+// build new store from opened db, schema is created if missing
+func NewSqlStore(db *sql.DB, opts *SqlStoreOpts) (*SqlStore, error) {
+	if len(opts.Table) == 0 {
+		opts.Table = DefaultTable
+	}
+
+	if opts.CleanupInterval == 0 {
+		opts.CleanupInterval = time.Duration(DefaultCleanupIntervalSeconds) * time.Second
+	}
+
+	if opts.Retention == 0 {
+		opts.Retention = time.Duration(DefaultRetentionSeconds) * time.Second
+	}
+
+	if err := db.Ping(); err != nil {
+		return nil, err
+	}
+
+	store := &SqlStore{
+		db:        db,
+		dialect:   opts.Dialect,
+		table:     opts.Table,
+		retention: opts.Retention,
+		done:      make(chan struct{}),
+	}
+
+	if err := store.Migrate(context.Background()); err != nil {
+		return nil, err
+	}
+
+	if opts.CleanupInterval > 0 {
+		store.wg.Add(1)
+		go store.cleanupLoop(opts.CleanupInterval)
+	}
+	return store, nil
+}
+
+// store client's data within cluster
+func (store *SqlStore) Store(name string, beginTime time.Time, endTime time.Time, lbs map[string]string,
+	value cluster_counter.CounterValue, force bool) error {
+	return store.StoreV2(context.Background(), "", &cluster_counter.StoreItem{
+		StoreKey: cluster_counter.StoreKey{Name: name, BeginTime: beginTime, EndTime: endTime, Labels: lbs},
+		Value:    value,
+		Force:    force,
+	})
+}
+
+// store client's data, values with the same token are applied only once
+func (store *SqlStore) StoreOnce(token string, name string, beginTime time.Time, endTime time.Time,
+	lbs map[string]string, value cluster_counter.CounterValue, force bool) error {
+	return store.StoreV2(context.Background(), "", &cluster_counter.StoreItem{
+		StoreKey: cluster_counter.StoreKey{Name: name, BeginTime: beginTime, EndTime: endTime, Labels: lbs},
+		Value:    value,
+		Force:    force,
+		Token:    token,
+	})
+}
+
+// load cluster's data for clients
+func (store *SqlStore) Load(name string, beginTime time.Time, endTime time.Time, lbs map[string]string,
+) (cluster_counter.CounterValue, error) {
+	value, err := store.LoadV2(context.Background(), "", &cluster_counter.StoreKey{
+		Name: name, BeginTime: beginTime, EndTime: endTime, Labels: lbs})
+	if cluster_counter.IsNotFound(err) {
+		return cluster_counter.CounterValue{}, nil
+	}
+	return value, err
+}
+
+// store with context, the token is recorded within the same transaction as the value
+func (store *SqlStore) StoreV2(ctx context.Context, nodeID string, item *cluster_counter.StoreItem) error {
+	labels := encodeLabels(item.Labels)
+	args := []interface{}{
+		counterKey(item.Name, item.BeginTime, item.EndTime, labels), item.Name, labels,
+		unixMilli(item.BeginTime), unixMilli(item.EndTime), item.Value.Sum, item.Value.Count,
+		time.Now().UnixNano() / int64(time.Millisecond),
+	}
+
+	if len(item.Token) == 0 {
+		_, err := store.db.ExecContext(ctx, store.upsertQuery(), args...)
+		return transientError(err)
+	}
+
+	tx, err := store.db.BeginTx(ctx, nil)
+	if err != nil {
+		return transientError(err)
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	result, err := tx.ExecContext(ctx, store.insertTokenQuery(), item.Token,
+		unixMilli(cluster_counter.TokenExpireTime(time.Now())))
+	if err != nil {
+		return transientError(err)
+	}
+	if n, err := result.RowsAffected(); err != nil || n == 0 {
+		// token was applied before
+		return transientError(err)
+	}
+
+	if _, err := tx.ExecContext(ctx, store.upsertQuery(), args...); err != nil {
+		return transientError(err)
+	}
+	return transientError(tx.Commit())
+}
+
+// set client's data unless the window has a row, returns the data kept
+func (store *SqlStore) SetIfAbsent(name string, beginTime time.Time, endTime time.Time, lbs map[string]string,
+	value cluster_counter.CounterValue) (cluster_counter.CounterValue, error) {
+	labels := encodeLabels(lbs)
+	_, err := store.db.Exec(store.insertAbsentQuery(), counterKey(name, beginTime, endTime, labels), name, labels,
+		unixMilli(beginTime), unixMilli(endTime), value.Sum, value.Count, time.Now().UnixNano()/int64(time.Millisecond))
+	if err != nil {
+		return cluster_counter.CounterValue{}, transientError(err)
+	}
+	return store.LoadV2(context.Background(), "", &cluster_counter.StoreKey{
+		Name: name, BeginTime: beginTime, EndTime: endTime, Labels: lbs})
+}
+
+// load with context, missing window is not found error
+func (store *SqlStore) LoadV2(ctx context.Context, nodeID string, key *cluster_counter.StoreKey,
+) (cluster_counter.CounterValue, error) {
+	var value cluster_counter.CounterValue
+	row := store.db.QueryRowContext(ctx, store.bind(fmt.Sprintf(
+		"SELECT value_sum, value_count FROM %v WHERE counter_key = ?", store.table)),
+		counterKey(key.Name, key.BeginTime, key.EndTime, encodeLabels(key.Labels)))
+	err := row.Scan(&value.Sum, &value.Count)
+	if err == sql.ErrNoRows {
+		return value, cluster_counter.NewNotFoundError(err)
+	}
+	return value, transientError(err)
+}
+
+// remove windows ended before the given time, windows without end time are kept
+func (store *SqlStore) DeleteExpired(ctx context.Context, before time.Time) (int64, error) {
+	result, err := store.db.ExecContext(ctx, store.bind(fmt.Sprintf(
+		"DELETE FROM %v WHERE end_time > 0 AND end_time < ?", store.table)), unixMilli(before))
+	if err != nil {
+		return 0, err
+	}
+	deleted, _ := result.RowsAffected()
+
+	_, err = store.db.ExecContext(ctx, store.bind(fmt.Sprintf(
+		"DELETE FROM %v_token WHERE end_time > 0 AND end_time < ?", store.table)), unixMilli(before))
+	return deleted, err
+}
+
+func (store *SqlStore) cleanupLoop(interval time.Duration) {
+	defer store.wg.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-store.done:
+			return
+		case <-ticker.C:
+			_, _ = store.DeleteExpired(context.Background(), time.Now().Add(-store.retention))
+		}
+	}
+}
+
+// stop cleanup and close db
+func (store *SqlStore) Close() error {
+	store.closeOnce.Do(func() {
+		close(store.done)
+	})
+	store.wg.Wait()
+	return store.db.Close()
+}
+
+func (store *SqlStore) upsertQuery() string {
+	insert := fmt.Sprintf("INSERT INTO %v (counter_key, name, labels, begin_time, end_time, value_sum, value_count, "+
+		"update_time) VALUES (?, ?, ?, ?, ?, ?, ?, ?)", store.table)
+	if store.dialect == DialectMySQL {
+		return insert + " ON DUPLICATE KEY UPDATE value_sum = value_sum + VALUES(value_sum), " +
+			"value_count = value_count + VALUES(value_count), update_time = VALUES(update_time)"
+	}
+	return store.bind(insert + fmt.Sprintf(" ON CONFLICT (counter_key) DO UPDATE SET "+
+		"value_sum = %v.value_sum + excluded.value_sum, value_count = %v.value_count + excluded.value_count, "+
+		"update_time = excluded.update_time", store.table, store.table))
+}
+
+func (store *SqlStore) insertAbsentQuery() string {
+	insert := fmt.Sprintf("INSERT INTO %v (counter_key, name, labels, begin_time, end_time, value_sum, value_count, "+
+		"update_time) VALUES (?, ?, ?, ?, ?, ?, ?, ?)", store.table)
+	if store.dialect == DialectMySQL {
+		return "INSERT IGNORE" + strings.TrimPrefix(insert, "INSERT")
+	}
+	return store.bind(insert + " ON CONFLICT (counter_key) DO NOTHING")
+}
+
+func (store *SqlStore) insertTokenQuery() string {
+	if store.dialect == DialectMySQL {
+		return fmt.Sprintf("INSERT IGNORE INTO %v_token (token, end_time) VALUES (?, ?)", store.table)
+	}
+	return store.bind(fmt.Sprintf("INSERT INTO %v_token (token, end_time) VALUES (?, ?) "+
+		"ON CONFLICT (token) DO NOTHING", store.table))
+}
+
+// replace ? with $n for postgres
+func (store *SqlStore) bind(query string) string {
+	if store.dialect != DialectPostgres {
+		return query
+	}
+
+	var builder strings.Builder
+	n := 0
+	for _, c := range query {
+		if c == '?' {
+			n++
+			builder.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		builder.WriteRune(c)
+	}
+	return builder.String()
+}
+
+// errors of database are taken as transient
+func transientError(err error) error {
+	if err == nil {
+		return nil
+	}
+	return cluster_counter.NewTransientError(err)
+}
+
+// milliseconds since epoch, zero time is 0
+func unixMilli(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+func fromUnixMilli(milli int64) time.Time {
+	if milli == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, milli*int64(time.Millisecond))
+}
+
+// canonical encoding of labels: sorted and quoted k=v pairs
+func encodeLabels(lbs map[string]string) string {
+	var labels []string
+	for k, v := range lbs {
+		labels = append(labels, strconv.Quote(k)+"="+strconv.Quote(v))
+	}
+	sort.Strings(labels)
+	return strings.Join(labels, SqlLabelSep)
+}
+
+// primary key of one counter's window, hashed to fit index length limits
+func counterKey(name string, beginTime time.Time, endTime time.Time, labels string) string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%v\n%v\n%v\n%v", name, unixMilli(beginTime), unixMilli(endTime), labels)))
+	return hex.EncodeToString(sum[:])
+}
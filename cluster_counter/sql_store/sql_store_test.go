@@ -0,0 +1,148 @@
+package sql_store
+
+import (
+	"context"
+	"database/sql"
+	"github.com/boostlearn/go-cluster-limiter/cluster_counter"
+	"testing"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+func newStoreForTest(t *testing.T) *SqlStore {
+	db, err := sql.Open("sqlite", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// every connection has its own in-memory database
+	db.SetMaxOpenConns(1)
+
+	store, err := NewSqlStore(db, &SqlStoreOpts{Dialect: DialectSQLite, CleanupInterval: -1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+func TestSqlStore_StoreAndLoad(t *testing.T) {
+	store := newStoreForTest(t)
+	defer store.Close()
+
+	startTime := time.Now().Truncate(time.Second)
+	endTime := startTime.Add(10 * time.Second)
+	lbs := map[string]string{"a1": "c2", "a2": "c1"}
+
+	_ = store.Store("test", startTime, endTime, lbs, cluster_counter.CounterValue{Sum: 100, Count: 1}, false)
+	_ = store.Store("test", startTime, endTime, lbs, cluster_counter.CounterValue{Sum: 200, Count: 1}, false)
+	v, err := store.Load("test", startTime, endTime, lbs)
+	if err != nil || v.Sum != 300 || v.Count != 2 {
+		t.Fatal("load value error", v, err)
+	}
+
+	swapped := map[string]string{"a1": "c1", "a2": "c2"}
+	if _, err := store.LoadV2(context.Background(), "", &cluster_counter.StoreKey{
+		Name: "test", BeginTime: startTime, EndTime: endTime, Labels: swapped}); cluster_counter.IsNotFound(err) == false {
+		t.Fatal("labels should not collide", err)
+	}
+
+	for i := 0; i < 2; i++ {
+		_ = store.StoreOnce("t1", "test", startTime, endTime, lbs, cluster_counter.CounterValue{Sum: 1, Count: 1}, true)
+	}
+	v, _ = store.Load("test", startTime, endTime, lbs)
+	if v.Count != 3 {
+		t.Fatal("token should be applied once", v)
+	}
+}
+
+func TestSqlStore_SetIfAbsent(t *testing.T) {
+	store := newStoreForTest(t)
+	defer store.Close()
+
+	startTime := time.Now().Truncate(time.Second)
+	endTime := startTime.Add(10 * time.Second)
+	for i := 1; i <= 2; i++ {
+		kept, err := store.SetIfAbsent("test", startTime, endTime, nil, cluster_counter.CounterValue{Sum: float64(i), Count: 1})
+		if err != nil || kept.Sum != 1 || kept.Count != 1 {
+			t.Fatal("first value should be kept", kept, err)
+		}
+	}
+}
+
+func TestSqlStore_Migrate(t *testing.T) {
+	store := newStoreForTest(t)
+	defer store.Close()
+
+	if err := store.Migrate(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	version, err := store.SchemaVersion(context.Background())
+	if err != nil || version != LatestSchemaVersion() {
+		t.Fatal("schema version error", version, err)
+	}
+
+	// tables and indexes of the last version exist, but its version was not recorded
+	if _, err := store.db.Exec("DELETE FROM "+store.table+"_schema WHERE version = ?", version); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Migrate(context.Background()); err != nil {
+		t.Fatal("migration should be repeatable", err)
+	}
+	if _, err := store.db.Exec("INSERT INTO "+store.table+"_schema (version) VALUES (?)", version); err == nil {
+		t.Fatal("schema version should be unique")
+	}
+}
+
+func TestSqlStore_DeleteExpired(t *testing.T) {
+	store := newStoreForTest(t)
+	defer store.Close()
+
+	timeNow := time.Now()
+	_ = store.Store("old", timeNow.Add(-2*time.Hour), timeNow.Add(-time.Hour), nil,
+		cluster_counter.CounterValue{Sum: 1, Count: 1}, true)
+	_ = store.Store("new", timeNow, timeNow.Add(time.Hour), nil, cluster_counter.CounterValue{Sum: 1, Count: 1}, true)
+	_ = store.Store("forever", timeNow, time.Time{}, nil, cluster_counter.CounterValue{Sum: 1, Count: 1}, true)
+
+	deleted, err := store.DeleteExpired(context.Background(), timeNow)
+	if err != nil || deleted != 1 {
+		t.Fatal("delete expired error", deleted, err)
+	}
+	if v, _ := store.Load("new", timeNow, timeNow.Add(time.Hour), nil); v.Count != 1 {
+		t.Fatal("unexpired window should be kept")
+	}
+	if v, _ := store.Load("forever", timeNow, time.Time{}, nil); v.Count != 1 {
+		t.Fatal("window without end time should be kept")
+	}
+}
+
+func TestSqlStore_Bind(t *testing.T) {
+	store := &SqlStore{dialect: DialectPostgres}
+	if q := store.bind("a = ? AND b = ?"); q != "a = $1 AND b = $2" {
+		t.Fatal("bind error", q)
+	}
+}
+
+func TestSqlStore_ListKeysAndDelete(t *testing.T) {
+	store := newStoreForTest(t)
+	defer store.Close()
+
+	startTime := time.Now().Truncate(time.Second)
+	endTime := startTime.Add(time.Hour)
+	lbs := map[string]string{"a,b": `c="d"`, "e": ""}
+	for _, name := range []string{"test_1", "test_2", "testx"} {
+		_ = store.Store(name, startTime, endTime, lbs, cluster_counter.CounterValue{Sum: 1, Count: 1}, false)
+	}
+
+	keys, err := store.ListKeys("test_")
+	if err != nil || len(keys) != 2 {
+		t.Fatal("list keys error", keys, err)
+	}
+	if keys[0].Labels["a,b"] != `c="d"` || keys[0].EndTime.Equal(endTime) == false {
+		t.Fatal("decode key error", keys[0])
+	}
+
+	_ = store.Delete(keys[0])
+	if keys, _ = store.ListKeys("test"); len(keys) != 2 {
+		t.Fatal("key should be deleted", keys)
+	}
+}
@@ -1,8 +1,98 @@
 package cluster_counter
 
-import "time"
+import (
+	"reflect"
+	"time"
+)
 
 type DataStoreI interface {
 	Store(name string, beginTime time.Time, endTime time.Time, lbs map[string]string, value CounterValue, force bool) error
 	Load(name string, beginTime time.Time, endTime time.Time, lbs map[string]string) (CounterValue, error)
 }
+
+// counter's data key within one time window
+type StoreKey struct {
+	Name      string
+	BeginTime time.Time
+	EndTime   time.Time
+	Labels    map[string]string
+}
+
+// counter's data to store
+type StoreItem struct {
+	StoreKey
+	Value CounterValue
+	Force bool
+	// unique id of this delta, set when journal is enabled
+	Token string
+	// why the value is stored, see StoreReason
+	Reason StoreReason
+}
+
+// optional: store that handles all counters of one heartbeat in a single call
+// the returned slices have the same length and order as the input
+type BatchDataStoreI interface {
+	DataStoreI
+	StoreBatch(items []*StoreItem) []error
+	LoadBatch(keys []*StoreKey) ([]CounterValue, []error)
+}
+
+// optional: store that knows it is unavailable, counters then estimate cluster's data from local traffic
+type DegradedStoreI interface {
+	Degraded() bool
+}
+
+// applied tokens are kept this long by idempotent stores, independent of the window's length,
+// so a journal should be replayed within it after a crash
+const DefaultTokenExpireSeconds = 3600
+
+// time until which a token applied at timeNow is kept
+func TokenExpireTime(timeNow time.Time) time.Time {
+	return timeNow.Add(DefaultTokenExpireSeconds * time.Second)
+}
+
+// optional: store that applies the value of one token at most once,
+// so that replaying journal does not count the same delta twice
+type IdempotentDataStoreI interface {
+	StoreOnce(token string, name string, beginTime time.Time, endTime time.Time, lbs map[string]string,
+		value CounterValue, force bool) error
+}
+
+// optional: store that can list and remove counters' windows, for cleanup of deleted counters and audits
+type AdminDataStoreI interface {
+	// windows of counters whose name starts with namePrefix
+	ListKeys(namePrefix string) ([]*StoreKey, error)
+	Delete(key *StoreKey) error
+}
+
+// optional: store keeping the first value set for a window, atomically for the whole cluster,
+// so that nodes agree on one record, e.g. settlement of a period. the value is read by Load
+type SetIfAbsentDataStoreI interface {
+	// value kept in store after the call, which is value if the window had none
+	SetIfAbsent(name string, beginTime time.Time, endTime time.Time, lbs map[string]string,
+		value CounterValue) (CounterValue, error)
+}
+
+// optional: store wrapping another one, e.g. a circuit breaker, and only as able as the wrapped store
+type WrapperDataStoreI interface {
+	Unwrap() DataStoreI
+}
+
+// whether store sets values if absent, asking wrappers about the stores they wrap
+func CanSetIfAbsent(store DataStoreI) bool {
+	if store == nil || reflect.ValueOf(store).IsNil() {
+		return false
+	}
+	if _, ok := store.(SetIfAbsentDataStoreI); ok == false {
+		return false
+	}
+	if wrapper, ok := store.(WrapperDataStoreI); ok {
+		return CanSetIfAbsent(wrapper.Unwrap())
+	}
+	return true
+}
+
+// optional: admin store that removes many windows in one call, cheaper than calling Delete for each of them
+type BatchAdminDataStoreI interface {
+	DeleteBatch(keys []*StoreKey) error
+}
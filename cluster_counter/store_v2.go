@@ -0,0 +1,252 @@
+package cluster_counter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+)
+
+// why data is written into store
+type StoreReason int
+
+const (
+	StoreReasonHeartbeat StoreReason = iota // periodic store of local delta
+	StoreReasonExpire                       // last delta of an expired window
+	StoreReasonFlush                        // flush on close
+	StoreReasonReplay                       // replay of journal left by previous process
+	StoreReasonHistory                      // window kept after it ends, see StoreHistory
+)
+
+func (reason StoreReason) String() string {
+	switch reason {
+	case StoreReasonHeartbeat:
+		return "heartbeat"
+	case StoreReasonExpire:
+		return "expire"
+	case StoreReasonFlush:
+		return "flush"
+	case StoreReasonReplay:
+		return "replay"
+	case StoreReasonHistory:
+		return "history"
+	}
+	return "unknown"
+}
+
+// store with deadlines, caller's identity and typed errors
+// errors should be built with NewNotFoundError, NewTransientError or NewPermanentError,
+// untyped errors are taken as transient
+type DataStoreV2I interface {
+	StoreV2(ctx context.Context, nodeID string, item *StoreItem) error
+	LoadV2(ctx context.Context, nodeID string, key *StoreKey) (CounterValue, error)
+}
+
+// optional: store that handles all counters of one heartbeat in a single call with deadline and caller's identity,
+// errors are typed as in DataStoreV2I. the returned slices have the same length and order as the input
+type BatchDataStoreV2I interface {
+	StoreBatchV2(ctx context.Context, nodeID string, items []*StoreItem) []error
+	LoadBatchV2(ctx context.Context, nodeID string, keys []*StoreKey) ([]CounterValue, []error)
+}
+
+type StoreErrorKind int
+
+const (
+	StoreErrorTransient StoreErrorKind = iota // may succeed on retry
+	StoreErrorNotFound                        // no data for the key
+	StoreErrorPermanent                       // retry will fail again
+)
+
+func (kind StoreErrorKind) String() string {
+	switch kind {
+	case StoreErrorTransient:
+		return "transient"
+	case StoreErrorNotFound:
+		return "not found"
+	case StoreErrorPermanent:
+		return "permanent"
+	}
+	return "unknown"
+}
+
+// error with kind for retry and degrade decisions
+type StoreError struct {
+	Kind StoreErrorKind
+	Err  error
+}
+
+func (storeErr *StoreError) Error() string {
+	return fmt.Sprintf("store error(%v): %v", storeErr.Kind, storeErr.Err)
+}
+
+func (storeErr *StoreError) Unwrap() error {
+	return storeErr.Err
+}
+
+func NewNotFoundError(err error) error {
+	return &StoreError{Kind: StoreErrorNotFound, Err: err}
+}
+
+func NewTransientError(err error) error {
+	return &StoreError{Kind: StoreErrorTransient, Err: err}
+}
+
+func NewPermanentError(err error) error {
+	return &StoreError{Kind: StoreErrorPermanent, Err: err}
+}
+
+// kind of error, untyped errors are transient
+func StoreErrorKindOf(err error) StoreErrorKind {
+	var storeErr *StoreError
+	if errors.As(err, &storeErr) {
+		return storeErr.Kind
+	}
+	return StoreErrorTransient
+}
+
+// error of a store as is if it has a kind, or else as transient error
+func WrapStoreError(err error) error {
+	if err == nil {
+		return nil
+	}
+	var storeErr *StoreError
+	if errors.As(err, &storeErr) {
+		return err
+	}
+	return NewTransientError(err)
+}
+
+func IsNotFound(err error) bool {
+	return err != nil && StoreErrorKindOf(err) == StoreErrorNotFound
+}
+
+func IsTransient(err error) bool {
+	return err != nil && StoreErrorKindOf(err) == StoreErrorTransient
+}
+
+func IsPermanent(err error) bool {
+	return err != nil && StoreErrorKindOf(err) == StoreErrorPermanent
+}
+
+// adapter of DataStoreI: the context is checked before each call, errors without kind are transient
+type storeV2Adapter struct {
+	store DataStoreI
+}
+
+// build DataStoreV2I from store, stores implementing it are returned as is
+func NewStoreV2(store DataStoreI) DataStoreV2I {
+	if store == nil || reflect.ValueOf(store).IsNil() {
+		return nil
+	}
+	if storeV2, ok := store.(DataStoreV2I); ok {
+		return storeV2
+	}
+	return &storeV2Adapter{store: store}
+}
+
+func (adapter *storeV2Adapter) StoreV2(ctx context.Context, nodeID string, item *StoreItem) error {
+	if err := ctx.Err(); err != nil {
+		return NewTransientError(err)
+	}
+
+	var err error
+	if idempotentStore, ok := adapter.store.(IdempotentDataStoreI); ok && len(item.Token) > 0 {
+		err = idempotentStore.StoreOnce(item.Token, item.Name, item.BeginTime, item.EndTime, item.Labels,
+			item.Value, item.Force)
+	} else {
+		err = adapter.store.Store(item.Name, item.BeginTime, item.EndTime, item.Labels, item.Value, item.Force)
+	}
+	return WrapStoreError(err)
+}
+
+func (adapter *storeV2Adapter) LoadV2(ctx context.Context, nodeID string, key *StoreKey) (CounterValue, error) {
+	if err := ctx.Err(); err != nil {
+		return CounterValue{}, NewTransientError(err)
+	}
+
+	value, err := adapter.store.Load(key.Name, key.BeginTime, key.EndTime, key.Labels)
+	return value, WrapStoreError(err)
+}
+
+// adapter of BatchDataStoreI: the context is checked before each batch, errors without kind are transient
+type batchStoreV2Adapter struct {
+	store BatchDataStoreI
+}
+
+// adapter of store without batches or with batches ignoring context: items are handled one by one through DataStoreV2I
+type itemStoreV2Adapter struct {
+	store DataStoreV2I
+}
+
+// build BatchDataStoreV2I from store, stores implementing it are returned as is.
+// a DataStoreV2I without batches of its own keeps its context per item
+func NewBatchStoreV2(store DataStoreI) BatchDataStoreV2I {
+	if store == nil || reflect.ValueOf(store).IsNil() {
+		return nil
+	}
+	if batchStoreV2, ok := store.(BatchDataStoreV2I); ok {
+		return batchStoreV2
+	}
+	if storeV2, ok := store.(DataStoreV2I); ok {
+		return &itemStoreV2Adapter{store: storeV2}
+	}
+	if batchStore, ok := store.(BatchDataStoreI); ok {
+		return &batchStoreV2Adapter{store: batchStore}
+	}
+	return &itemStoreV2Adapter{store: NewStoreV2(store)}
+}
+
+func (adapter *batchStoreV2Adapter) StoreBatchV2(ctx context.Context, nodeID string, items []*StoreItem) []error {
+	errs := make([]error, len(items))
+	if err := ctx.Err(); err != nil {
+		for i := range errs {
+			errs[i] = NewTransientError(err)
+		}
+		return errs
+	}
+
+	batchErrs := adapter.store.StoreBatch(items)
+	for i := range errs {
+		errs[i] = WrapStoreError(batchError(batchErrs, i))
+	}
+	return errs
+}
+
+func (adapter *batchStoreV2Adapter) LoadBatchV2(ctx context.Context, nodeID string, keys []*StoreKey,
+) ([]CounterValue, []error) {
+	values := make([]CounterValue, len(keys))
+	errs := make([]error, len(keys))
+	if err := ctx.Err(); err != nil {
+		for i := range errs {
+			errs[i] = NewTransientError(err)
+		}
+		return values, errs
+	}
+
+	batchValues, batchErrs := adapter.store.LoadBatch(keys)
+	for i := range errs {
+		if i < len(batchValues) {
+			values[i] = batchValues[i]
+		}
+		errs[i] = WrapStoreError(batchError(batchErrs, i))
+	}
+	return values, errs
+}
+
+func (adapter *itemStoreV2Adapter) StoreBatchV2(ctx context.Context, nodeID string, items []*StoreItem) []error {
+	errs := make([]error, len(items))
+	for i, item := range items {
+		errs[i] = adapter.store.StoreV2(ctx, nodeID, item)
+	}
+	return errs
+}
+
+func (adapter *itemStoreV2Adapter) LoadBatchV2(ctx context.Context, nodeID string, keys []*StoreKey,
+) ([]CounterValue, []error) {
+	values := make([]CounterValue, len(keys))
+	errs := make([]error, len(keys))
+	for i, key := range keys {
+		values[i], errs[i] = adapter.store.LoadV2(ctx, nodeID, key)
+	}
+	return values, errs
+}
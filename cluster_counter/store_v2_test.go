@@ -0,0 +1,142 @@
+package cluster_counter
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+type storeV2ForTest struct {
+	storeErr error
+	calls    int
+	nodeID   string
+	reasons  []StoreReason
+}
+
+func (store *storeV2ForTest) StoreV2(ctx context.Context, nodeID string, item *StoreItem) error {
+	store.calls++
+	store.nodeID = nodeID
+	store.reasons = append(store.reasons, item.Reason)
+	return store.storeErr
+}
+
+func (store *storeV2ForTest) LoadV2(ctx context.Context, nodeID string, key *StoreKey) (CounterValue, error) {
+	return CounterValue{}, NewNotFoundError(errors.New("no data"))
+}
+
+func (store *storeV2ForTest) Store(name string, beginTime time.Time, endTime time.Time, lbs map[string]string,
+	value CounterValue, force bool) error {
+	return errors.New("should call StoreV2")
+}
+
+func (store *storeV2ForTest) Load(name string, beginTime time.Time, endTime time.Time, lbs map[string]string,
+) (CounterValue, error) {
+	return CounterValue{}, errors.New("should call LoadV2")
+}
+
+func TestStoreError_Kind(t *testing.T) {
+	err := errors.New("down")
+	if IsTransient(err) == false || IsTransient(nil) {
+		t.Fatal("untyped error should be transient")
+	}
+	if IsPermanent(NewPermanentError(err)) == false || IsNotFound(NewNotFoundError(err)) == false {
+		t.Fatal("typed error kind error")
+	}
+	if errors.Is(NewTransientError(err), err) == false {
+		t.Fatal("store error should unwrap")
+	}
+	if IsPermanent(WrapStoreError(NewPermanentError(err))) == false || IsTransient(WrapStoreError(err)) == false {
+		t.Fatal("error with kind should be kept, others are transient")
+	}
+
+	adapter := NewStoreV2(&journalStoreForTest{tokens: make(map[string]bool)})
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := adapter.StoreV2(ctx, "n1", &StoreItem{}); IsTransient(err) == false {
+		t.Fatal("canceled call should be transient error", err)
+	}
+}
+
+func TestClusterCounter_StoreV2(t *testing.T) {
+	store := &storeV2ForTest{storeErr: NewPermanentError(errors.New("bad value"))}
+	factory := NewFactory(&ClusterCounterFactoryOpts{Store: store, NodeID: "n1"})
+	factory.Stop()
+
+	counter, _ := factory.NewClusterCounter(&ClusterCounterOpts{Name: "test", ResetInterval: time.Hour})
+	if counter.Degraded() {
+		t.Fatal("missing key should not degrade counter")
+	}
+
+	counter.Add(1)
+	if counter.StoreData() {
+		t.Fatal("store should fail")
+	}
+	if IsPermanent(counter.LastStoreError()) == false || store.nodeID != "n1" {
+		t.Fatal("store error should be recorded", counter.LastStoreError(), store.nodeID)
+	}
+
+	// value of permanent failure is dropped, not retried
+	if err := counter.Flush(); err != nil || store.calls != 1 {
+		t.Fatal("dropped value should not be stored again", err, store.calls)
+	}
+
+	store.storeErr = errors.New("timeout")
+	counter.Add(1)
+	if err := counter.Flush(); err == nil {
+		t.Fatal("flush should fail")
+	}
+	if err := counter.Flush(); err == nil || store.calls != 3 {
+		t.Fatal("transient failure should be retried", store.calls)
+	}
+	if store.reasons[0] != StoreReasonHeartbeat || store.reasons[1] != StoreReasonFlush {
+		t.Fatal("store reason error", store.reasons)
+	}
+}
+
+type batchStoreV2ForTest struct {
+	batchStoreForTest
+	nodeID    string
+	deadlines int
+}
+
+func (store *batchStoreV2ForTest) StoreBatchV2(ctx context.Context, nodeID string, items []*StoreItem) []error {
+	store.nodeID = nodeID
+	if _, ok := ctx.Deadline(); ok {
+		store.deadlines++
+	}
+	return store.StoreBatch(items)
+}
+
+func (store *batchStoreV2ForTest) LoadBatchV2(ctx context.Context, nodeID string, keys []*StoreKey,
+) ([]CounterValue, []error) {
+	if _, ok := ctx.Deadline(); ok {
+		store.deadlines++
+	}
+	return store.LoadBatch(keys)
+}
+
+func TestClusterCounterFactory_BatchHeartbeatV2(t *testing.T) {
+	store := &batchStoreV2ForTest{batchStoreForTest: batchStoreForTest{values: make(map[string]CounterValue)}}
+	factory := NewFactory(&ClusterCounterFactoryOpts{Store: store, NodeID: "n1", StoreTimeout: time.Second})
+	factory.Stop()
+
+	counter, _ := factory.NewClusterCounter(&ClusterCounterOpts{Name: "test", ResetInterval: time.Hour})
+	counter.Add(1)
+	counter.lastLoadTime = counter.lastLoadTime.Add(-time.Hour)
+	store.deadlines = 0
+
+	factory.Heartbeat()
+	if store.storeCalls != 1 || store.loadCalls != 1 || store.deadlines != 2 || store.nodeID != "n1" {
+		t.Fatal("batch heartbeat should be bound by store timeout", store.storeCalls, store.loadCalls,
+			store.deadlines, store.nodeID)
+	}
+
+	// batches of stores without context are skipped once canceled, and fail transiently
+	adapter := NewBatchStoreV2(&batchStoreForTest{values: make(map[string]CounterValue)})
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if errs := adapter.StoreBatchV2(ctx, "n1", []*StoreItem{{}}); IsTransient(errs[0]) == false {
+		t.Fatal("canceled batch should be transient error", errs)
+	}
+}
@@ -0,0 +1,576 @@
+package tiered_store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/boostlearn/go-cluster-limiter/cluster_counter"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const TieredKeySep = "####"
+
+// separates counter's name and the region whose total is replicated into it
+const TieredRegionSep = "@"
+
+// name of keys marking that a region has replicated its deltas
+const TieredSyncName = "tiered_sync"
+const DefaultSyncIntervalSeconds = 2
+const DefaultIdleSyncRounds = 30
+
+// options for creating tiered store
+type TieredStoreOpts struct {
+	// region of this node
+	Region string
+	// store shared by nodes within this region
+	LocalStore cluster_counter.DataStoreI
+	// other regions' stores, keyed by region. local deltas are replicated into them,
+	// and their nodes replicate theirs into LocalStore
+	RemoteStores map[string]cluster_counter.DataStoreI
+	// interval of replicating deltas and refreshing remote regions' totals
+	SyncInterval time.Duration
+	// counters not loaded within IdleSyncRounds sync intervals stop being refreshed
+	IdleSyncRounds int
+	// source of time, should be the same as counters', default is cluster_counter.RealClock
+	Clock cluster_counter.Clock
+}
+
+// last known total of one remote region
+type RegionTotal struct {
+	Value cluster_counter.CounterValue
+	// last time the region replicated its deltas, zero if not within IdleSyncRounds sync intervals since start
+	UpdateTime time.Time
+}
+
+type tieredEntry struct {
+	key          cluster_counter.StoreKey
+	remote       map[string]cluster_counter.CounterValue
+	lastLoadTime time.Time
+}
+
+// store for multi-IDC deployments: deltas are written into the local region's store,
+// and replicated asynchronously into the other regions' stores as per-region totals,
+// so heartbeats never wait on cross-region calls and loads read the local region's store only
+type TieredStore struct {
+	mu           sync.RWMutex
+	region       string
+	local        cluster_counter.DataStoreI
+	localV2      cluster_counter.DataStoreV2I
+	localBatchV2 cluster_counter.BatchDataStoreV2I
+	remotes      map[string]cluster_counter.DataStoreI
+	entries      map[string]*tieredEntry
+	// deltas of this node not replicated yet, by remote region
+	pending map[string]map[string]*cluster_counter.StoreItem
+	// last replication of each remote region
+	syncTimes map[string]time.Time
+
+	syncInterval   time.Duration
+	idleSyncRounds int
+	clock          cluster_counter.Clock
+
+	ticker cluster_counter.Ticker
+	done   chan struct{}
+	wg     sync.WaitGroup
+}
+
+// build new tiered store and start replication
+func NewStore(opts *TieredStoreOpts) (*TieredStore, error) {
+	if opts == nil || opts.LocalStore == nil {
+		return nil, errors.New("local store cannot be nil")
+	}
+
+	if opts.SyncInterval == 0 {
+		opts.SyncInterval = DefaultSyncIntervalSeconds * time.Second
+	}
+
+	if opts.IdleSyncRounds <= 0 {
+		opts.IdleSyncRounds = DefaultIdleSyncRounds
+	}
+
+	clock := opts.Clock
+	if clock == nil || reflect.ValueOf(clock).IsNil() {
+		clock = cluster_counter.RealClock
+	}
+
+	remotes := make(map[string]cluster_counter.DataStoreI)
+	pending := make(map[string]map[string]*cluster_counter.StoreItem)
+	for region, store := range opts.RemoteStores {
+		if region == opts.Region {
+			return nil, fmt.Errorf("remote region is same as local region: %v", region)
+		}
+		if store != nil {
+			remotes[region] = store
+			pending[region] = make(map[string]*cluster_counter.StoreItem)
+		}
+	}
+
+	store := &TieredStore{
+		region:         opts.Region,
+		local:          opts.LocalStore,
+		localV2:        cluster_counter.NewStoreV2(opts.LocalStore),
+		localBatchV2:   cluster_counter.NewBatchStoreV2(opts.LocalStore),
+		remotes:        remotes,
+		entries:        make(map[string]*tieredEntry),
+		pending:        pending,
+		syncTimes:      make(map[string]time.Time),
+		syncInterval:   opts.SyncInterval,
+		idleSyncRounds: opts.IdleSyncRounds,
+		clock:          clock,
+		done:           make(chan struct{}),
+	}
+
+	store.ticker = clock.NewTicker(store.syncInterval)
+	store.wg.Add(1)
+	go store.replicate()
+	return store, nil
+}
+
+// stop replication, deltas not replicated yet are dropped
+func (store *TieredStore) Close() {
+	select {
+	case <-store.done:
+		return
+	default:
+	}
+
+	close(store.done)
+	store.ticker.Stop()
+	store.wg.Wait()
+}
+
+// store client's data into local region
+func (store *TieredStore) Store(name string, beginTime time.Time, endTime time.Time, lbs map[string]string,
+	value cluster_counter.CounterValue, force bool) error {
+	err := store.local.Store(name, beginTime, endTime, lbs, value, force)
+	if err == nil {
+		store.queue(&cluster_counter.StoreItem{
+			StoreKey: cluster_counter.StoreKey{Name: name, BeginTime: beginTime, EndTime: endTime, Labels: lbs},
+			Value:    value,
+			Force:    force,
+		})
+	}
+	return err
+}
+
+// store client's data into local region once for token, if the local store supports it
+func (store *TieredStore) StoreOnce(token string, name string, beginTime time.Time, endTime time.Time,
+	lbs map[string]string, value cluster_counter.CounterValue, force bool) error {
+	err := storeOnce(store.local, token, name, beginTime, endTime, lbs, value, force)
+	if err == nil {
+		store.queue(&cluster_counter.StoreItem{
+			StoreKey: cluster_counter.StoreKey{Name: name, BeginTime: beginTime, EndTime: endTime, Labels: lbs},
+			Value:    value,
+			Force:    force,
+			Token:    token,
+		})
+	}
+	return err
+}
+
+// load local region's data plus last known remote regions' totals
+func (store *TieredStore) Load(name string, beginTime time.Time, endTime time.Time, lbs map[string]string,
+) (cluster_counter.CounterValue, error) {
+	value, err := store.local.Load(name, beginTime, endTime, lbs)
+	if err != nil {
+		return value, err
+	}
+
+	return value.Add(store.remoteTotal(cluster_counter.StoreKey{
+		Name:      name,
+		BeginTime: beginTime,
+		EndTime:   endTime,
+		Labels:    lbs,
+	})), nil
+}
+
+// store with context into local region, keeping kinds of its errors
+func (store *TieredStore) StoreV2(ctx context.Context, nodeID string, item *cluster_counter.StoreItem) error {
+	err := store.localV2.StoreV2(ctx, nodeID, item)
+	if err == nil {
+		store.queue(item)
+	}
+	return err
+}
+
+// load with context local region's data plus last known remote regions' totals,
+// not found only if neither has data
+func (store *TieredStore) LoadV2(ctx context.Context, nodeID string, key *cluster_counter.StoreKey,
+) (cluster_counter.CounterValue, error) {
+	value, err := store.localV2.LoadV2(ctx, nodeID, key)
+	if err != nil && cluster_counter.IsNotFound(err) == false {
+		return value, err
+	}
+
+	remote := store.remoteTotal(*key)
+	if cluster_counter.IsNotFound(err) && remote == (cluster_counter.CounterValue{}) {
+		return value, err
+	}
+	return value.Add(remote), nil
+}
+
+// store several counters' data into local region
+func (store *TieredStore) StoreBatch(items []*cluster_counter.StoreItem) []error {
+	errs := storeBatch(store.local, items)
+	for i, item := range items {
+		if errs[i] == nil {
+			store.queue(item)
+		}
+	}
+	return errs
+}
+
+// load several counters' data, see Load
+func (store *TieredStore) LoadBatch(keys []*cluster_counter.StoreKey) ([]cluster_counter.CounterValue, []error) {
+	values, errs := loadBatch(store.local, keys)
+	for i, key := range keys {
+		if errs[i] == nil {
+			values[i] = values[i].Add(store.remoteTotal(*key))
+		}
+	}
+	return values, errs
+}
+
+// store several counters' data with context into local region, see StoreV2
+func (store *TieredStore) StoreBatchV2(ctx context.Context, nodeID string, items []*cluster_counter.StoreItem,
+) []error {
+	errs := store.localBatchV2.StoreBatchV2(ctx, nodeID, items)
+	for i, item := range items {
+		if errs[i] == nil {
+			store.queue(item)
+		}
+	}
+	return errs
+}
+
+// load several counters' data with context, see LoadV2
+func (store *TieredStore) LoadBatchV2(ctx context.Context, nodeID string, keys []*cluster_counter.StoreKey,
+) ([]cluster_counter.CounterValue, []error) {
+	values, errs := store.localBatchV2.LoadBatchV2(ctx, nodeID, keys)
+	for i, key := range keys {
+		if errs[i] != nil && cluster_counter.IsNotFound(errs[i]) == false {
+			continue
+		}
+
+		remote := store.remoteTotal(*key)
+		if cluster_counter.IsNotFound(errs[i]) && remote == (cluster_counter.CounterValue{}) {
+			continue
+		}
+		values[i], errs[i] = values[i].Add(remote), nil
+	}
+	return values, errs
+}
+
+// last known totals of remote regions with their update time
+func (store *TieredStore) RemoteTotals(name string, beginTime time.Time, endTime time.Time, lbs map[string]string,
+) map[string]RegionTotal {
+	key := generateTieredKey(name, beginTime, endTime, lbs)
+
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	totals := make(map[string]RegionTotal)
+	entry := store.entries[key]
+	for region := range store.remotes {
+		total := RegionTotal{UpdateTime: store.syncTimes[region]}
+		if entry != nil {
+			total.Value = entry.remote[region]
+		}
+		totals[region] = total
+	}
+	return totals
+}
+
+// windows of counters in local region's store, none if it cannot list keys.
+// remote regions' totals of counters are listed with names suffixed by TieredRegionSep and region
+func (store *TieredStore) ListKeys(namePrefix string) ([]*cluster_counter.StoreKey, error) {
+	if adminStore, ok := store.local.(cluster_counter.AdminDataStoreI); ok {
+		return adminStore.ListKeys(namePrefix)
+	}
+	return nil, nil
+}
+
+// remove counter's window and remote regions' totals of it from local region's store,
+// nodes of other regions delete their own
+func (store *TieredStore) Delete(key *cluster_counter.StoreKey) error {
+	tieredKey := generateTieredKey(key.Name, key.BeginTime, key.EndTime, key.Labels)
+	store.mu.Lock()
+	delete(store.entries, tieredKey)
+	for _, items := range store.pending {
+		for pendingKey, item := range items {
+			if generateTieredKey(item.Name, item.BeginTime, item.EndTime, item.Labels) == tieredKey {
+				delete(items, pendingKey)
+			}
+		}
+	}
+	store.mu.Unlock()
+
+	adminStore, ok := store.local.(cluster_counter.AdminDataStoreI)
+	if ok == false {
+		return nil
+	}
+	lastErr := adminStore.Delete(key)
+	for region := range store.remotes {
+		replicaKey := *key
+		replicaKey.Name = replicaName(key.Name, region)
+		if err := adminStore.Delete(&replicaKey); err != nil {
+			lastErr = err
+		}
+	}
+	return lastErr
+}
+
+// whether local region's store is unavailable
+func (store *TieredStore) Degraded() bool {
+	if degradedStore, ok := store.local.(cluster_counter.DegradedStoreI); ok {
+		return degradedStore.Degraded()
+	}
+	return false
+}
+
+// add delta stored locally to the deltas to replicate into each remote region.
+// deltas with tokens are kept apart so that remote stores apply them once
+func (store *TieredStore) queue(item *cluster_counter.StoreItem) {
+	key := generateTieredKey(item.Name, item.BeginTime, item.EndTime, item.Labels) + TieredKeySep + item.Token
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	for _, items := range store.pending {
+		if pendingItem, ok := items[key]; ok {
+			pendingItem.Value = pendingItem.Value.Add(item.Value)
+			continue
+		}
+		labels := make(map[string]string)
+		for k, v := range item.Labels {
+			labels[k] = v
+		}
+		pendingItem := *item
+		pendingItem.Labels = labels
+		items[key] = &pendingItem
+	}
+}
+
+// sum of remote totals, registers the counter for refreshing
+func (store *TieredStore) remoteTotal(storeKey cluster_counter.StoreKey) cluster_counter.CounterValue {
+	key := generateTieredKey(storeKey.Name, storeKey.BeginTime, storeKey.EndTime, storeKey.Labels)
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	entry, ok := store.entries[key]
+	if ok == false {
+		labels := make(map[string]string)
+		for k, v := range storeKey.Labels {
+			labels[k] = v
+		}
+		storeKey.Labels = labels
+		entry = &tieredEntry{key: storeKey, remote: make(map[string]cluster_counter.CounterValue)}
+		store.entries[key] = entry
+	}
+	entry.lastLoadTime = store.clock.Now()
+
+	var value cluster_counter.CounterValue
+	for _, total := range entry.remote {
+		value = value.Add(total)
+	}
+	return value
+}
+
+func (store *TieredStore) replicate() {
+	defer store.wg.Done()
+
+	for {
+		select {
+		case <-store.done:
+			return
+		case <-store.ticker.C():
+			store.Sync()
+		}
+	}
+}
+
+// refresh remote regions' totals of active counters from local region's store,
+// and replicate this node's deltas into each remote region's store
+func (store *TieredStore) Sync() {
+	timeNow := store.clock.Now()
+	store.refresh(timeNow)
+
+	// a slow or unavailable region delays no other region
+	var wg sync.WaitGroup
+	for region, remote := range store.remotes {
+		wg.Add(1)
+		go func(region string, remote cluster_counter.DataStoreI) {
+			defer wg.Done()
+			store.push(region, remote, timeNow)
+		}(region, remote)
+	}
+	wg.Wait()
+}
+
+// load totals replicated into local region's store by remote regions, and their last replication
+func (store *TieredStore) refresh(timeNow time.Time) {
+	var keys []*cluster_counter.StoreKey
+	var entryKeys []string
+	var regions []string
+
+	store.mu.Lock()
+	for key, entry := range store.entries {
+		if (entry.key.EndTime.After(time.Time{}) && timeNow.After(entry.key.EndTime)) ||
+			timeNow.After(entry.lastLoadTime.Add(store.syncInterval*time.Duration(store.idleSyncRounds))) {
+			delete(store.entries, key)
+			continue
+		}
+		for region := range store.remotes {
+			replicaKey := entry.key
+			replicaKey.Name = replicaName(entry.key.Name, region)
+			keys = append(keys, &replicaKey)
+			entryKeys = append(entryKeys, key)
+			regions = append(regions, region)
+		}
+	}
+	store.mu.Unlock()
+
+	// newest sync mark within idle rounds
+	syncKeys := make(map[string][]*cluster_counter.StoreKey)
+	for region := range store.remotes {
+		for i := 0; i <= store.idleSyncRounds; i++ {
+			beginTime := timeNow.Truncate(store.syncInterval).Add(-time.Duration(i) * store.syncInterval)
+			syncKeys[region] = append(syncKeys[region], store.syncKey(region, beginTime))
+		}
+	}
+
+	values, errs := loadBatch(store.local, keys)
+	syncTimes := make(map[string]time.Time)
+	for region, regionKeys := range syncKeys {
+		marks, markErrs := loadBatch(store.local, regionKeys)
+		for i, mark := range marks {
+			if markErrs[i] == nil && mark.Count > 0 {
+				syncTimes[region] = regionKeys[i].BeginTime
+				break
+			}
+		}
+	}
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	for i, key := range entryKeys {
+		if errs[i] != nil {
+			continue
+		}
+		if entry, ok := store.entries[key]; ok {
+			entry.remote[regions[i]] = values[i]
+		}
+	}
+	for region, syncTime := range syncTimes {
+		if syncTime.After(store.syncTimes[region]) {
+			store.syncTimes[region] = syncTime
+		}
+	}
+}
+
+// replicate pending deltas into remote region's store under names suffixed by this region,
+// and mark the sync if all of them are stored. failed deltas are kept for next sync
+func (store *TieredStore) push(region string, remote cluster_counter.DataStoreI, timeNow time.Time) {
+	store.mu.Lock()
+	pending := store.pending[region]
+	store.pending[region] = make(map[string]*cluster_counter.StoreItem)
+	store.mu.Unlock()
+
+	var keys []string
+	var items []*cluster_counter.StoreItem
+	for key, item := range pending {
+		replica := *item
+		replica.Name = replicaName(item.Name, store.region)
+		if len(item.Token) > 0 {
+			replica.Token = store.region + TieredRegionSep + item.Token
+		}
+		keys = append(keys, key)
+		items = append(items, &replica)
+	}
+
+	failed := false
+	errs := storeBatch(remote, items)
+	store.mu.Lock()
+	for i, err := range errs {
+		if err == nil {
+			continue
+		}
+		failed = true
+		item := pending[keys[i]]
+		if pendingItem, ok := store.pending[region][keys[i]]; ok {
+			pendingItem.Value = pendingItem.Value.Add(item.Value)
+		} else {
+			store.pending[region][keys[i]] = item
+		}
+	}
+	store.mu.Unlock()
+
+	if failed == false {
+		mark := store.syncKey(store.region, timeNow.Truncate(store.syncInterval))
+		_ = remote.Store(mark.Name, mark.BeginTime, mark.EndTime, nil, cluster_counter.CounterValue{Count: 1}, false)
+	}
+}
+
+// key marking that region synced within the interval beginning at beginTime, kept for idle rounds
+func (store *TieredStore) syncKey(region string, beginTime time.Time) *cluster_counter.StoreKey {
+	return &cluster_counter.StoreKey{
+		Name:      replicaName(TieredSyncName, region),
+		BeginTime: beginTime,
+		EndTime:   beginTime.Add(store.syncInterval * time.Duration(store.idleSyncRounds+1)),
+	}
+}
+
+// name of counter's total replicated from region
+func replicaName(name string, region string) string {
+	return name + TieredRegionSep + region
+}
+
+func storeOnce(store cluster_counter.DataStoreI, token string, name string, beginTime time.Time,
+	endTime time.Time, lbs map[string]string, value cluster_counter.CounterValue, force bool) error {
+	if idempotentStore, ok := store.(cluster_counter.IdempotentDataStoreI); ok && len(token) > 0 {
+		return idempotentStore.StoreOnce(token, name, beginTime, endTime, lbs, value, force)
+	}
+	return store.Store(name, beginTime, endTime, lbs, value, force)
+}
+
+func storeBatch(store cluster_counter.DataStoreI, items []*cluster_counter.StoreItem) []error {
+	if batchStore, ok := store.(cluster_counter.BatchDataStoreI); ok {
+		return batchStore.StoreBatch(items)
+	}
+
+	errs := make([]error, len(items))
+	for i, item := range items {
+		errs[i] = storeOnce(store, item.Token, item.Name, item.BeginTime, item.EndTime, item.Labels, item.Value,
+			item.Force)
+	}
+	return errs
+}
+
+func loadBatch(store cluster_counter.DataStoreI, keys []*cluster_counter.StoreKey,
+) ([]cluster_counter.CounterValue, []error) {
+	if batchStore, ok := store.(cluster_counter.BatchDataStoreI); ok {
+		return batchStore.LoadBatch(keys)
+	}
+
+	values := make([]cluster_counter.CounterValue, len(keys))
+	errs := make([]error, len(keys))
+	for i, key := range keys {
+		values[i], errs[i] = store.Load(key.Name, key.BeginTime, key.EndTime, key.Labels)
+	}
+	return values, errs
+}
+
+func generateTieredKey(name string, beginTime time.Time, endTime time.Time, lbs map[string]string) string {
+	var labels []string
+	for k, v := range lbs {
+		labels = append(labels, strconv.Quote(k)+"="+strconv.Quote(v))
+	}
+	sort.Stable(sort.StringSlice(labels))
+	return fmt.Sprintf("%v%v%v_%v%v%v", name, TieredKeySep, beginTime.UnixNano(), endTime.UnixNano(),
+		TieredKeySep, strings.Join(labels, TieredKeySep))
+}
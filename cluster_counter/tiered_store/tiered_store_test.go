@@ -0,0 +1,91 @@
+package tiered_store
+
+import (
+	"github.com/boostlearn/go-cluster-limiter/cluster_counter"
+	"github.com/boostlearn/go-cluster-limiter/cluster_counter/clocktest"
+	"github.com/boostlearn/go-cluster-limiter/cluster_counter/memory_store"
+	"testing"
+	"time"
+)
+
+func TestTieredStore_StoreAndLoad(t *testing.T) {
+	clock := clocktest.NewFakeClock(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	east := memory_store.NewStoreWithClock(clock)
+	west := memory_store.NewStoreWithClock(clock)
+	north := memory_store.NewStoreWithClock(clock)
+
+	eastStore, err := NewStore(&TieredStoreOpts{
+		Region:       "east",
+		LocalStore:   east,
+		RemoteStores: map[string]cluster_counter.DataStoreI{"west": west, "north": north},
+		SyncInterval: time.Hour,
+		Clock:        clock,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer eastStore.Close()
+
+	westStore, _ := NewStore(&TieredStoreOpts{
+		Region:       "west",
+		LocalStore:   west,
+		RemoteStores: map[string]cluster_counter.DataStoreI{"east": east},
+		SyncInterval: time.Hour,
+		Clock:        clock,
+	})
+	defer westStore.Close()
+
+	beginTime := clock.Now()
+	endTime := beginTime.Add(24 * time.Hour)
+	_ = eastStore.Store("test", beginTime, endTime, nil, cluster_counter.CounterValue{Sum: 1, Count: 1}, false)
+	_ = westStore.Store("test", beginTime, endTime, nil, cluster_counter.CounterValue{Sum: 2, Count: 1}, false)
+
+	v, _ := eastStore.Load("test", beginTime, endTime, nil)
+	if v.Sum != 1 {
+		t.Fatal("remote total should not be known before sync", v)
+	}
+
+	// west replicates its delta into east, east refreshes it from its own store
+	clock.Advance(time.Minute)
+	westStore.Sync()
+	eastStore.Sync()
+	v, _ = eastStore.Load("test", beginTime, endTime, nil)
+	if v.Sum != 3 || v.Count != 2 {
+		t.Fatal("load should include remote total", v)
+	}
+
+	totals := eastStore.RemoteTotals("test", beginTime, endTime, nil)
+	if totals["west"].Value.Sum != 2 || totals["west"].UpdateTime.Equal(beginTime) == false {
+		t.Fatal("remote total error", totals)
+	}
+	if totals["north"].UpdateTime.IsZero() == false {
+		t.Fatal("region never synced should have no update time", totals)
+	}
+
+	v, _ = east.Load("test", beginTime, endTime, nil)
+	if v.Sum != 1 {
+		t.Fatal("remote totals should not be written into local counter's key", v)
+	}
+	v, _ = north.Load("test"+TieredRegionSep+"east", beginTime, endTime, nil)
+	if v.Sum != 1 {
+		t.Fatal("local delta should be replicated into every remote region", v)
+	}
+
+	// west's update time stays while it does not sync
+	clock.Advance(3 * time.Hour)
+	_ = westStore.Store("test", beginTime, endTime, nil, cluster_counter.CounterValue{Sum: 2, Count: 1}, false)
+	eastStore.Sync()
+	totals = eastStore.RemoteTotals("test", beginTime, endTime, nil)
+	if totals["west"].Value.Sum != 2 || totals["west"].UpdateTime.Equal(beginTime) == false {
+		t.Fatal("remote total should be stale", totals)
+	}
+
+	// deltas are replicated once
+	westStore.Sync()
+	westStore.Sync()
+	eastStore.Sync()
+	totals = eastStore.RemoteTotals("test", beginTime, endTime, nil)
+	if totals["west"].Value.Sum != 4 || totals["west"].UpdateTime.Equal(beginTime.Add(3*time.Hour)) == false {
+		t.Fatal("remote total should be updated", totals)
+	}
+}
@@ -0,0 +1,175 @@
+package cluster_limiter
+
+import (
+	"sync"
+	"time"
+)
+
+const DefaultRewardDelayBuckets = 60
+
+// pass taken by TakeWithID waiting for its reward
+type passRecord struct {
+	time   time.Time
+	bucket *passBucket
+}
+
+// passes within one burst interval and rewards attributed to them
+type passBucket struct {
+	beginTime time.Time
+	passes    float64
+	rewards   float64
+}
+
+// attribution of delayed rewards to passes within a window, and the learned distribution of reward delay
+type attribution struct {
+	mu             sync.Mutex
+	window         time.Duration
+	bucketInterval time.Duration
+
+	pending map[string]*passRecord
+	buckets []*passBucket
+
+	delayCounts []float64
+	delayTotal  float64
+}
+
+func newAttribution(window time.Duration, bucketInterval time.Duration) *attribution {
+	if bucketInterval <= 0 || bucketInterval > window {
+		bucketInterval = window
+	}
+	return &attribution{
+		window:         window,
+		bucketInterval: bucketInterval,
+		pending:        make(map[string]*passRecord),
+		delayCounts:    make([]float64, DefaultRewardDelayBuckets),
+	}
+}
+
+// record pass of id
+func (attr *attribution) pass(id string, v float64, timeNow time.Time) {
+	attr.mu.Lock()
+	defer attr.mu.Unlock()
+
+	var bucket *passBucket
+	if len(attr.buckets) > 0 {
+		bucket = attr.buckets[len(attr.buckets)-1]
+	}
+	if bucket == nil || timeNow.Before(bucket.beginTime.Add(attr.bucketInterval)) == false {
+		bucket = &passBucket{beginTime: timeNow.Truncate(attr.bucketInterval)}
+		attr.buckets = append(attr.buckets, bucket)
+	}
+	bucket.passes += v
+	attr.pending[id] = &passRecord{time: timeNow, bucket: bucket}
+}
+
+// find pass of id and learn reward's delay, false if id is unknown or out of window
+// one pass may get several rewards until it is out of window
+func (attr *attribution) reward(id string, v float64, timeNow time.Time) (time.Time, bool) {
+	attr.mu.Lock()
+	defer attr.mu.Unlock()
+
+	record, ok := attr.pending[id]
+	if ok == false {
+		return time.Time{}, false
+	}
+
+	delay := timeNow.Sub(record.time)
+	if delay > attr.window {
+		delete(attr.pending, id)
+		return time.Time{}, false
+	}
+
+	record.bucket.rewards += v
+	pos := int(int64(delay) * int64(len(attr.delayCounts)) / int64(attr.window))
+	if pos >= len(attr.delayCounts) {
+		pos = len(attr.delayCounts) - 1
+	}
+	attr.delayCounts[pos] += v
+	attr.delayTotal += v
+	return record.time, true
+}
+
+// drop passes out of window
+func (attr *attribution) expire(timeNow time.Time) {
+	attr.mu.Lock()
+	defer attr.mu.Unlock()
+
+	expireTime := timeNow.Add(-attr.window)
+	for id, record := range attr.pending {
+		if record.time.Before(expireTime) {
+			delete(attr.pending, id)
+		}
+	}
+
+	pos := 0
+	for pos < len(attr.buckets) && attr.buckets[pos].beginTime.Add(attr.bucketInterval).Before(expireTime) {
+		pos++
+	}
+	attr.buckets = append([]*passBucket{}, attr.buckets[pos:]...)
+}
+
+// proportion of rewards arrived within delay, 1 if no reward is observed
+func (attr *attribution) delayProportion(delay time.Duration) float64 {
+	if attr.delayTotal <= 0 || delay >= attr.window {
+		return 1.0
+	}
+	if delay <= 0 {
+		return 0.0
+	}
+
+	width := float64(attr.window) / float64(len(attr.delayCounts))
+	pos := float64(delay) / width
+	var arrived float64
+	for i := 0; i < int(pos); i++ {
+		arrived += attr.delayCounts[i]
+	}
+	arrived += attr.delayCounts[int(pos)] * (pos - float64(int(pos)))
+	return arrived / attr.delayTotal
+}
+
+// rewards per pass within window, passes whose rewards are still in flight are discounted
+// by the delay distribution, false if passes are not enough
+func (attr *attribution) rewardRate(timeNow time.Time, minPasses float64) (float64, bool) {
+	attr.mu.Lock()
+	defer attr.mu.Unlock()
+
+	var passes, expectedPasses, rewards float64
+	for _, bucket := range attr.buckets {
+		age := timeNow.Sub(bucket.beginTime.Add(attr.bucketInterval / 2))
+		passes += bucket.passes
+		expectedPasses += bucket.passes * attr.delayProportion(age)
+		rewards += bucket.rewards
+	}
+	if passes < minPasses || expectedPasses <= 0 {
+		return 0, false
+	}
+	return rewards / expectedPasses, true
+}
+
+// delay within which proportion q of rewards arrive
+func (attr *attribution) delayQuantile(q float64) time.Duration {
+	attr.mu.Lock()
+	defer attr.mu.Unlock()
+
+	if attr.delayTotal <= 0 {
+		return 0
+	}
+
+	width := float64(attr.window) / float64(len(attr.delayCounts))
+	var arrived float64
+	for i, count := range attr.delayCounts {
+		if count > 0 && arrived+count >= q*attr.delayTotal {
+			return time.Duration(width * (float64(i) + (q*attr.delayTotal-arrived)/count))
+		}
+		arrived += count
+	}
+	return attr.window
+}
+
+// number of passes waiting for rewards
+func (attr *attribution) pendingSize() int {
+	attr.mu.Lock()
+	defer attr.mu.Unlock()
+
+	return len(attr.pending)
+}
@@ -0,0 +1,110 @@
+package cluster_limiter
+
+import (
+	"fmt"
+	"github.com/boostlearn/go-cluster-limiter/cluster_counter/clocktest"
+	"github.com/boostlearn/go-cluster-limiter/cluster_counter/memory_store"
+	"testing"
+	"time"
+)
+
+func TestAttribution_RewardRate(t *testing.T) {
+	timeBegin := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	attr := newAttribution(10*time.Minute, 5*time.Second)
+
+	for i := 0; i < 100; i++ {
+		attr.pass(fmt.Sprint("a", i), 1, timeBegin)
+	}
+	for i := 0; i < 50; i++ {
+		attr.reward(fmt.Sprint("a", i), 1, timeBegin.Add(5*time.Minute))
+	}
+	if delay := attr.delayQuantile(0.5); delay < 4*time.Minute || delay > 6*time.Minute {
+		t.Fatal("delay distribution error", delay)
+	}
+
+	// rewards of passes younger than the delay have not arrived yet
+	for i := 0; i < 100; i++ {
+		attr.pass(fmt.Sprint("b", i), 1, timeBegin.Add(6*time.Minute))
+	}
+	rate, ok := attr.rewardRate(timeBegin.Add(6*time.Minute+time.Second), 100)
+	if ok == false || rate < 0.49 || rate > 0.51 {
+		t.Fatal("reward rate should discount passes in flight", rate)
+	}
+
+	attr.expire(timeBegin.Add(20 * time.Minute))
+	if attr.pendingSize() != 0 || len(attr.buckets) != 0 {
+		t.Fatal("passes out of window should be dropped")
+	}
+}
+
+func TestClusterLimiter_RewardFor(t *testing.T) {
+	beginTime := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := clocktest.NewFakeClock(beginTime.Add(59 * time.Minute))
+	recorder := &periodRecorderForTest{}
+	factory := NewFactory(&ClusterLimiterFactoryOpts{
+		Name: "test", Store: memory_store.NewStoreWithClock(clock), Clock: clock, PeriodRecorder: recorder})
+	factory.Stop()
+
+	limiter, _ := factory.NewClusterLimiter(&ClusterLimiterOpts{Name: "p", RewardTarget: 1000,
+		PeriodInterval: time.Hour, InitPassRate: 1, AttributionWindow: 10 * time.Minute})
+	factory.Heartbeat()
+	if limiter.TakeWithID("a", 1) == false {
+		t.Fatal("request should be passed")
+	}
+
+	clock.Advance(2 * time.Minute)
+	factory.Heartbeat()
+	if limiter.RewardFor("a", 1) == false {
+		t.Fatal("reward should be attributed")
+	}
+	if v, _ := limiter.RewardCounter.LocalValue(0); v.Sum != 0 {
+		t.Fatal("late reward should not be counted in current period", v)
+	}
+	if len(recorder.records) != 0 {
+		t.Fatal("period should be settled after attribution window")
+	}
+
+	if limiter.RewardFor("b", 1) {
+		t.Fatal("unknown pass should not be attributed")
+	}
+	if v, _ := limiter.RewardCounter.LocalValue(0); v.Sum != 1 {
+		t.Fatal("unattributed reward should be counted in current period", v)
+	}
+
+	clock.Advance(10 * time.Minute)
+	factory.Heartbeat()
+	if v, err := limiter.loadPeriodReward(beginTime, beginTime.Add(time.Hour)); err != nil || v.Sum != 1 {
+		t.Fatal("late reward should be stored into period of pass", v, err)
+	}
+	if len(recorder.records) != 1 || recorder.records[0].Reward != 1 {
+		t.Fatal("late reward should be counted in record of period of pass", recorder.records)
+	}
+}
+
+func TestClusterLimiter_RewardForAfterEnd(t *testing.T) {
+	beginTime := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := clocktest.NewFakeClock(beginTime.Add(59 * time.Minute))
+	factory := NewFactory(&ClusterLimiterFactoryOpts{
+		Name: "test", Store: memory_store.NewStoreWithClock(clock), Clock: clock})
+	factory.Stop()
+
+	limiter, _ := factory.NewClusterLimiter(&ClusterLimiterOpts{Name: "l", RewardTarget: 1000,
+		BeginTime: beginTime, EndTime: beginTime.Add(time.Hour), InitPassRate: 1, AttributionWindow: 10 * time.Minute})
+	factory.Heartbeat()
+	limiter.TakeWithID("a", 1)
+
+	clock.Advance(5 * time.Minute)
+	factory.Heartbeat()
+	if factory.GetClusterLimiter("l") == nil || limiter.RewardFor("a", 1) == false {
+		t.Fatal("limiter should be kept within attribution window after end")
+	}
+	if v, _ := limiter.RewardCounter.LocalValue(0); v.Sum != 1 {
+		t.Fatal("reward after end should be counted", v)
+	}
+
+	clock.Advance(10 * time.Minute)
+	factory.Heartbeat()
+	if factory.GetClusterLimiter("l") != nil {
+		t.Fatal("limiter should expire after attribution window")
+	}
+}
@@ -19,23 +19,59 @@ type ClusterLimiter struct {
 	factory *ClusterLimiterFactory
 
 	name     string
+	lbs      []string
 	initTime time.Time
 
 	beginTime       time.Time
 	endTime         time.Time
 	completionTime  time.Time
 	periodInterval  time.Duration
+	schedule        *cluster_counter.Schedule
 	reserveInterval time.Duration
 
 	rewardTarget        float64
 	discardPreviousData bool
 
+	// target set by options or SetRewardTarget, rewardTarget adds the share of parent's unused budget
+	baseRewardTarget float64
+	parent           *ClusterLimiter
+	children         sync.Map
+
+	// moved into current period from previous ones, and whether it is settled by any node
+	rolloverTarget float64
+	rolloverLoaded bool
+	// period for which this node stored its open mark, zero before the first one after start
+	openedBeginTime time.Time
+	// whether result of non-periodic limiter is recorded
+	recorded bool
+
 	periodRewardBase cluster_counter.CounterValue
 
 	RequestCounter *cluster_counter.ClusterCounter
 	PassCounter    *cluster_counter.ClusterCounter
 	RewardCounter  *cluster_counter.ClusterCounter
 
+	// labels of limiter in vector, nil if not in vector
+	labels map[string]string
+	// local rewards by period not stored yet, and local reward counted into them so far
+	rewardMu            sync.Mutex
+	pendingRewards      map[int64]*periodReward
+	collectedReward     cluster_counter.CounterValue
+	lastRewardStoreTime time.Time
+	// periods closed but not settled before their attribution window passes
+	unsettled []*PeriodRecord
+
+	attributionWindow time.Duration
+	attribution       *attribution
+
+	pacing              PacingCurveI
+	prevObservedRequest cluster_counter.CounterValue
+
+	trafficProfile     *TrafficProfile
+	profileRequest     cluster_counter.CounterValue
+	profileCycle       time.Time
+	lastProfileTryTime time.Time
+
 	lastIdealPassRateTime   time.Time
 	lastRewardPassRateTime  time.Time
 	lastWorkingPassRateTime time.Time
@@ -78,7 +114,7 @@ func (limiter *ClusterLimiter) Initialize() {
 	limiter.mu.Lock()
 	defer limiter.mu.Unlock()
 
-	timeNow := time.Now()
+	timeNow := limiter.now()
 	limiter.initTime = timeNow
 	limiter.expired = false
 
@@ -100,9 +136,8 @@ func (limiter *ClusterLimiter) Initialize() {
 		limiter.idealPassRate = DefaultInitPassRate
 	}
 
-	if limiter.periodInterval > 0 {
-		limiter.beginTime = timeNow.Truncate(limiter.periodInterval)
-		limiter.endTime = limiter.beginTime.Add(limiter.periodInterval)
+	if cluster_counter.Periodic(limiter.periodInterval, limiter.schedule) {
+		limiter.beginTime, limiter.endTime = limiter.period(timeNow)
 	}
 	if limiter.reserveInterval > 0 && limiter.endTime.After(limiter.beginTime.Add(limiter.reserveInterval)) {
 		limiter.completionTime = limiter.endTime.Add(-limiter.reserveInterval)
@@ -111,20 +146,121 @@ func (limiter *ClusterLimiter) Initialize() {
 	}
 
 	limiter.periodRewardBase, _ = limiter.RewardCounter.ClusterValue(0)
+
+	if passRate, ok := limiter.profilePassRate(); ok {
+		limiter.idealPassRate = passRate
+	}
+}
+
+// pass rate reaching reward target with requests expected by traffic profile
+func (limiter *ClusterLimiter) profilePassRate() (float64, bool) {
+	if limiter.trafficProfile == nil || limiter.rewardTarget == 0 || limiter.idealRewardRate <= 0 {
+		return 0, false
+	}
+
+	requests := limiter.trafficProfile.Requests(limiter.beginTime, limiter.completionTime)
+	if requests <= 0 {
+		return 0, false
+	}
+
+	passRate := limiter.rewardTarget / requests / limiter.idealRewardRate
+	if passRate > 1.0 {
+		passRate = 1.0
+	}
+	return passRate, true
+}
+
+// store requests of finished slots, and rebuild traffic profile from store once a cycle,
+// failure of rebuilding is retried after a slot
+func (limiter *ClusterLimiter) syncTrafficProfile() {
+	if limiter.trafficProfile == nil {
+		return
+	}
+
+	counterFactory := limiter.factory.counterFactory
+	name := limiter.factory.name + limiter.name + ":profile"
+	retention := limiter.trafficProfile.retention()
+	timeNow := limiter.now()
+
+	limiter.mu.Lock()
+	requests, _ := limiter.RequestCounter.LocalValue(0)
+	observed := requests.Sub(limiter.profileRequest)
+	limiter.profileRequest = requests
+	limiter.mu.Unlock()
+	limiter.trafficProfile.observe(timeNow, observed)
+
+	for _, slot := range limiter.trafficProfile.finishedSlots(timeNow) {
+		_ = counterFactory.StoreHistory(name, nil, slot.beginTime, retention, slot.value)
+	}
+
+	limiter.mu.Lock()
+	cycleBegin := limiter.trafficProfile.cycleBegin(timeNow)
+	if cycleBegin.Equal(limiter.profileCycle) ||
+		timeNow.Before(limiter.lastProfileTryTime.Add(limiter.trafficProfile.opts.Slot)) {
+		limiter.mu.Unlock()
+		return
+	}
+	limiter.lastProfileTryTime = timeNow
+	limiter.mu.Unlock()
+
+	err := limiter.trafficProfile.build(timeNow, func(beginTime time.Time, interval time.Duration, n int) ([]float64, error) {
+		values, err := counterFactory.LoadHistory(name, nil, beginTime, interval, retention, n)
+		if err != nil {
+			return nil, err
+		}
+		requests := make([]float64, len(values))
+		for i, v := range values {
+			requests[i] = v.Sum
+		}
+		return requests, nil
+	})
+
+	if err == nil {
+		limiter.mu.Lock()
+		limiter.profileCycle = cycleBegin
+		limiter.mu.Unlock()
+	}
+}
+
+// pacing curve of limiter, a clone of options' curve if it has state
+func (limiter *ClusterLimiter) PacingCurve() PacingCurveI {
+	return limiter.pacing
+}
+
+// traffic profile learned from store, nil if not set
+func (limiter *ClusterLimiter) TrafficProfile() *TrafficProfile {
+	return limiter.trafficProfile
 }
 
 // request passed
 func (limiter *ClusterLimiter) Take(v float64) bool {
+	if limiter.admit(v) == false {
+		return false
+	}
+
+	if limiter.parent != nil && limiter.parent.Take(v) == false {
+		return false
+	}
+
+	limiter.PassCounter.Add(v)
+	return true
+}
+
+func (limiter *ClusterLimiter) admit(v float64) bool {
 	limiter.mu.RLock()
 	defer limiter.mu.RUnlock()
 
-	timeNow := time.Now()
+	timeNow := limiter.now()
 	if timeNow.Before(limiter.beginTime) || timeNow.After(limiter.endTime) {
 		return false
 	}
 
+	if limiter.schedule != nil && limiter.schedule.Active(timeNow) == false {
+		return false
+	}
+
 	limiter.RequestCounter.Add(v)
-	if rand.Float64() > limiter.workingPassRate {
+	if limiter.randFloat64() > limiter.workingPassRate {
 		return false
 	}
 
@@ -133,17 +269,23 @@ func (limiter *ClusterLimiter) Take(v float64) bool {
 	if clusterCur+v > limiter.getIdealReward(timeNow) {
 		return false
 	}
-
-	limiter.PassCounter.Add(v)
 	return true
 }
 
-// reward feedback
+// reward feedback, added to all ancestors
 func (limiter *ClusterLimiter) Reward(v float64) {
+	limiter.reward(v)
+
+	if limiter.parent != nil {
+		limiter.parent.Reward(v)
+	}
+}
+
+func (limiter *ClusterLimiter) reward(v float64) {
 	limiter.mu.RLock()
 	defer limiter.mu.RUnlock()
 
-	timeNow := time.Now()
+	timeNow := limiter.now()
 	if timeNow.Before(limiter.beginTime) || timeNow.After(limiter.endTime) {
 		return
 	}
@@ -151,16 +293,85 @@ func (limiter *ClusterLimiter) Reward(v float64) {
 	limiter.RewardCounter.Add(v)
 }
 
+// request passed, its rewards can be attributed by RewardFor with the same id
+func (limiter *ClusterLimiter) TakeWithID(id string, v float64) bool {
+	if limiter.Take(v) == false {
+		return false
+	}
+
+	if limiter.attribution != nil {
+		limiter.attribution.pass(id, v, limiter.now())
+	}
+	return true
+}
+
+// reward feedback of the pass taken by TakeWithID, credited to the period of the pass.
+// passes are known only to the process which took them.
+// false if the pass is unknown or out of attribution window, then it is added as Reward
+func (limiter *ClusterLimiter) RewardFor(id string, v float64) bool {
+	if limiter.attribution == nil {
+		limiter.Reward(v)
+		return false
+	}
+
+	passTime, ok := limiter.attribution.reward(id, v, limiter.now())
+	if ok == false {
+		limiter.Reward(v)
+		return false
+	}
+
+	limiter.creditReward(v, passTime)
+	return true
+}
+
+// add reward of pass at passTime to the period of the pass, and to ancestors
+func (limiter *ClusterLimiter) creditReward(v float64, passTime time.Time) {
+	limiter.mu.RLock()
+	timeNow := limiter.now()
+	late := passTime.Before(limiter.beginTime)
+	valid := timeNow.Before(limiter.beginTime) == false &&
+		timeNow.After(limiter.endTime.Add(limiter.attributionWindow)) == false
+	limiter.mu.RUnlock()
+
+	if valid && late && cluster_counter.Periodic(limiter.periodInterval, limiter.schedule) {
+		beginTime, endTime := limiter.period(passTime)
+		limiter.addPeriodReward(beginTime, endTime, cluster_counter.CounterValue{Sum: v, Count: 1})
+	} else if valid && late == false {
+		limiter.RewardCounter.Add(v)
+	}
+
+	if limiter.parent != nil {
+		limiter.parent.creditReward(v, passTime)
+	}
+}
+
 // request passed with score
 func (limiter *ClusterLimiter) TakeWithScore(v float64, score float64) bool {
+	if limiter.admitWithScore(v, score) == false {
+		return false
+	}
+
+	if limiter.parent != nil && limiter.parent.TakeWithScore(v, score) == false {
+		return false
+	}
+
+	limiter.PassCounter.Add(v)
+	return true
+}
+
+func (limiter *ClusterLimiter) admitWithScore(v float64, score float64) bool {
 	limiter.mu.RLock()
 	defer limiter.mu.RUnlock()
 
-	timeNow := time.Now()
+	timeNow := limiter.now()
 	if timeNow.Before(limiter.beginTime) || timeNow.After(limiter.endTime) {
 		return false
 	}
 
+	if limiter.schedule != nil && limiter.schedule.Active(timeNow) == false {
+		return false
+	}
+
 	if limiter.scoreSamplesMax > 0 {
 		limiter.scoreSamples[limiter.scoreSamplesPos%limiter.scoreSamplesMax] = score
 		limiter.scoreSamplesPos++
@@ -169,7 +380,7 @@ func (limiter *ClusterLimiter) TakeWithScore(v float64, score float64) bool {
 	limiter.RequestCounter.Add(v)
 
 	if limiter.scoreCutReady == false || limiter.scoreSamplesMax == 0 {
-		if rand.Float64() > limiter.workingPassRate {
+		if limiter.randFloat64() > limiter.workingPassRate {
 			return false
 		}
 	} else {
@@ -183,8 +394,6 @@ func (limiter *ClusterLimiter) TakeWithScore(v float64, score float64) bool {
 	if clusterCur+v > limiter.getIdealReward(timeNow) {
 		return false
 	}
-
-	limiter.PassCounter.Add(v)
 	return true
 }
 
@@ -212,7 +421,8 @@ func (limiter *ClusterLimiter) SetRewardTarget(target float64) {
 	limiter.mu.Lock()
 	defer limiter.mu.Unlock()
 
-	limiter.rewardTarget = target
+	limiter.baseRewardTarget = target
+	limiter.rewardTarget = limiter.periodTarget()
 }
 
 func (limiter *ClusterLimiter) GetRewardTarget() float64 {
@@ -222,16 +432,110 @@ func (limiter *ClusterLimiter) GetRewardTarget() float64 {
 	return limiter.rewardTarget
 }
 
+// parent limiter, nil if not set
+func (limiter *ClusterLimiter) Parent() *ClusterLimiter {
+	return limiter.parent
+}
+
+// reward of current period
+func (limiter *ClusterLimiter) periodReward() float64 {
+	limiter.mu.RLock()
+	defer limiter.mu.RUnlock()
+
+	cur, _ := limiter.RewardCounter.ClusterValue(0)
+	return cur.Sum - limiter.periodRewardBase.Sum
+}
+
+// whether any child is attached
+func (limiter *ClusterLimiter) hasChildren() bool {
+	found := false
+	limiter.children.Range(func(k interface{}, v interface{}) bool {
+		found = true
+		return false
+	})
+	return found
+}
+
+// target behind ideal reward so far, which is not spent by own traffic in time
+func (limiter *ClusterLimiter) unspentTarget() float64 {
+	limiter.mu.RLock()
+	defer limiter.mu.RUnlock()
+
+	timeNow := limiter.now()
+	if timeNow.Before(limiter.beginTime) {
+		return 0
+	}
+	cur, _ := limiter.RewardCounter.ClusterValue(0)
+	unspent := limiter.periodTarget()*(limiter.progress(timeNow)-limiter.progressBase()) - (cur.Sum - limiter.periodRewardBase.Sum)
+	if unspent < 0 {
+		return 0
+	}
+	return unspent
+}
+
+// share budget neither allocated to children nor used by own traffic among children with weight,
+// and move target a child has not spent in time to its siblings
+func (limiter *ClusterLimiter) redistributeBudget() {
+	var children []*ClusterLimiter
+	var unspent []float64
+	var totalWeight, childrenTarget, childrenReward float64
+	limiter.children.Range(func(k interface{}, v interface{}) bool {
+		if child, ok := v.(*ClusterLimiter); ok {
+			children = append(children, child)
+			child.mu.RLock()
+			childrenTarget += child.periodTarget()
+			child.mu.RUnlock()
+			childrenReward += child.periodReward()
+			unspent = append(unspent, child.unspentTarget())
+			totalWeight += child.Options.Weight
+		}
+		return true
+	})
+	if totalWeight <= 0 {
+		return
+	}
+
+	ownReward := limiter.periodReward() - childrenReward
+	if ownReward < 0 {
+		ownReward = 0
+	}
+	unused := limiter.GetRewardTarget() - ownReward - childrenTarget
+	if unused < 0 {
+		unused = 0
+	}
+
+	shares := make([]float64, len(children))
+	for i, child := range children {
+		shares[i] += unused * child.Options.Weight / totalWeight
+		siblingsWeight := totalWeight - child.Options.Weight
+		if unspent[i] <= 0 || siblingsWeight <= 0 {
+			continue
+		}
+		shares[i] -= unspent[i]
+		for j, sibling := range children {
+			if j != i {
+				shares[j] += unspent[i] * sibling.Options.Weight / siblingsWeight
+			}
+		}
+	}
+
+	for i, child := range children {
+		child.mu.Lock()
+		child.rewardTarget = child.periodTarget() + shares[i]
+		child.mu.Unlock()
+	}
+}
+
 //
 func (limiter *ClusterLimiter) IdealReward() float64 {
 	limiter.mu.RLock()
 	defer limiter.mu.RUnlock()
 
-	return limiter.getIdealReward(time.Now())
+	return limiter.getIdealReward(limiter.now())
 }
 
 func (limiter *ClusterLimiter) getIdealReward(t time.Time) float64 {
-	timeNow := time.Now()
+	timeNow := limiter.now()
 	if timeNow.Before(limiter.beginTime) || !limiter.beginTime.Before(limiter.endTime) {
 		return 0
 	}
@@ -240,32 +544,51 @@ func (limiter *ClusterLimiter) getIdealReward(t time.Time) float64 {
 		return limiter.rewardTarget
 	}
 
+	idealReward := limiter.rewardTarget * (limiter.progress(t) - limiter.progressBase())
+	if idealReward > limiter.rewardTarget {
+		idealReward = limiter.rewardTarget
+	}
+	if idealReward < 0 {
+		idealReward = 0
+	}
+	return idealReward
+}
+
+// share of reward target to be reached at t by pacing curve
+func (limiter *ClusterLimiter) progress(t time.Time) float64 {
+	if limiter.pacing == nil {
+		return LinearPacing{}.Progress(limiter.beginTime, limiter.completionTime, t)
+	}
+	return limiter.pacing.Progress(limiter.beginTime, limiter.completionTime, t)
+}
+
+// progress at init time if previous data is discarded
+func (limiter *ClusterLimiter) progressBase() float64 {
 	if limiter.discardPreviousData && limiter.initTime.Before(limiter.endTime) &&
 		limiter.initTime.After(limiter.beginTime) {
-		targetTotalReward := limiter.rewardTarget
-		idealReward := (targetTotalReward) *
-			float64(t.UnixNano()-limiter.initTime.UnixNano()) /
-			float64(limiter.completionTime.UnixNano()-limiter.beginTime.UnixNano())
-		if idealReward > limiter.rewardTarget {
-			idealReward = limiter.rewardTarget
-		}
-		if idealReward < 0 {
-			idealReward = 0
-		}
-		return idealReward
-	} else {
-		targetTotalReward := limiter.rewardTarget
-		idealReward := targetTotalReward *
-			float64(t.UnixNano()-limiter.beginTime.UnixNano()) /
-			float64(limiter.completionTime.UnixNano()-limiter.beginTime.UnixNano())
-		if idealReward > limiter.rewardTarget {
-			idealReward = limiter.rewardTarget
-		}
-		if idealReward < 0 {
-			idealReward = 0
+		return limiter.progress(limiter.initTime)
+	}
+	return 0
+}
+
+// time when pacing curve reaches progress p, linear beyond [beginTime, completionTime]
+func (limiter *ClusterLimiter) progressTime(p float64) float64 {
+	begin := float64(limiter.beginTime.UnixNano()) / 1e9
+	interval := float64(limiter.completionTime.UnixNano()-limiter.beginTime.UnixNano()) / 1e9
+	if limiter.pacing == nil || p <= 0 || p >= 1 {
+		return begin + p*interval
+	}
+
+	low, high := limiter.beginTime, limiter.completionTime
+	for high.Sub(low) > time.Millisecond {
+		mid := low.Add(high.Sub(low) / 2)
+		if limiter.progress(mid) < p {
+			low = mid
+		} else {
+			high = mid
 		}
-		return idealReward
 	}
+	return float64(high.UnixNano()) / 1e9
 }
 
 // Lag time from ideal reward
@@ -281,9 +604,11 @@ func (limiter *ClusterLimiter) getLagTime(reward float64, t time.Time) float64 {
 		return 0
 	}
 
+	// seconds between pacing curve reaching ideal reward and reaching reward
+	base := limiter.progressBase()
 	idealReward := limiter.getIdealReward(t)
-	interval := float64(limiter.completionTime.UnixNano()-limiter.beginTime.UnixNano()) / 1e9
-	return (idealReward - reward) * interval / limiter.rewardTarget
+	return limiter.progressTime(idealReward/limiter.rewardTarget+base) -
+		limiter.progressTime(reward/limiter.rewardTarget+base)
 }
 
 // limiters's current pass rate
@@ -318,16 +643,86 @@ func (limiter *ClusterLimiter) IdealRewardRate() float64 {
 	return limiter.idealRewardRate
 }
 
+// delay within which proportion q of attributed rewards arrive, 0 if no reward is attributed
+func (limiter *ClusterLimiter) RewardDelay(q float64) time.Duration {
+	if limiter.attribution == nil {
+		return 0
+	}
+	return limiter.attribution.delayQuantile(q)
+}
+
+// whether the store is unavailable and cluster's traffic is estimated from local traffic
+func (limiter *ClusterLimiter) Degraded() bool {
+	return limiter.RequestCounter.Degraded() || limiter.PassCounter.Degraded() || limiter.RewardCounter.Degraded()
+}
+
+// longest time since counters last loaded cluster's data
+func (limiter *ClusterLimiter) Staleness() time.Duration {
+	staleness := limiter.RequestCounter.Staleness()
+	for _, counter := range []*cluster_counter.ClusterCounter{limiter.PassCounter, limiter.RewardCounter} {
+		if s := counter.Staleness(); s > staleness {
+			staleness = s
+		}
+	}
+	return staleness
+}
+
+// random number of factory's source
+func (limiter *ClusterLimiter) randFloat64() float64 {
+	if limiter.factory != nil {
+		return limiter.factory.randFloat64()
+	}
+	return rand.Float64()
+}
+
+// period containing t, or the next one of schedule if t is not active
+func (limiter *ClusterLimiter) period(t time.Time) (time.Time, time.Time) {
+	if limiter.schedule != nil {
+		return limiter.schedule.Period(t)
+	}
+	beginTime := t.Truncate(limiter.periodInterval)
+	return beginTime, beginTime.Add(limiter.periodInterval)
+}
+
+// time of factory's clock
+func (limiter *ClusterLimiter) now() time.Time {
+	if limiter.factory != nil && limiter.factory.clock != nil {
+		return limiter.factory.clock.Now()
+	}
+	return time.Now()
+}
+
+// whether expired at last check, without renewing period
+func (limiter *ClusterLimiter) isExpired() bool {
+	limiter.mu.RLock()
+	defer limiter.mu.RUnlock()
+
+	return limiter.expired
+}
+
 // check whether expired
 func (limiter *ClusterLimiter) Expire() bool {
+	// store is accessed and recorder is called after unlock
+	var record *PeriodRecord
+	defer func() {
+		limiter.settlePeriods()
+		if record != nil {
+			limiter.settle(record, record.EndTime, record.EndTime)
+		}
+	}()
+
 	limiter.mu.Lock()
 	defer limiter.mu.Unlock()
 
-	timeNow := time.Now()
-	if limiter.periodInterval > 0 {
+	timeNow := limiter.now()
+	if cluster_counter.Periodic(limiter.periodInterval, limiter.schedule) {
 		if timeNow.After(limiter.endTime) {
-			limiter.beginTime = timeNow.Truncate(limiter.periodInterval)
-			limiter.endTime = limiter.beginTime.Add(limiter.periodInterval)
+			nextBeginTime, nextEndTime := limiter.period(timeNow)
+			limiter.collectPeriodReward()
+			limiter.unsettled = append(limiter.unsettled, limiter.closePeriod())
+			limiter.beginTime, limiter.endTime = nextBeginTime, nextEndTime
+			limiter.rolloverTarget, limiter.rolloverLoaded = 0, false
+			limiter.rewardTarget = limiter.periodTarget()
 
 			if limiter.reserveInterval > 0 && limiter.endTime.After(limiter.beginTime.Add(limiter.reserveInterval)) {
 				limiter.completionTime = limiter.endTime.Add(-limiter.reserveInterval)
@@ -340,7 +735,11 @@ func (limiter *ClusterLimiter) Expire() bool {
 		limiter.expired = false
 		return limiter.expired
 	} else {
-		limiter.expired = timeNow.After(limiter.endTime)
+		limiter.expired = timeNow.After(limiter.endTime.Add(limiter.attributionWindow))
+		if limiter.expired && limiter.recorded == false {
+			record = limiter.closePeriod()
+			limiter.recorded = true
+		}
 		return limiter.expired
 	}
 }
@@ -350,7 +749,12 @@ func (limiter *ClusterLimiter) Heartbeat() {
 	limiter.mu.Lock()
 	defer limiter.mu.Unlock()
 
-	timeNow := time.Now()
+	timeNow := limiter.now()
+	if limiter.attribution != nil {
+		limiter.attribution.expire(timeNow)
+	}
+	limiter.observeTraffic(timeNow)
+
 	if timeNow.After(limiter.endTime) || timeNow.Before(limiter.beginTime) {
 		return
 	}
@@ -368,12 +772,28 @@ func (limiter *ClusterLimiter) Heartbeat() {
 	limiter.sortScoreSamples()
 }
 
+// feed cluster's requests to pacing curve learning from traffic
+func (limiter *ClusterLimiter) observeTraffic(timeNow time.Time) {
+	observer, ok := limiter.pacing.(TrafficObserverI)
+	if ok == false {
+		return
+	}
+
+	curRequest, _ := limiter.RequestCounter.ClusterValue(0)
+	if limiter.prevObservedRequest.Count > 0 {
+		observer.Observe(timeNow, curRequest.Sum-limiter.prevObservedRequest.Sum)
+	} else {
+		observer.Observe(timeNow, 0)
+	}
+	limiter.prevObservedRequest = curRequest
+}
+
 func (limiter *ClusterLimiter) updateIdealPassRate() {
-	timeNow := time.Now()
+	timeNow := limiter.now()
 	if timeNow.Before(limiter.lastIdealPassRateTime.Add(limiter.Options.BurstInterval)) {
 		return
 	}
-	limiter.lastIdealPassRateTime = time.Now()
+	limiter.lastIdealPassRateTime = limiter.now()
 
 	if timeNow.Before(limiter.initTime.Add(limiter.Options.BurstInterval)) {
 		limiter.workingPassRate = limiter.idealPassRate
@@ -423,6 +843,10 @@ func (limiter *ClusterLimiter) updateIdealPassRate() {
 
 		var idealReward = limiter.rewardTarget * lastClusterRequestTime.Sub(limiter.prevClusterRequestTime).Seconds() /
 			limiter.endTime.Sub(limiter.beginTime).Seconds()
+		if limiter.pacing != nil {
+			idealReward = limiter.rewardTarget *
+				(limiter.progress(lastClusterRequestTime) - limiter.progress(limiter.prevClusterRequestTime))
+		}
 		limiter.clusterIdealRewardRecently.Sum = limiter.clusterIdealRewardRecently.Sum*limiter.Options.DeclineExpRatio +
 			idealReward*(1-limiter.Options.DeclineExpRatio)
 
@@ -445,11 +869,11 @@ func (limiter *ClusterLimiter) updateIdealPassRate() {
 }
 
 func (limiter *ClusterLimiter) updateIdealRewardRate() {
-	timeNow := time.Now()
+	timeNow := limiter.now()
 	if timeNow.Before(limiter.lastRewardPassRateTime.Add(limiter.Options.BurstInterval)) {
 		return
 	}
-	limiter.lastRewardPassRateTime = time.Now()
+	limiter.lastRewardPassRateTime = limiter.now()
 
 	var curLocalReward, _ = limiter.RewardCounter.LocalStoreValue(0)
 	var curLocalPass, _ = limiter.PassCounter.LocalStoreValue(0)
@@ -467,6 +891,12 @@ func (limiter *ClusterLimiter) updateIdealRewardRate() {
 	}
 
 	idealRewardRate := limiter.localRewardRecently.Sum / limiter.localPassRecently.Sum
+	// rewards of recent passes are still in flight
+	if limiter.attribution != nil {
+		if rate, ok := limiter.attribution.rewardRate(timeNow, float64(limiter.Options.UpdateRewardRateMinCount)); ok {
+			idealRewardRate = rate
+		}
+	}
 	if idealRewardRate >= 0 {
 		limiter.idealRewardRate = limiter.idealRewardRate*limiter.Options.RewardRatioDeclineExpRatio +
 			idealRewardRate*(1-limiter.Options.RewardRatioDeclineExpRatio)
@@ -480,7 +910,7 @@ func (limiter *ClusterLimiter) updateIdealRewardRate() {
 }
 
 func (limiter *ClusterLimiter) updateWorkingPassRate() {
-	timeNow := time.Now()
+	timeNow := limiter.now()
 	if timeNow.Before(limiter.initTime.Add(limiter.Options.BurstInterval * 2)) {
 		limiter.workingPassRate = limiter.idealPassRate
 		return
@@ -489,7 +919,7 @@ func (limiter *ClusterLimiter) updateWorkingPassRate() {
 	if timeNow.Before(limiter.lastWorkingPassRateTime.Add(limiter.Options.BurstInterval / 4)) {
 		return
 	}
-	limiter.lastWorkingPassRateTime = time.Now()
+	limiter.lastWorkingPassRateTime = limiter.now()
 
 	curReward, _ := limiter.RewardCounter.ClusterValue(0)
 	curReward = curReward.Sub(limiter.periodRewardBase)
@@ -530,7 +960,7 @@ func (limiter *ClusterLimiter) sortScoreSamples() {
 		return
 	}
 
-	timeNow := time.Now()
+	timeNow := limiter.now()
 	if timeNow.Before(limiter.lastScoreSortTime.Add(limiter.scoreSamplesSortInterval)) {
 		return
 	}
@@ -543,7 +973,7 @@ func (limiter *ClusterLimiter) sortScoreSamples() {
 	sort.Stable(sort.Float64Slice(samples))
 	limiter.mu.Lock()
 
-	limiter.lastScoreSortTime = time.Now()
+	limiter.lastScoreSortTime = limiter.now()
 	limiter.scoreSamplesSorted = samples
 }
 
@@ -564,6 +994,7 @@ func (limiter *ClusterLimiter) CollectMetrics() bool {
 	metrics["reward_rate"] = limiter.IdealRewardRate()
 
 	metrics["reward_target"] = limiter.GetRewardTarget()
+	metrics["rollover_target"] = limiter.RolloverTarget()
 	metrics["ideal_reward"] = limiter.IdealReward()
 
 	rewardCur, rewardTime := limiter.RewardCounter.ClusterValue(0)
@@ -604,9 +1035,21 @@ func (limiter *ClusterLimiter) CollectMetrics() bool {
 	metrics["reward_last_sum"] = rewardLast.Sum
 	metrics["reward_last_cnt"] = float64(rewardLast.Count)
 
+	if limiter.attribution != nil {
+		metrics["reward_delay_median"] = limiter.RewardDelay(0.5).Seconds()
+		metrics["attribution_pending"] = float64(limiter.attribution.pendingSize())
+	}
+
 	metrics["request_local_traffic_proportion"] = limiter.RequestCounter.LocalTrafficProportion()
 	metrics["reward_local_traffic_proportion"] = limiter.RewardCounter.LocalTrafficProportion()
 
+	if limiter.Degraded() {
+		metrics["store_degraded"] = 1.0
+	} else {
+		metrics["store_degraded"] = 0.0
+	}
+	metrics["store_staleness_seconds"] = limiter.Staleness().Seconds()
+
 	scoreFlag, scoreCutValue := limiter.ScoreCut()
 	if scoreFlag == false {
 		scoreCutValue = 1.0
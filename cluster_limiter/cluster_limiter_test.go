@@ -1 +1,96 @@
 package cluster_limiter
+
+import (
+	"github.com/boostlearn/go-cluster-limiter/cluster_counter"
+	"github.com/boostlearn/go-cluster-limiter/cluster_counter/clocktest"
+	"github.com/boostlearn/go-cluster-limiter/cluster_counter/memory_store"
+	"testing"
+	"time"
+)
+
+func TestClusterLimiter_FakeClock(t *testing.T) {
+	clock := clocktest.NewFakeClock(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	factory := NewFactory(&ClusterLimiterFactoryOpts{
+		Name:  "test",
+		Store: memory_store.NewStoreWithClock(clock),
+		Clock: clock,
+	})
+	factory.Stop()
+
+	limiter, err := factory.NewClusterLimiter(&ClusterLimiterOpts{
+		Name:           "test",
+		RewardTarget:   1000,
+		PeriodInterval: time.Hour,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// two periods of 10 requests every 100ms, all passed requests are rewarded
+	var periodPass [2]float64
+	for step := 0; step < 2*36000; step++ {
+		period := step / 36000
+		if step == 18000 && (periodPass[0] < 400 || periodPass[0] > 600) {
+			t.Fatal("reward should be paced over the period", periodPass[0])
+		}
+		for i := 0; i < 10; i++ {
+			if limiter.Take(1) {
+				limiter.Reward(1)
+				periodPass[period] += 1
+			}
+		}
+		factory.Heartbeat()
+		clock.Advance(100 * time.Millisecond)
+	}
+	for _, pass := range periodPass {
+		if pass < 900 || pass > 1000 {
+			t.Fatal("reward of each period should reach target", periodPass)
+		}
+	}
+}
+
+func TestClusterLimiter_Schedule(t *testing.T) {
+	friday := time.Date(2020, 1, 3, 0, 0, 0, 0, time.UTC)
+	clock := clocktest.NewFakeClock(friday.Add(8 * time.Hour))
+	factory := NewFactory(&ClusterLimiterFactoryOpts{
+		Name: "test", Store: memory_store.NewStoreWithClock(clock), Clock: clock})
+	factory.Stop()
+
+	limiter, err := factory.NewClusterLimiter(&ClusterLimiterOpts{
+		Name:         "daypart",
+		RewardTarget: 900,
+		InitPassRate: 1,
+		Schedule: &cluster_counter.Schedule{
+			Weekdays:    []time.Weekday{time.Monday, time.Tuesday, time.Wednesday, time.Thursday, time.Friday},
+			ActiveBegin: 9 * time.Hour,
+			ActiveEnd:   18 * time.Hour,
+			Reset:       "0 0 * * *",
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if limiter.beginTime != friday || limiter.endTime != friday.Add(24*time.Hour) {
+		t.Fatal("period should follow resets of schedule", limiter.beginTime, limiter.endTime)
+	}
+
+	factory.Heartbeat()
+	if limiter.Take(1) {
+		t.Fatal("request outside active hours should not pass")
+	}
+
+	clock.Advance(4 * time.Hour)
+	factory.Heartbeat()
+	if limiter.IdealReward() != 300 {
+		t.Fatal("reward target should be spent in active hours only", limiter.IdealReward())
+	}
+	if limiter.Take(1) == false {
+		t.Fatal("request in active hours should pass")
+	}
+
+	clock.Advance(13 * time.Hour)
+	factory.Heartbeat()
+	if limiter.beginTime != friday.Add(24*time.Hour) || limiter.Take(1) {
+		t.Fatal("saturday should be a new period without activity", limiter.beginTime)
+	}
+}
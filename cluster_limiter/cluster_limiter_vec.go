@@ -0,0 +1,220 @@
+package cluster_limiter
+
+import (
+	"github.com/boostlearn/go-cluster-limiter/cluster_counter"
+	"strings"
+	"sync"
+	"time"
+)
+
+// reward target of limiter with label values, false if template's target is used
+type RewardTargetFunc func(lbs []string) (float64, bool)
+
+// separator of label values in keys of limiters with labels
+const LimiterVecKeySep = "####"
+
+// reward targets keyed by label values joined with LimiterVecKeySep
+func RewardTargetsFromMap(targets map[string]float64) RewardTargetFunc {
+	return func(lbs []string) (float64, bool) {
+		target, ok := targets[strings.Join(lbs, LimiterVecKeySep)]
+		return target, ok
+	}
+}
+
+// limiter vector with same configuration, its counters are labeled series of one name
+type ClusterLimiterVec struct {
+	mu         sync.RWMutex
+	name       string
+	labelNames []string
+
+	Options *ClusterLimiterOpts
+	factory *ClusterLimiterFactory
+	parent  *ClusterLimiter
+
+	rewardTargetFunc RewardTargetFunc
+	rewardTargets    sync.Map
+
+	RequestCounterVec *cluster_counter.ClusterCounterVec
+	PassCounterVec    *cluster_counter.ClusterCounterVec
+	RewardCounterVec  *cluster_counter.ClusterCounterVec
+
+	limiters sync.Map
+}
+
+// create new limiter vector, limiters are created by WithLabelValues
+func (factory *ClusterLimiterFactory) NewClusterLimiterVec(opts *ClusterLimiterOpts, labelNames []string,
+	rewardTargetFunc RewardTargetFunc) (*ClusterLimiterVec, error) {
+	if err := setDefaultOptions(opts); err != nil {
+		return nil, err
+	}
+	if err := factory.checkStore(opts); err != nil {
+		return nil, err
+	}
+
+	parent, err := factory.parentLimiter(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	limiterVec := &ClusterLimiterVec{
+		name:             opts.Name,
+		labelNames:       append([]string{}, labelNames...),
+		Options:          opts,
+		factory:          factory,
+		parent:           parent,
+		rewardTargetFunc: rewardTargetFunc,
+	}
+
+	counterOpts := *opts
+	if cluster_counter.Periodic(opts.PeriodInterval, opts.Schedule) {
+		counterOpts.BeginTime = time.Date(1900, 1, 1, 0, 0, 0, 0, time.Local)
+		counterOpts.EndTime = time.Date(3000, 1, 1, 0, 0, 0, 0, time.Local)
+	}
+
+	limiterVec.RequestCounterVec, err = factory.counterFactory.NewClusterCounterVec(
+		counterOptions(factory.name+opts.Name+":request", &counterOpts), labelNames)
+	if err != nil {
+		return nil, err
+	}
+
+	limiterVec.PassCounterVec, err = factory.counterFactory.NewClusterCounterVec(
+		counterOptions(factory.name+opts.Name+":pass", &counterOpts), labelNames)
+	if err != nil {
+		return nil, err
+	}
+
+	limiterVec.RewardCounterVec, err = factory.counterFactory.NewClusterCounterVec(
+		rewardCounterOptions(factory.name+opts.Name+":reward", &counterOpts), labelNames)
+	if err != nil {
+		return nil, err
+	}
+
+	factory.limiterVecs.Store(opts.Name, limiterVec)
+	return factory.GetClusterLimiterVec(opts.Name), nil
+}
+
+// get limiter vector
+func (factory *ClusterLimiterFactory) GetClusterLimiterVec(name string) *ClusterLimiterVec {
+	if l, ok := factory.limiterVecs.Load(name); ok {
+		return l.(*ClusterLimiterVec)
+	}
+	return nil
+}
+
+// get or build limiter with labels
+func (limiterVec *ClusterLimiterVec) WithLabelValues(lbs []string) *ClusterLimiter {
+	if len(limiterVec.labelNames) != len(lbs) {
+		return nil
+	}
+
+	key := strings.Join(lbs, LimiterVecKeySep)
+	if v, ok := limiterVec.limiters.Load(key); ok {
+		if limiter, ok2 := v.(*ClusterLimiter); ok2 {
+			return limiter
+		}
+	}
+
+	opts := *limiterVec.Options
+	opts.RewardTarget = limiterVec.rewardTarget(key, lbs)
+
+	limiter := limiterVec.factory.newLimiter(&opts)
+	limiter.name = limiterVec.name + "{" + strings.Join(lbs, ",") + "}"
+	limiter.lbs = append([]string{}, lbs...)
+	limiter.parent = limiterVec.parent
+	limiter.RequestCounter = limiterVec.RequestCounterVec.WithLabelValues(lbs)
+	limiter.PassCounter = limiterVec.PassCounterVec.WithLabelValues(lbs)
+	limiter.RewardCounter = limiterVec.RewardCounterVec.WithLabelValues(lbs)
+	limiter.labels = make(map[string]string)
+	for i, labelName := range limiterVec.labelNames {
+		limiter.labels[labelName] = lbs[i]
+	}
+	limiter.Initialize()
+
+	v, loaded := limiterVec.limiters.LoadOrStore(key, limiter)
+	if loaded == false && limiter.parent != nil {
+		limiter.parent.children.Store(limiter.name, limiter)
+	}
+	return v.(*ClusterLimiter)
+}
+
+// reward target set for the labels, or from callback, or template's target
+func (limiterVec *ClusterLimiterVec) rewardTarget(key string, lbs []string) float64 {
+	if v, ok := limiterVec.rewardTargets.Load(key); ok {
+		return v.(float64)
+	}
+
+	limiterVec.mu.RLock()
+	rewardTargetFunc := limiterVec.rewardTargetFunc
+	limiterVec.mu.RUnlock()
+	if rewardTargetFunc != nil {
+		if target, ok := rewardTargetFunc(lbs); ok {
+			return target
+		}
+	}
+	return limiterVec.Options.RewardTarget
+}
+
+// set reward target of limiter with labels, it takes precedence over callback
+func (limiterVec *ClusterLimiterVec) SetRewardTarget(lbs []string, target float64) {
+	key := strings.Join(lbs, LimiterVecKeySep)
+	limiterVec.rewardTargets.Store(key, target)
+
+	if v, ok := limiterVec.limiters.Load(key); ok {
+		v.(*ClusterLimiter).SetRewardTarget(target)
+	}
+}
+
+// replace callback of reward targets and apply it to created limiters
+func (limiterVec *ClusterLimiterVec) SetRewardTargetFunc(rewardTargetFunc RewardTargetFunc) {
+	limiterVec.mu.Lock()
+	limiterVec.rewardTargetFunc = rewardTargetFunc
+	limiterVec.mu.Unlock()
+
+	limiterVec.RefreshRewardTargets()
+}
+
+// evaluate reward targets of created limiters again, e.g. after callback's source changed
+func (limiterVec *ClusterLimiterVec) RefreshRewardTargets() {
+	limiterVec.rangeLimiters(func(key string, limiter *ClusterLimiter) bool {
+		limiter.SetRewardTarget(limiterVec.rewardTarget(key, limiter.lbs))
+		return true
+	})
+}
+
+// update data heartbeat
+func (limiterVec *ClusterLimiterVec) Heartbeat() {
+	limiterVec.rangeLimiters(func(key string, limiter *ClusterLimiter) bool {
+		limiter.Heartbeat()
+		limiter.CollectMetrics()
+
+		if limiter.Expire() {
+			limiterVec.limiters.Delete(key)
+			if limiter.parent != nil {
+				limiter.parent.children.Delete(limiter.name)
+			}
+		}
+		return true
+	})
+}
+
+// all unexpired limiters with labels
+func (limiterVec *ClusterLimiterVec) AllLimiters() []*ClusterLimiter {
+	var limiters []*ClusterLimiter
+	limiterVec.rangeLimiters(func(key string, limiter *ClusterLimiter) bool {
+		if limiter.isExpired() == false {
+			limiters = append(limiters, limiter)
+		}
+		return true
+	})
+	return limiters
+}
+
+// iterate limiters with labels
+func (limiterVec *ClusterLimiterVec) rangeLimiters(f func(key string, limiter *ClusterLimiter) bool) {
+	limiterVec.limiters.Range(func(k interface{}, v interface{}) bool {
+		if limiter, ok := v.(*ClusterLimiter); ok {
+			return f(k.(string), limiter)
+		}
+		return true
+	})
+}
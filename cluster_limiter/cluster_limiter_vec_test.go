@@ -0,0 +1,90 @@
+package cluster_limiter
+
+import (
+	"github.com/boostlearn/go-cluster-limiter/cluster_counter/clocktest"
+	"github.com/boostlearn/go-cluster-limiter/cluster_counter/memory_store"
+	"testing"
+	"time"
+)
+
+func TestClusterLimiterVec_WithLabelValues(t *testing.T) {
+	store := memory_store.NewStore()
+	factory := NewFactory(&ClusterLimiterFactoryOpts{Name: "test", Store: store})
+	factory.Stop()
+
+	limiterVec, err := factory.NewClusterLimiterVec(&ClusterLimiterOpts{
+		Name:           "vec",
+		RewardTarget:   100,
+		PeriodInterval: time.Hour,
+	}, []string{"advertiser"}, RewardTargetsFromMap(map[string]float64{"a": 200}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if limiterVec.WithLabelValues([]string{"a", "b"}) != nil {
+		t.Fatal("labels should match label names")
+	}
+
+	a := limiterVec.WithLabelValues([]string{"a"})
+	if a != limiterVec.WithLabelValues([]string{"a"}) {
+		t.Fatal("limiter should be created once")
+	}
+	b := limiterVec.WithLabelValues([]string{"b"})
+	if a.GetRewardTarget() != 200 || b.GetRewardTarget() != 100 {
+		t.Fatal("reward target error", a.GetRewardTarget(), b.GetRewardTarget())
+	}
+
+	limiterVec.SetRewardTarget([]string{"b"}, 50)
+	limiterVec.SetRewardTargetFunc(nil)
+	if a.GetRewardTarget() != 100 || b.GetRewardTarget() != 50 {
+		t.Fatal("reward target should be updated", a.GetRewardTarget(), b.GetRewardTarget())
+	}
+
+	a.Take(1)
+	b.Take(1)
+	factory.Heartbeat()
+	keys, _ := store.ListKeys("testvec:request")
+	if len(keys) != 2 || len(keys[0].Labels) != 1 {
+		t.Fatal("requests should be labeled series of one name", keys)
+	}
+
+	if err := factory.Delete("vec"); err != nil || factory.GetClusterLimiterVec("vec") != nil {
+		t.Fatal("limiter vector should be deleted", err)
+	}
+	if keys, _ := store.ListKeys("testvec:"); len(keys) != 0 {
+		t.Fatal("series of deleted limiter vector should be purged", len(keys))
+	}
+}
+
+func TestRewardTargetsFromMap(t *testing.T) {
+	targets := RewardTargetsFromMap(map[string]float64{"a,b" + LimiterVecKeySep + "c": 1})
+	if target, ok := targets([]string{"a,b", "c"}); ok == false || target != 1 {
+		t.Fatal("target should be found by label values", target)
+	}
+	if _, ok := targets([]string{"a", "b,c"}); ok {
+		t.Fatal("label values containing comma should not collide")
+	}
+}
+
+func TestClusterLimiterVec_AllLimiters(t *testing.T) {
+	beginTime := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := clocktest.NewFakeClock(beginTime)
+	recorder := &periodRecorderForTest{}
+	factory := NewFactory(&ClusterLimiterFactoryOpts{
+		Name: "test", Store: memory_store.NewStoreWithClock(clock), Clock: clock, PeriodRecorder: recorder})
+	factory.Stop()
+
+	limiterVec, _ := factory.NewClusterLimiterVec(&ClusterLimiterOpts{
+		Name: "vec", RewardTarget: 100, PeriodInterval: time.Hour}, []string{"advertiser"}, nil)
+	limiterVec.WithLabelValues([]string{"a"})
+
+	// listing limiters does not close their periods
+	clock.Advance(time.Hour + time.Second)
+	if len(limiterVec.AllLimiters()) != 1 || len(factory.AllLimiters()) != 0 || len(recorder.records) != 0 {
+		t.Fatal("listing limiters should not close periods", len(recorder.records))
+	}
+	factory.Heartbeat()
+	if len(recorder.records) != 1 {
+		t.Fatal("heartbeat should close period", len(recorder.records))
+	}
+}
@@ -1,11 +1,14 @@
 package cluster_limiter
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/boostlearn/go-cluster-limiter/cluster_counter"
 	"io/ioutil"
+	"math/rand"
+	"reflect"
 	"sync"
 	"time"
 )
@@ -34,6 +37,9 @@ type ClusterLimiterOpts struct {
 
 	PeriodInterval  time.Duration
 	ReserveInterval time.Duration
+	// periods follow schedule's resets or active windows instead of PeriodInterval,
+	// and requests outside active hours are not passed
+	Schedule *cluster_counter.Schedule
 
 	BurstInterval  time.Duration
 	MaxBoostFactor float64
@@ -53,17 +59,44 @@ type ClusterLimiterOpts struct {
 	TakeWithScore            bool
 	ScoreSamplesSortInterval time.Duration
 	ScoreSamplesMax          int64
+
+	// name of parent limiter created before, a request passes only if all ancestors admit it
+	// and rewards are added to all ancestors. a parent outlives its children
+	Parent string
+	// share of parent's unused budget and siblings' unspent target among children, 0 takes no share
+	Weight float64
+
+	// schedule of spending reward target, default is linear, or traffic profile if set
+	PacingCurve PacingCurveI `json:"-"`
+	// learn requests of each slot of day or week from store, for pacing and initial pass rate.
+	// ignored by ClusterLimiterVec
+	TrafficProfile *TrafficProfileOpts
+
+	// rewards of passes taken by TakeWithID within this window after the pass are credited to the period of the pass,
+	// 0 disables attribution
+	AttributionWindow time.Duration
+
+	// move difference between reward target and reward of a period into following periods, periodic limiters only
+	Rollover *RolloverOpts
 }
 
 // Producer of limiter
 type ClusterLimiterFactory struct {
 	name              string
-	ticker            *time.Ticker
+	clock             cluster_counter.Clock
+	randMu            sync.Mutex
+	rand              *rand.Rand
+	ticker            cluster_counter.Ticker
 	heartbeatInterval time.Duration
+	done              chan struct{}
+	stopOnce          sync.Once
+	loopWg            sync.WaitGroup
 
 	limiters       sync.Map
+	limiterVecs    sync.Map
 	counterFactory *cluster_counter.ClusterCounterFactory
 	Reporter       ReporterI
+	PeriodRecorder PeriodRecorderI
 }
 
 // options of creating limiter's factory
@@ -73,6 +106,17 @@ type ClusterLimiterFactoryOpts struct {
 	InitLocalTrafficProportion float64
 	Store                      cluster_counter.DataStoreI
 	Reporter                   ReporterI
+	// receiver of results of limiters' periods
+	PeriodRecorder PeriodRecorderI
+
+	// source of time, default is cluster_counter.RealClock
+	Clock cluster_counter.Clock
+	// source of random numbers for admitting requests, default is the global source of math/rand
+	RandSource rand.Source
+
+	// identity of this process passed to store and deadline of one store call
+	NodeID       string
+	StoreTimeout time.Duration
 }
 
 // build new factory
@@ -89,26 +133,131 @@ func NewFactory(opts *ClusterLimiterFactoryOpts) *ClusterLimiterFactory {
 		Name:              opts.Name + ":cls_ct:",
 		HeartbeatInterval: opts.HeartbeatInterval,
 		Store:             opts.Store,
+		Clock:             opts.Clock,
+		NodeID:            opts.NodeID,
+		StoreTimeout:      opts.StoreTimeout,
 	})
 	factory := &ClusterLimiterFactory{
+		clock:             counterFactory.Clock(),
 		counterFactory:    counterFactory,
 		heartbeatInterval: opts.HeartbeatInterval,
 		name:              opts.Name,
 		Reporter:          opts.Reporter,
+		PeriodRecorder:    opts.PeriodRecorder,
+	}
+	if opts.RandSource != nil {
+		factory.rand = rand.New(opts.RandSource)
 	}
 	return factory
 }
 
+// random number in [0.0,1.0)
+func (factory *ClusterLimiterFactory) randFloat64() float64 {
+	if factory.rand == nil {
+		return rand.Float64()
+	}
+
+	factory.randMu.Lock()
+	defer factory.randMu.Unlock()
+	return factory.rand.Float64()
+}
+
+// rollover is settled once for the cluster, so its store should set values if absent for the whole cluster,
+// e.g. not a tiered or gossip store. without store each node settles on its own
+func (factory *ClusterLimiterFactory) checkStore(opts *ClusterLimiterOpts) error {
+	store := factory.counterFactory.Store
+	if opts.Rollover == nil || store == nil || reflect.ValueOf(store).IsNil() {
+		return nil
+	}
+	if cluster_counter.CanSetIfAbsent(store) == false {
+		return errors.New("rollover needs a store setting values if absent, see cluster_counter.SetIfAbsentDataStoreI")
+	}
+	return nil
+}
+
 // create new limiter
 func (factory *ClusterLimiterFactory) NewClusterLimiter(opts *ClusterLimiterOpts,
 ) (*ClusterLimiter, error) {
+	if err := setDefaultOptions(opts); err != nil {
+		return nil, err
+	}
+	if err := factory.checkStore(opts); err != nil {
+		return nil, err
+	}
+
+	parent, err := factory.parentLimiter(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	limiter := factory.newLimiter(opts)
+	limiter.parent = parent
+
+	if cluster_counter.Periodic(opts.PeriodInterval, opts.Schedule) {
+		opts.BeginTime = time.Date(1900, 1, 1, 0, 0, 0, 0, time.Local)
+		opts.EndTime = time.Date(3000, 1, 1, 0, 0, 0, 0, time.Local)
+	}
+
+	limiter.RequestCounter, err = factory.counterFactory.NewClusterCounter(
+		counterOptions(factory.name+opts.Name+":request", opts))
+	if err != nil {
+		return nil, err
+	}
+
+	limiter.PassCounter, err = factory.counterFactory.NewClusterCounter(
+		counterOptions(factory.name+opts.Name+":pass", opts))
+	if err != nil {
+		return nil, err
+	}
+
+	limiter.RewardCounter, err = factory.counterFactory.NewClusterCounter(
+		rewardCounterOptions(factory.name+opts.Name+":reward", opts))
+	if err != nil {
+		return nil, err
+	}
+
+	if opts.TrafficProfile != nil {
+		limiter.trafficProfile, err = newTrafficProfile(opts.TrafficProfile, limiter.now())
+		if err != nil {
+			return nil, err
+		}
+		if opts.PacingCurve == nil {
+			limiter.pacing = limiter.trafficProfile
+		}
+		limiter.syncTrafficProfile()
+	}
+	limiter.Initialize()
+
+	if parent != nil {
+		parent.children.Store(limiter.name, limiter)
+	}
+	factory.limiters.Store(opts.Name, limiter)
+	return factory.GetClusterLimiter(opts.Name), nil
+}
+
+// check options and fill default values
+func setDefaultOptions(opts *ClusterLimiterOpts) error {
 	if len(opts.Name) == 0 {
-		return nil, errors.New("name cannot be nil")
+		return errors.New("name cannot be nil")
 	}
 
-	if opts.PeriodInterval.Truncate(time.Second) == 0 &&
+	if opts.Schedule != nil {
+		if err := opts.Schedule.Validate(); err != nil {
+			return err
+		}
+	} else if opts.PeriodInterval.Truncate(time.Second) == 0 &&
 		opts.BeginTime.Truncate(time.Second).Before(opts.EndTime.Truncate(time.Second)) == false {
-		return nil, errors.New("period interval not set or begin time bigger than end time")
+		return errors.New("period interval not set or begin time bigger than end time")
+	}
+
+	if validator, ok := opts.PacingCurve.(PacingValidatorI); ok && reflect.ValueOf(validator).IsNil() == false {
+		if err := validator.Validate(); err != nil {
+			return err
+		}
+	}
+
+	if opts.Rollover != nil && (cluster_counter.Periodic(opts.PeriodInterval, opts.Schedule) == false || opts.Rollover.MaxCarryRatio < 0) {
+		return errors.New("rollover needs periods and max carry ratio should not be negative")
 	}
 
 	if opts.CompletionTime.Unix() == 0 {
@@ -150,11 +299,41 @@ func (factory *ClusterLimiterFactory) NewClusterLimiter(opts *ClusterLimiterOpts
 		opts.RewardRatioDeclineExpRatio = DefaultRewardRatioDeclineExpRatio
 	}
 
-	var limiter = &ClusterLimiter{
+	if opts.Weight < 0 {
+		return errors.New("weight cannot be negative")
+	}
+
+	if opts.AttributionWindow < 0 {
+		return errors.New("attribution window cannot be negative")
+	}
+	return nil
+}
+
+// parent of limiter to create, nil if not set
+func (factory *ClusterLimiterFactory) parentLimiter(opts *ClusterLimiterOpts) (*ClusterLimiter, error) {
+	if len(opts.Parent) == 0 {
+		return nil, nil
+	}
+
+	if opts.Parent == opts.Name {
+		return nil, errors.New("limiter cannot be parent of itself")
+	}
+
+	parent := factory.GetClusterLimiter(opts.Parent)
+	if parent == nil {
+		return nil, errors.New("parent limiter not found: " + opts.Parent)
+	}
+	return parent, nil
+}
+
+// build limiter without counters
+func (factory *ClusterLimiterFactory) newLimiter(opts *ClusterLimiterOpts) *ClusterLimiter {
+	limiter := &ClusterLimiter{
 		name:                     opts.Name,
 		Options:                  opts,
 		factory:                  factory,
 		rewardTarget:             opts.RewardTarget,
+		baseRewardTarget:         opts.RewardTarget,
 		beginTime:                opts.BeginTime,
 		endTime:                  opts.EndTime,
 		completionTime:           opts.CompletionTime,
@@ -165,53 +344,41 @@ func (factory *ClusterLimiterFactory) NewClusterLimiter(opts *ClusterLimiterOpts
 		idealRewardRate:          opts.InitRewardRate,
 		scoreSamplesSortInterval: opts.ScoreSamplesSortInterval,
 		scoreSamplesMax:          opts.ScoreSamplesMax,
+		attributionWindow:        opts.AttributionWindow,
+		pacing:                   opts.PacingCurve,
+		schedule:                 opts.Schedule,
 	}
-
-	if opts.PeriodInterval > 0 {
-		opts.BeginTime = time.Date(1900, 1, 1, 0, 0, 0, 0, time.Local)
-		opts.EndTime = time.Date(3000, 1, 1, 0, 0, 0, 0, time.Local)
+	if clone, ok := limiter.pacing.(PacingCloneI); ok && reflect.ValueOf(clone).IsNil() == false {
+		limiter.pacing = clone.Clone()
 	}
-
-	var err error
-	limiter.RequestCounter, err = factory.counterFactory.NewClusterCounter(&cluster_counter.ClusterCounterOpts{
-		Name:                       factory.name + opts.Name + ":request",
-		BeginTime:                  opts.BeginTime,
-		EndTime:                    opts.EndTime,
-		DiscardPreviousData:        opts.DiscardPreviousData,
-		StoreDataInterval:          opts.BurstInterval,
-		InitLocalTrafficProportion: opts.InitLocalTrafficProportion,
-	})
-	if err != nil {
-		return nil, err
+	if limiter.pacing == nil && opts.Schedule != nil {
+		limiter.pacing = opts.Schedule
 	}
-
-	limiter.PassCounter, err = factory.counterFactory.NewClusterCounter(&cluster_counter.ClusterCounterOpts{
-		Name:                       factory.name + opts.Name + ":pass",
-		BeginTime:                  opts.BeginTime,
-		EndTime:                    opts.EndTime,
-		DiscardPreviousData:        opts.DiscardPreviousData,
-		StoreDataInterval:          opts.BurstInterval,
-		InitLocalTrafficProportion: opts.InitLocalTrafficProportion,
-	})
-	if err != nil {
-		return nil, err
+	if opts.AttributionWindow > 0 {
+		limiter.attribution = newAttribution(opts.AttributionWindow, opts.BurstInterval)
 	}
+	return limiter
+}
 
-	limiter.RewardCounter, err = factory.counterFactory.NewClusterCounter(&cluster_counter.ClusterCounterOpts{
-		Name:                       factory.name + opts.Name + ":reward",
+// options of limiter's request, pass or reward counter
+func counterOptions(name string, opts *ClusterLimiterOpts) *cluster_counter.ClusterCounterOpts {
+	return &cluster_counter.ClusterCounterOpts{
+		Name:                       name,
 		BeginTime:                  opts.BeginTime,
 		EndTime:                    opts.EndTime,
 		DiscardPreviousData:        opts.DiscardPreviousData,
 		StoreDataInterval:          opts.BurstInterval,
 		InitLocalTrafficProportion: opts.InitLocalTrafficProportion,
-	})
-	if err != nil {
-		return nil, err
 	}
-	limiter.Initialize()
+}
 
-	factory.limiters.Store(opts.Name, limiter)
-	return factory.GetClusterLimiter(opts.Name), nil
+// options of limiter's reward counter, rewards of the last passes are counted within attribution window after end
+func rewardCounterOptions(name string, opts *ClusterLimiterOpts) *cluster_counter.ClusterCounterOpts {
+	counterOpts := counterOptions(name, opts)
+	if cluster_counter.Periodic(opts.PeriodInterval, opts.Schedule) == false {
+		counterOpts.EndTime = counterOpts.EndTime.Add(opts.AttributionWindow)
+	}
+	return counterOpts
 }
 
 // get limiter
@@ -244,52 +411,124 @@ func (factory *ClusterLimiterFactory) LoadFile(filePath string) error {
 
 func (factory *ClusterLimiterFactory) Start() {
 	if factory.ticker == nil {
-		factory.ticker = time.NewTicker(factory.heartbeatInterval)
-		go factory.WatchAndSync()
+		factory.ticker = factory.clock.NewTicker(factory.heartbeatInterval)
+		factory.done = make(chan struct{})
+		factory.loopWg.Add(1)
+		go func() {
+			defer factory.loopWg.Done()
+			factory.WatchAndSync()
+		}()
 	}
 }
 
+// stop update of limiters and of their counters
 func (factory *ClusterLimiterFactory) Stop() {
+	factory.counterFactory.Stop()
 	if factory.ticker != nil {
 		factory.ticker.Stop()
+		factory.stopOnce.Do(func() {
+			close(factory.done)
+		})
 	}
 }
 
 func (factory *ClusterLimiterFactory) WatchAndSync() {
-	for range factory.ticker.C {
-		factory.Heartbeat()
+	for {
+		select {
+		case <-factory.done:
+			return
+		case <-factory.ticker.C():
+			factory.Heartbeat()
+		}
 	}
 }
 
+// stop update, wait for running heartbeat, then store all limiters' un-flushed data
+func (factory *ClusterLimiterFactory) Close(ctx context.Context) error {
+	factory.Stop()
+
+	stopped := make(chan struct{})
+	go func() {
+		factory.loopWg.Wait()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	return factory.counterFactory.Close(ctx)
+}
+
 // update
 func (factory *ClusterLimiterFactory) Heartbeat() {
 	factory.counterFactory.Heartbeat()
 
 	factory.limiters.Range(func(k interface{}, v interface{}) bool {
 		if limiter, ok := v.(*ClusterLimiter); ok {
+			limiter.syncTrafficProfile()
 			limiter.Heartbeat()
 			limiter.CollectMetrics()
 
-			if limiter.Expire() {
+			// an expired parent is kept until its children are gone
+			if limiter.Expire() && limiter.hasChildren() == false {
 				factory.limiters.Delete(k)
+				if limiter.parent != nil {
+					limiter.parent.children.Delete(limiter.name)
+				}
 			}
 		}
 		return true
 	})
+
+	factory.limiterVecs.Range(func(k interface{}, v interface{}) bool {
+		if limiterVec, ok := v.(*ClusterLimiterVec); ok {
+			limiterVec.Heartbeat()
+		}
+		return true
+	})
+
+	factory.limiters.Range(func(k interface{}, v interface{}) bool {
+		if limiter, ok := v.(*ClusterLimiter); ok {
+			limiter.redistributeBudget()
+		}
+		return true
+	})
 }
 
-func (factory *ClusterLimiterFactory) Delete(name string) {
+// delete limiter or limiter vector, and its request, pass and reward series in store if store can delete keys.
+// a parent cannot be deleted before its children
+func (factory *ClusterLimiterFactory) Delete(name string) error {
+	if limiter := factory.GetClusterLimiter(name); limiter != nil && limiter.hasChildren() {
+		return errors.New("limiter has children: " + name)
+	}
+	if limiter := factory.GetClusterLimiter(name); limiter != nil && limiter.parent != nil {
+		limiter.parent.children.Delete(name)
+	}
+	if limiterVec := factory.GetClusterLimiterVec(name); limiterVec != nil && limiterVec.parent != nil {
+		limiterVec.rangeLimiters(func(key string, limiter *ClusterLimiter) bool {
+			limiterVec.parent.children.Delete(limiter.name)
+			return true
+		})
+	}
 	factory.limiters.Delete(name)
-	factory.counterFactory.Delete(factory.name + name + ":request")
-	factory.counterFactory.Delete(factory.name + name + ":pass")
-	factory.counterFactory.Delete(factory.name + name + ":reward")
+	factory.limiterVecs.Delete(name)
+
+	var lastErr error
+	for _, suffix := range []string{":request", ":pass", ":reward", ":period_reward", ":settlement", ":period_open", ":profile"} {
+		if err := factory.counterFactory.Purge(factory.name + name + suffix); err != nil {
+			lastErr = err
+		}
+	}
+	return lastErr
 }
 
 func (factory *ClusterLimiterFactory) AllOptions() []*ClusterLimiterOpts {
 	var opts []*ClusterLimiterOpts
 	factory.limiters.Range(func(k interface{}, v interface{}) bool {
 		if limiter, ok := v.(*ClusterLimiter); ok {
-			if limiter.Expire() == false {
+			if limiter.isExpired() == false {
 				opts = append(opts, limiter.Options)
 			}
 		}
@@ -302,7 +541,7 @@ func (factory *ClusterLimiterFactory) AllLimiters() []*ClusterLimiter {
 	var limiters []*ClusterLimiter
 	factory.limiters.Range(func(k interface{}, v interface{}) bool {
 		if limiter, ok := v.(*ClusterLimiter); ok {
-			if limiter.Expire() == false {
+			if limiter.isExpired() == false {
 				limiters = append(limiters, limiter)
 			}
 		}
@@ -1 +1,167 @@
 package cluster_limiter
+
+import (
+	"github.com/boostlearn/go-cluster-limiter/cluster_counter/clocktest"
+	"github.com/boostlearn/go-cluster-limiter/cluster_counter/memory_store"
+	"math"
+	"testing"
+	"time"
+)
+
+func TestClusterLimiterFactory_Delete(t *testing.T) {
+	store := memory_store.NewStore()
+	factory := NewFactory(&ClusterLimiterFactoryOpts{Name: "test", Store: store})
+	factory.Stop()
+
+	for _, name := range []string{"l1", "l10"} {
+		limiter, err := factory.NewClusterLimiter(&ClusterLimiterOpts{
+			Name:           name,
+			RewardTarget:   100,
+			PeriodInterval: time.Hour,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		limiter.Take(1)
+		limiter.Reward(1)
+	}
+	factory.Heartbeat()
+	if keys, _ := store.ListKeys("testl1:"); len(keys) == 0 {
+		t.Fatal("series should be stored")
+	}
+
+	if err := factory.Delete("l1"); err != nil {
+		t.Fatal(err)
+	}
+	if factory.GetClusterLimiter("l1") != nil {
+		t.Fatal("limiter should be deleted")
+	}
+	if keys, _ := store.ListKeys("testl1:"); len(keys) != 0 {
+		t.Fatal("series of deleted limiter should be purged", len(keys))
+	}
+	if keys, _ := store.ListKeys("testl10:"); len(keys) == 0 {
+		t.Fatal("series of other limiter should be kept")
+	}
+}
+
+// counter factory keeps its own heartbeat, serialized with the limiter factory's one
+func TestClusterLimiterFactory_CounterHeartbeat(t *testing.T) {
+	clock := clocktest.NewFakeClock(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	store := memory_store.NewStoreWithClock(clock)
+	factory := NewFactory(&ClusterLimiterFactoryOpts{Name: "test", Store: store, Clock: clock})
+	defer factory.Stop()
+
+	limiter, _ := factory.NewClusterLimiter(&ClusterLimiterOpts{Name: "l", RewardTarget: 100,
+		PeriodInterval: time.Hour})
+	limiter.Take(1)
+	clock.Advance(time.Duration(DefaultHeartbeatIntervalMilliseconds) * time.Millisecond)
+
+	for i := 0; i < 100; i++ {
+		if keys, _ := store.ListKeys("testl:"); len(keys) > 0 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("counters should be stored without Start")
+}
+
+func TestClusterLimiterFactory_Parent(t *testing.T) {
+	beginTime := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := clocktest.NewFakeClock(beginTime)
+	factory := NewFactory(&ClusterLimiterFactoryOpts{
+		Name: "test", Store: memory_store.NewStoreWithClock(clock), Clock: clock})
+	factory.Stop()
+
+	if _, err := factory.NewClusterLimiter(&ClusterLimiterOpts{
+		Name: "c", PeriodInterval: time.Hour, Parent: "p"}); err == nil {
+		t.Fatal("parent should be created before")
+	}
+
+	parent, _ := factory.NewClusterLimiter(&ClusterLimiterOpts{Name: "p", RewardTarget: 100, PeriodInterval: time.Hour})
+	a, _ := factory.NewClusterLimiter(&ClusterLimiterOpts{Name: "a", RewardTarget: 20, PeriodInterval: time.Hour,
+		Parent: "p", Weight: 1, InitPassRate: 1})
+	b, _ := factory.NewClusterLimiter(&ClusterLimiterOpts{Name: "b", RewardTarget: 20, PeriodInterval: time.Hour,
+		Parent: "p", Weight: 3, InitPassRate: 1})
+	if a.Parent() != parent {
+		t.Fatal("parent not set")
+	}
+
+	factory.Heartbeat()
+	if a.GetRewardTarget() != 35 || b.GetRewardTarget() != 65 {
+		t.Fatal("unused budget should be shared by weight", a.GetRewardTarget(), b.GetRewardTarget())
+	}
+
+	// parent's pass rate is 0 before its first update
+	if a.Take(1) {
+		t.Fatal("request should be rejected by parent")
+	}
+	if v, _ := a.PassCounter.LocalValue(0); v.Count != 0 {
+		t.Fatal("request rejected by parent should not pass", v)
+	}
+
+	a.Reward(1)
+	if v, _ := parent.RewardCounter.LocalValue(0); v.Sum != 1 {
+		t.Fatal("reward should be added to parent", v)
+	}
+
+	if err := factory.Delete("p"); err == nil || factory.GetClusterLimiter("p") == nil {
+		t.Fatal("parent with children should not be deleted")
+	}
+	_ = factory.Delete("a")
+	factory.Heartbeat()
+	if b.GetRewardTarget() != 20+79 {
+		t.Fatal("deleted child should not take share", b.GetRewardTarget())
+	}
+	_ = factory.Delete("b")
+	if err := factory.Delete("p"); err != nil {
+		t.Fatal("parent without children should be deleted", err)
+	}
+}
+
+func TestClusterLimiterFactory_ParentUnspent(t *testing.T) {
+	beginTime := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := clocktest.NewFakeClock(beginTime)
+	factory := NewFactory(&ClusterLimiterFactoryOpts{
+		Name: "test", Store: memory_store.NewStoreWithClock(clock), Clock: clock})
+	factory.Stop()
+
+	_, _ = factory.NewClusterLimiter(&ClusterLimiterOpts{Name: "p", RewardTarget: 100, PeriodInterval: time.Hour})
+	a, _ := factory.NewClusterLimiter(&ClusterLimiterOpts{Name: "a", RewardTarget: 40, PeriodInterval: time.Hour,
+		Parent: "p", Weight: 1})
+	b, _ := factory.NewClusterLimiter(&ClusterLimiterOpts{Name: "b", RewardTarget: 40, PeriodInterval: time.Hour,
+		Parent: "p", Weight: 1})
+
+	// at half of period a is on pace and b has spent nothing
+	clock.Advance(30 * time.Minute)
+	a.Reward(20)
+	factory.Heartbeat()
+	if math.Abs(a.GetRewardTarget()-70) > 1e-6 || math.Abs(b.GetRewardTarget()-30) > 1e-6 {
+		t.Fatal("unspent target should be moved to siblings", a.GetRewardTarget(), b.GetRewardTarget())
+	}
+}
+
+func TestClusterLimiterFactory_ParentExpire(t *testing.T) {
+	beginTime := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := clocktest.NewFakeClock(beginTime)
+	factory := NewFactory(&ClusterLimiterFactoryOpts{
+		Name: "test", Store: memory_store.NewStoreWithClock(clock), Clock: clock})
+	factory.Stop()
+
+	_, _ = factory.NewClusterLimiter(&ClusterLimiterOpts{Name: "p", RewardTarget: 100,
+		BeginTime: beginTime, EndTime: beginTime.Add(time.Hour)})
+	_, _ = factory.NewClusterLimiter(&ClusterLimiterOpts{Name: "c", RewardTarget: 10,
+		BeginTime: beginTime, EndTime: beginTime.Add(2 * time.Hour), Parent: "p"})
+
+	clock.Advance(time.Hour + time.Minute)
+	factory.Heartbeat()
+	if factory.GetClusterLimiter("p") == nil {
+		t.Fatal("expired parent should be kept for its children")
+	}
+
+	clock.Advance(time.Hour)
+	factory.Heartbeat()
+	factory.Heartbeat()
+	if factory.GetClusterLimiter("c") != nil || factory.GetClusterLimiter("p") != nil {
+		t.Fatal("parent should be removed after its children")
+	}
+}
@@ -0,0 +1,430 @@
+package cluster_limiter
+
+import (
+	"github.com/boostlearn/go-cluster-limiter/cluster_counter"
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+const DefaultFrontLoadedFactor = 2.0
+const DefaultTrafficShapeSlotSeconds = 3600
+const DefaultTrafficShapeCycleSeconds = 86400
+const DefaultTrafficShapeDeclineExpRatio = 0.5
+
+// schedule of spending reward target within [beginTime, completionTime]
+type PacingCurveI interface {
+	// share of reward target to be reached at t, non-decreasing from 0 at beginTime to 1 at completionTime
+	Progress(beginTime time.Time, completionTime time.Time, t time.Time) float64
+}
+
+// pacing curve learning from traffic, observed by limiter's heartbeat
+type TrafficObserverI interface {
+	Observe(t time.Time, requests float64)
+}
+
+// pacing curve with options checked when limiter is created
+type PacingValidatorI interface {
+	Validate() error
+}
+
+// pacing curve with state, each limiter created with it uses its own clone,
+// e.g. limiters of a vector or nodes of simulator sharing options
+type PacingCloneI interface {
+	Clone() PacingCurveI
+}
+
+// spend reward target evenly
+type LinearPacing struct{}
+
+func (pacing LinearPacing) Progress(beginTime time.Time, completionTime time.Time, t time.Time) float64 {
+	return cluster_counter.ClampProgress(float64(t.UnixNano()-beginTime.UnixNano()) /
+		float64(completionTime.UnixNano()-beginTime.UnixNano()))
+}
+
+// spend more of reward target early, progress is 1-(1-x)^Factor with x the elapsed share of time
+type FrontLoadedPacing struct {
+	Factor float64
+}
+
+func (pacing FrontLoadedPacing) Progress(beginTime time.Time, completionTime time.Time, t time.Time) float64 {
+	factor := pacing.Factor
+	if factor <= 0 {
+		factor = DefaultFrontLoadedFactor
+	}
+	x := LinearPacing{}.Progress(beginTime, completionTime, t)
+	return cluster_counter.ClampProgress(1 - math.Pow(1-x, factor))
+}
+
+// spend reward target in proportion to weights of slots, weights repeat every Slot * len(Weights),
+// aligned to local midnight of 1970-01-01, e.g. 24 weights of one hour for daily traffic.
+// options are read on first use
+type PiecewisePacing struct {
+	Slot    time.Duration
+	Weights []float64
+	// IANA name of time zone, default is UTC
+	TimeZone string
+
+	once  sync.Once
+	err   error
+	shape *slotShape
+}
+
+// check time zone
+func (pacing *PiecewisePacing) Validate() error {
+	pacing.once.Do(func() {
+		var location *time.Location
+		location, pacing.err = loadLocation(pacing.TimeZone)
+		pacing.shape = newSlotShape(pacing.Slot, pacing.Weights, location)
+	})
+	return pacing.err
+}
+
+func (pacing *PiecewisePacing) Progress(beginTime time.Time, completionTime time.Time, t time.Time) float64 {
+	_ = pacing.Validate()
+	return pacing.shape.progress(beginTime, completionTime, t)
+}
+
+// spend reward target following traffic shape learned from requests of previous cycles,
+// slots not observed yet count as average traffic. each limiter learns with its own clone
+type TrafficShapePacing struct {
+	Slot  time.Duration
+	Cycle time.Duration
+	// IANA name of time zone slots are aligned to, default is UTC
+	TimeZone        string
+	DeclineExpRatio float64
+
+	mu        sync.RWMutex
+	err       error
+	location  *time.Location
+	weights   []float64
+	observed  []bool
+	slotBegin time.Time
+	slotTime  time.Duration
+	slotCount float64
+	lastTime  time.Time
+	// learned weights prepared for Progress, rebuilt when a slot is learned
+	shape *slotShape
+}
+
+// same options without learned traffic
+func (pacing *TrafficShapePacing) Clone() PacingCurveI {
+	return &TrafficShapePacing{
+		Slot:            pacing.Slot,
+		Cycle:           pacing.Cycle,
+		TimeZone:        pacing.TimeZone,
+		DeclineExpRatio: pacing.DeclineExpRatio,
+	}
+}
+
+func (pacing *TrafficShapePacing) init() {
+	if pacing.weights != nil {
+		return
+	}
+	if pacing.Slot <= 0 {
+		pacing.Slot = DefaultTrafficShapeSlotSeconds * time.Second
+	}
+	if pacing.Cycle < pacing.Slot {
+		pacing.Cycle = DefaultTrafficShapeCycleSeconds * time.Second
+	}
+	if pacing.DeclineExpRatio <= 0 || pacing.DeclineExpRatio >= 1 {
+		pacing.DeclineExpRatio = DefaultTrafficShapeDeclineExpRatio
+	}
+	pacing.location, pacing.err = loadLocation(pacing.TimeZone)
+	slots := int(pacing.Cycle / pacing.Slot)
+	pacing.weights = make([]float64, slots)
+	pacing.observed = make([]bool, slots)
+	pacing.shape = newSlotShape(pacing.Slot, pacing.averageWeights(), pacing.location)
+}
+
+// check time zone
+func (pacing *TrafficShapePacing) Validate() error {
+	pacing.mu.Lock()
+	defer pacing.mu.Unlock()
+	pacing.init()
+
+	return pacing.err
+}
+
+// add requests arrived since last observation
+func (pacing *TrafficShapePacing) Observe(t time.Time, requests float64) {
+	pacing.mu.Lock()
+	defer pacing.mu.Unlock()
+	pacing.init()
+
+	if pacing.lastTime.IsZero() == false {
+		pacing.slotTime += t.Sub(pacing.lastTime)
+		pacing.slotCount += requests
+	}
+	pacing.lastTime = t
+
+	slotBegin := alignTime(t, pacing.Slot, pacing.location)
+	if slotBegin.Equal(pacing.slotBegin) == false {
+		pacing.finishSlot()
+		pacing.slotBegin = slotBegin
+		pacing.slotTime = 0
+		pacing.slotCount = 0
+	}
+}
+
+// learn traffic of finished slot, called with lock held
+func (pacing *TrafficShapePacing) finishSlot() {
+	if pacing.slotBegin.IsZero() || pacing.slotTime < pacing.Slot/2 {
+		return
+	}
+
+	pos := slotIndex(pacing.slotBegin, pacing.Slot, len(pacing.weights), pacing.location)
+	rate := pacing.slotCount / pacing.slotTime.Seconds()
+	if pacing.observed[pos] {
+		pacing.weights[pos] = pacing.weights[pos]*pacing.DeclineExpRatio + rate*(1-pacing.DeclineExpRatio)
+	} else {
+		pacing.weights[pos] = rate
+		pacing.observed[pos] = true
+	}
+	pacing.shape = newSlotShape(pacing.Slot, pacing.averageWeights(), pacing.location)
+}
+
+// learned traffic of slots, average for slots not observed yet
+func (pacing *TrafficShapePacing) Weights() []float64 {
+	pacing.mu.RLock()
+	defer pacing.mu.RUnlock()
+
+	if pacing.weights == nil {
+		return nil
+	}
+	return pacing.averageWeights()
+}
+
+// learned weights with average for slots not observed yet, called with lock held
+func (pacing *TrafficShapePacing) averageWeights() []float64 {
+	var sum float64
+	var num int
+	for i, w := range pacing.weights {
+		if pacing.observed[i] {
+			sum += w
+			num++
+		}
+	}
+	weights := make([]float64, len(pacing.weights))
+	for i, w := range pacing.weights {
+		if pacing.observed[i] {
+			weights[i] = w
+		} else if num > 0 {
+			weights[i] = sum / float64(num)
+		} else {
+			weights[i] = 1
+		}
+	}
+	return weights
+}
+
+func (pacing *TrafficShapePacing) Progress(beginTime time.Time, completionTime time.Time, t time.Time) float64 {
+	pacing.mu.RLock()
+	shape := pacing.shape
+	pacing.mu.RUnlock()
+
+	if shape == nil {
+		pacing.mu.Lock()
+		pacing.init()
+		shape = pacing.shape
+		pacing.mu.Unlock()
+	}
+	return shape.progress(beginTime, completionTime, t)
+}
+
+// weights of slots repeating every cycle with their prefix sums, not changed once built
+type slotShape struct {
+	slot     time.Duration
+	weights  []float64
+	prefix   []float64 // sums of weights before each slot, the last one is of the whole cycle
+	location *time.Location
+}
+
+// nil if there are no slots, progress of nil shape is linear
+func newSlotShape(slot time.Duration, weights []float64, loc *time.Location) *slotShape {
+	if slot <= 0 || len(weights) == 0 {
+		return nil
+	}
+	if loc == nil {
+		loc = time.UTC
+	}
+
+	shape := &slotShape{
+		slot:     slot,
+		weights:  append([]float64{}, weights...),
+		prefix:   make([]float64, len(weights)+1),
+		location: loc,
+	}
+	for i, w := range weights {
+		shape.prefix[i+1] = shape.prefix[i] + w
+	}
+	return shape
+}
+
+// progress of piecewise constant rate, linear if weights are all zero within the range
+func (shape *slotShape) progress(beginTime time.Time, completionTime time.Time, t time.Time) float64 {
+	if shape == nil {
+		return LinearPacing{}.Progress(beginTime, completionTime, t)
+	}
+
+	total := shape.integral(beginTime, completionTime)
+	if total <= 0 {
+		return LinearPacing{}.Progress(beginTime, completionTime, t)
+	}
+	return cluster_counter.ClampProgress(shape.integral(beginTime, t) / total)
+}
+
+// integral of weights over absolute time within [beginTime, endTime], in weight * slot.
+// the slot of each instant is looked up by local wall clock, so an hour repeated when clocks
+// go back counts twice and a skipped hour does not count
+func (shape *slotShape) integral(beginTime time.Time, endTime time.Time) float64 {
+	if endTime.Before(beginTime) {
+		return -shape.integral(endTime, beginTime)
+	}
+
+	var integral float64
+	for t := beginTime; ; {
+		_, offset := t.In(shape.location).Zone()
+		next := nextZoneTransition(shape.location, t, endTime)
+		x := time.Duration(offset) * time.Second
+		integral += shape.localIntegral(time.Duration(next.UnixNano())+x) -
+			shape.localIntegral(time.Duration(t.UnixNano())+x)
+		if next.Equal(endTime) {
+			return integral
+		}
+		t = next
+	}
+}
+
+// integral of weights from midnight of 1970-01-01 to local time x, as if the offset of location never changed
+func (shape *slotShape) localIntegral(x time.Duration) float64 {
+	cycle := shape.slot * time.Duration(len(shape.weights))
+
+	cycles := x / cycle
+	rest := x % cycle
+	if rest < 0 {
+		cycles--
+		rest += cycle
+	}
+
+	pos := int(rest / shape.slot)
+	return float64(cycles)*shape.prefix[len(shape.weights)] + shape.prefix[pos] +
+		shape.weights[pos]*float64(rest%shape.slot)/float64(shape.slot)
+}
+
+// changes of offset of each location, found once a year and kept
+var zoneTransitions sync.Map
+
+type locationTransitions struct {
+	mu    sync.RWMutex
+	years map[int][]time.Time
+}
+
+// first change of loc's offset after t, endTime if none before it
+func nextZoneTransition(loc *time.Location, t time.Time, endTime time.Time) time.Time {
+	if loc == time.UTC {
+		return endTime
+	}
+	for year := t.UTC().Year(); year <= endTime.UTC().Year(); year++ {
+		transitions := yearZoneTransitions(loc, year)
+		pos := sort.Search(len(transitions), func(i int) bool {
+			return transitions[i].After(t)
+		})
+		if pos < len(transitions) {
+			if transitions[pos].Before(endTime) {
+				return transitions[pos]
+			}
+			return endTime
+		}
+	}
+	return endTime
+}
+
+// changes of loc's offset within a year of UTC, at most one a day is found
+func yearZoneTransitions(loc *time.Location, year int) []time.Time {
+	v, ok := zoneTransitions.Load(loc)
+	if ok == false {
+		v, _ = zoneTransitions.LoadOrStore(loc, &locationTransitions{years: make(map[int][]time.Time)})
+	}
+	cache := v.(*locationTransitions)
+	cache.mu.RLock()
+	transitions, ok := cache.years[year]
+	cache.mu.RUnlock()
+	if ok {
+		return transitions
+	}
+
+	zoneOffset := func(sec int64) int {
+		_, offset := time.Unix(sec, 0).In(loc).Zone()
+		return offset
+	}
+
+	begin := time.Date(year, 1, 1, 0, 0, 0, 0, time.UTC).Unix()
+	end := time.Date(year+1, 1, 1, 0, 0, 0, 0, time.UTC).Unix()
+	offset := zoneOffset(begin)
+	for day := begin; day < end; day += 86400 {
+		nextOffset := zoneOffset(day + 86400)
+		if nextOffset == offset {
+			continue
+		}
+
+		// offset changes at first second of hi
+		lo, hi := day, day+86400
+		for hi-lo > 1 {
+			mid := (lo + hi) / 2
+			if zoneOffset(mid) == offset {
+				lo = mid
+			} else {
+				hi = mid
+			}
+		}
+		transitions = append(transitions, time.Unix(hi, 0))
+		offset = nextOffset
+	}
+
+	cache.mu.Lock()
+	cache.years[year] = transitions
+	cache.mu.Unlock()
+	return transitions
+}
+
+// index of slot containing t
+func slotIndex(t time.Time, slot time.Duration, slots int, loc *time.Location) int {
+	pos := int((localOffset(t, loc) / slot) % time.Duration(slots))
+	if pos < 0 {
+		pos += slots
+	}
+	return pos
+}
+
+// begin of slot containing t
+func alignTime(t time.Time, slot time.Duration, loc *time.Location) time.Time {
+	x := localOffset(t, loc)
+	rest := x % slot
+	if rest < 0 {
+		rest += slot
+	}
+	return t.Add(-rest)
+}
+
+// location of IANA name, UTC if name is empty or unknown
+func loadLocation(timeZone string) (*time.Location, error) {
+	if len(timeZone) == 0 {
+		return time.UTC, nil
+	}
+	location, err := time.LoadLocation(timeZone)
+	if err != nil {
+		return time.UTC, err
+	}
+	return location, nil
+}
+
+// duration since midnight of 1970-01-01 in loc
+func localOffset(t time.Time, loc *time.Location) time.Duration {
+	if loc == nil {
+		loc = time.UTC
+	}
+	_, offset := t.In(loc).Zone()
+	return time.Duration(t.UnixNano()) + time.Duration(offset)*time.Second
+}
@@ -0,0 +1,129 @@
+package cluster_limiter
+
+import (
+	"github.com/boostlearn/go-cluster-limiter/cluster_counter/clocktest"
+	"math"
+	"testing"
+	"time"
+)
+
+func TestPacingCurve_Progress(t *testing.T) {
+	beginTime := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	endTime := beginTime.Add(24 * time.Hour)
+
+	if p := (LinearPacing{}).Progress(beginTime, endTime, beginTime.Add(6*time.Hour)); p != 0.25 {
+		t.Fatal("linear progress error", p)
+	}
+	if p := (FrontLoadedPacing{}).Progress(beginTime, endTime, beginTime.Add(12*time.Hour)); p != 0.75 {
+		t.Fatal("front loaded progress error", p)
+	}
+
+	piecewise := &PiecewisePacing{Slot: 12 * time.Hour, Weights: []float64{0, 1}}
+	if p := piecewise.Progress(beginTime, endTime, beginTime.Add(12*time.Hour)); p != 0 {
+		t.Fatal("piecewise progress error", p)
+	}
+	if p := piecewise.Progress(beginTime, endTime, beginTime.Add(18*time.Hour)); p != 0.5 {
+		t.Fatal("piecewise progress error", p)
+	}
+
+	piecewise = &PiecewisePacing{Slot: 12 * time.Hour, Weights: []float64{0, 1}, TimeZone: "Asia/Shanghai"}
+	if p := piecewise.Progress(beginTime, endTime, beginTime.Add(10*time.Hour)); p != 0.5 {
+		t.Fatal("piecewise progress should be aligned in location", p)
+	}
+
+	// traffic of the second half of day is twice of the first half
+	shape := &TrafficShapePacing{Slot: time.Hour}
+	for ts := beginTime; ts.Before(beginTime.Add(48 * time.Hour)); ts = ts.Add(time.Minute) {
+		requests := 60.0
+		if ts.Hour() >= 12 {
+			requests = 120
+		}
+		shape.Observe(ts, requests)
+	}
+	if p := shape.Progress(endTime, endTime.Add(24*time.Hour), endTime.Add(12*time.Hour)); math.Abs(p-1.0/3) > 0.01 {
+		t.Fatal("progress should follow traffic shape", p)
+	}
+	if allocs := testing.AllocsPerRun(100, func() {
+		shape.Progress(endTime, endTime.Add(24*time.Hour), endTime.Add(12*time.Hour))
+	}); allocs != 0 {
+		t.Fatal("learned shape should be prepared for progress", allocs)
+	}
+}
+
+func TestPacingCurve_DaylightSaving(t *testing.T) {
+	location, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skip("no time zone data", err)
+	}
+
+	// traffic only between 01:00 and 03:00, the hour from 01:00 is repeated on 2020-11-01
+	weights := make([]float64, 24)
+	weights[1], weights[2] = 1, 1
+	pacing := &PiecewisePacing{Slot: time.Hour, Weights: weights, TimeZone: "America/New_York"}
+	for _, day := range []time.Time{
+		time.Date(2020, 11, 1, 0, 0, 0, 0, location),
+		time.Date(2020, 3, 8, 0, 0, 0, 0, location),
+	} {
+		beginTime, endTime := day, day.AddDate(0, 0, 1)
+		var last float64
+		for ts := beginTime; ts.Before(endTime); ts = ts.Add(time.Minute) {
+			p := pacing.Progress(beginTime, endTime, ts)
+			if p < last {
+				t.Fatal("progress should not decrease", ts, p, last)
+			}
+			last = p
+		}
+	}
+
+	beginTime := time.Date(2020, 11, 1, 0, 0, 0, 0, location)
+	endTime := beginTime.AddDate(0, 0, 1)
+	if p := pacing.Progress(beginTime, endTime, beginTime.Add(3*time.Hour)); math.Abs(p-2.0/3) > 1e-9 {
+		t.Fatal("repeated hour should count twice", p)
+	}
+	if allocs := testing.AllocsPerRun(100, func() {
+		pacing.Progress(beginTime, endTime, beginTime.Add(2*time.Hour))
+	}); allocs != 0 {
+		t.Fatal("zone transitions should be kept", allocs)
+	}
+}
+
+func TestClusterLimiter_PacingCurve(t *testing.T) {
+	clock := clocktest.NewFakeClock(time.Date(2020, 1, 1, 18, 0, 0, 0, time.UTC))
+	factory := NewFactory(&ClusterLimiterFactoryOpts{Name: "test", Clock: clock})
+	factory.Stop()
+
+	linear, _ := factory.NewClusterLimiter(&ClusterLimiterOpts{
+		Name: "linear", RewardTarget: 1000, PeriodInterval: 24 * time.Hour})
+	piecewise, _ := factory.NewClusterLimiter(&ClusterLimiterOpts{
+		Name: "piecewise", RewardTarget: 1000, PeriodInterval: 24 * time.Hour,
+		PacingCurve: &PiecewisePacing{Slot: 12 * time.Hour, Weights: []float64{0, 1}}})
+
+	if linear.IdealReward() != 750 || piecewise.IdealReward() != 500 {
+		t.Fatal("ideal reward error", linear.IdealReward(), piecewise.IdealReward())
+	}
+
+	// reward of 250 is reached at 06:00 by linear pacing and at 15:00 by piecewise pacing
+	if lag := linear.LagTime(250, clock.Now()); math.Abs(lag-12*3600) > 1 {
+		t.Fatal("linear lag time error", lag)
+	}
+	if lag := piecewise.LagTime(250, clock.Now()); math.Abs(lag-3*3600) > 1 {
+		t.Fatal("piecewise lag time error", lag)
+	}
+}
+
+func TestClusterLimiterVec_PacingClone(t *testing.T) {
+	factory := NewFactory(&ClusterLimiterFactoryOpts{Name: "test"})
+	factory.Stop()
+
+	shape := &TrafficShapePacing{Slot: time.Hour}
+	limiterVec, _ := factory.NewClusterLimiterVec(&ClusterLimiterOpts{
+		Name: "shape", RewardTarget: 1000, PeriodInterval: 24 * time.Hour, PacingCurve: shape}, []string{"a"}, nil)
+	first := limiterVec.WithLabelValues([]string{"1"}).PacingCurve()
+	second := limiterVec.WithLabelValues([]string{"2"}).PacingCurve()
+	if first == PacingCurveI(shape) || first == second {
+		t.Fatal("limiters should learn with their own curves")
+	}
+	if clone, ok := first.(*TrafficShapePacing); ok == false || clone.Slot != time.Hour {
+		t.Fatal("clone should keep options", first)
+	}
+}
@@ -0,0 +1,91 @@
+package cluster_limiter
+
+import (
+	"github.com/boostlearn/go-cluster-limiter/cluster_counter"
+	"time"
+)
+
+// rewards of a period are kept in store this long after the period and its attribution window end
+const DefaultPeriodRewardRetentionSeconds = 86400
+
+// local rewards credited to one period, not stored yet
+type periodReward struct {
+	beginTime time.Time
+	endTime   time.Time
+	value     cluster_counter.CounterValue
+}
+
+// name of rewards by period in store, a window per period holds its on-time and late rewards
+func (limiter *ClusterLimiter) periodRewardName() string {
+	return limiter.factory.name + limiter.Options.Name + ":period_reward"
+}
+
+// name of rollover settled by period in store, sum is rollover into the period and count identifies settling node
+func (limiter *ClusterLimiter) settlementName() string {
+	return limiter.factory.name + limiter.Options.Name + ":settlement"
+}
+
+// name of periods opened by any node in store
+func (limiter *ClusterLimiter) periodOpenName() string {
+	return limiter.factory.name + limiter.Options.Name + ":period_open"
+}
+
+// how long rewards of period [beginTime, endTime) are kept in store
+func (limiter *ClusterLimiter) periodRewardRetention(beginTime time.Time, endTime time.Time) time.Duration {
+	return endTime.Sub(beginTime) + limiter.attributionWindow + DefaultPeriodRewardRetentionSeconds*time.Second
+}
+
+// add local reward credited to period [beginTime, endTime), stored later
+func (limiter *ClusterLimiter) addPeriodReward(beginTime time.Time, endTime time.Time, value cluster_counter.CounterValue) {
+	limiter.rewardMu.Lock()
+	defer limiter.rewardMu.Unlock()
+
+	if limiter.pendingRewards == nil {
+		limiter.pendingRewards = make(map[int64]*periodReward)
+	}
+	if pending, ok := limiter.pendingRewards[beginTime.UnixNano()]; ok {
+		pending.value = pending.value.Add(value)
+		return
+	}
+	limiter.pendingRewards[beginTime.UnixNano()] = &periodReward{beginTime: beginTime, endTime: endTime, value: value}
+}
+
+// move local on-time reward since last call into current period, called with lock held
+func (limiter *ClusterLimiter) collectPeriodReward() {
+	cur, _ := limiter.RewardCounter.LocalValue(0)
+	delta := cur.Sub(limiter.collectedReward)
+	limiter.collectedReward = cur
+	if delta.Sum != 0 || delta.Count != 0 {
+		limiter.addPeriodReward(limiter.beginTime, limiter.endTime, delta)
+	}
+}
+
+// add local rewards of periods into store.
+// transient failure stays in journal and is replayed on next startup
+func (limiter *ClusterLimiter) storePeriodRewards() {
+	limiter.rewardMu.Lock()
+	pending := limiter.pendingRewards
+	limiter.pendingRewards = nil
+	limiter.rewardMu.Unlock()
+
+	name := limiter.periodRewardName()
+	for _, reward := range pending {
+		_ = limiter.factory.counterFactory.StoreHistory(name, limiter.labels, reward.beginTime,
+			limiter.periodRewardRetention(reward.beginTime, reward.endTime), reward.value)
+	}
+}
+
+// rewards of cluster credited to period [beginTime, endTime), including late ones
+func (limiter *ClusterLimiter) loadPeriodReward(beginTime time.Time, endTime time.Time) (cluster_counter.CounterValue, error) {
+	return limiter.loadPeriodValue(limiter.periodRewardName(), beginTime, endTime)
+}
+
+// value of period [beginTime, endTime) in store, kept as long as its rewards
+func (limiter *ClusterLimiter) loadPeriodValue(name string, beginTime time.Time, endTime time.Time) (cluster_counter.CounterValue, error) {
+	values, err := limiter.factory.counterFactory.LoadHistory(name, limiter.labels, beginTime,
+		endTime.Sub(beginTime), limiter.periodRewardRetention(beginTime, endTime), 1)
+	if err != nil {
+		return cluster_counter.CounterValue{}, err
+	}
+	return values[0], nil
+}
@@ -0,0 +1,71 @@
+package cluster_limiter
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// pass reserved by Reserve, finished by Commit or Cancel once
+type Reservation struct {
+	limiter  *ClusterLimiter
+	value    float64
+	passTime time.Time
+	done     int32
+}
+
+// reserve a pass, nil if request is not passed
+// the pass is counted at once and taken back from limiter and its ancestors if cancelled
+func (limiter *ClusterLimiter) Reserve(v float64) *Reservation {
+	if limiter.Take(v) == false {
+		return nil
+	}
+	return &Reservation{limiter: limiter, value: v, passTime: limiter.now()}
+}
+
+// reserve a pass with score, nil if request is not passed
+func (limiter *ClusterLimiter) ReserveWithScore(v float64, score float64) *Reservation {
+	if limiter.TakeWithScore(v, score) == false {
+		return nil
+	}
+	return &Reservation{limiter: limiter, value: v, passTime: limiter.now()}
+}
+
+// value of reserved pass
+func (reservation *Reservation) Value() float64 {
+	return reservation.value
+}
+
+// keep the pass and feed back reward, no reward if reward is 0
+func (reservation *Reservation) Commit(reward float64) bool {
+	if atomic.CompareAndSwapInt32(&reservation.done, 0, 1) == false {
+		return false
+	}
+
+	if reward != 0 {
+		reservation.limiter.Reward(reward)
+	}
+	return true
+}
+
+// give back the pass, so it is neither counted as pass nor used to estimate reward rate.
+// a pass of a period which has ended is not given back
+func (reservation *Reservation) Cancel() bool {
+	if atomic.CompareAndSwapInt32(&reservation.done, 0, 1) == false {
+		return false
+	}
+
+	for limiter := reservation.limiter; limiter != nil; limiter = limiter.parent {
+		if limiter.inPeriod(reservation.passTime) {
+			limiter.PassCounter.Refund(reservation.value, reservation.passTime)
+		}
+	}
+	return true
+}
+
+// whether t is within current period of limiter
+func (limiter *ClusterLimiter) inPeriod(t time.Time) bool {
+	limiter.mu.RLock()
+	defer limiter.mu.RUnlock()
+
+	return t.Before(limiter.beginTime) == false && t.After(limiter.endTime) == false
+}
@@ -0,0 +1,62 @@
+package cluster_limiter
+
+import (
+	"github.com/boostlearn/go-cluster-limiter/cluster_counter/clocktest"
+	"github.com/boostlearn/go-cluster-limiter/cluster_counter/memory_store"
+	"testing"
+	"time"
+)
+
+func TestReservation_CommitAndCancel(t *testing.T) {
+	clock := clocktest.NewFakeClock(time.Date(2020, 1, 1, 0, 30, 0, 0, time.UTC))
+	store := memory_store.NewStoreWithClock(clock)
+	factory := NewFactory(&ClusterLimiterFactoryOpts{Name: "test", Store: store, Clock: clock})
+	factory.Stop()
+
+	parent, _ := factory.NewClusterLimiter(&ClusterLimiterOpts{
+		Name: "p", RewardTarget: 100, PeriodInterval: time.Hour, InitPassRate: 1})
+	limiter, _ := factory.NewClusterLimiter(&ClusterLimiterOpts{
+		Name: "c", RewardTarget: 100, PeriodInterval: time.Hour, InitPassRate: 1, Parent: "p"})
+	factory.Heartbeat()
+
+	cancelled := limiter.Reserve(1)
+	committed := limiter.Reserve(1)
+	if cancelled == nil || committed == nil {
+		t.Fatal("request should be passed")
+	}
+
+	if cancelled.Cancel() == false || cancelled.Cancel() || cancelled.Commit(1) {
+		t.Fatal("reservation should be finished once")
+	}
+	committed.Commit(1)
+
+	for _, l := range []*ClusterLimiter{limiter, parent} {
+		if v, _ := l.PassCounter.LocalValue(0); v.Count != 1 || v.Sum != 1 {
+			t.Fatal("cancelled pass should be taken back", v)
+		}
+		if v, _ := l.RewardCounter.LocalValue(0); v.Sum != 1 {
+			t.Fatal("committed reward error", v)
+		}
+	}
+
+	// refund after the pass is stored is pushed as a negative value
+	clock.Advance(10 * time.Second)
+	factory.Heartbeat()
+	limiter.Reserve(1).Cancel()
+	clock.Advance(10 * time.Second)
+	factory.Heartbeat()
+	keys, _ := store.ListKeys("testc:pass")
+	if v, _ := store.Load(keys[0].Name, keys[0].BeginTime, keys[0].EndTime, nil); v.Count != 1 || v.Sum != 1 {
+		t.Fatal("stored pass error", v)
+	}
+
+	// pass of previous period is not taken back from the new one
+	reservation := limiter.Reserve(1)
+	clock.Advance(time.Hour)
+	factory.Heartbeat()
+	before, _ := limiter.PassCounter.LocalValue(0)
+	reservation.Cancel()
+	if v, _ := limiter.PassCounter.LocalValue(0); v != before {
+		t.Fatal("refund across periods should be dropped", v, before)
+	}
+}
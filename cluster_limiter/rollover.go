@@ -0,0 +1,271 @@
+package cluster_limiter
+
+import (
+	"github.com/boostlearn/go-cluster-limiter/cluster_counter"
+	"hash/fnv"
+	"math"
+	"reflect"
+	"time"
+)
+
+const MaxFlightPeriods = 100000
+
+// how the difference between reward target and reward of a period is moved into following periods
+type RolloverOpts struct {
+	// carry unspent reward target into following periods
+	CarryUnspent bool
+	// at most this share of reward target is carried from one period, unlimited if 0
+	MaxCarryRatio float64
+	// subtract overspend from following periods
+	SubtractOverspend bool
+	// spread difference evenly across periods before the end of flight, next period only if not set
+	FlightEndTime time.Time
+}
+
+// result of one finished period, for reconciliation
+type PeriodRecord struct {
+	Name      string
+	Labels    []string
+	BeginTime time.Time
+	EndTime   time.Time
+	// reward target set by user
+	BaseRewardTarget float64
+	// reward target including rollover of previous periods
+	RewardTarget float64
+	// reward of cluster credited to period, including rewards attributed after it ends
+	Reward float64
+	// moved into following periods, negative for overspend
+	Rollover float64
+}
+
+// receiver of period records, called once per cluster after each period of a limiter ends and its attribution
+// window passes, by the node whose settlement is stored first. every node records if store is unavailable
+type PeriodRecorderI interface {
+	Record(record *PeriodRecord)
+}
+
+// reward target of current period, called with lock held
+func (limiter *ClusterLimiter) periodTarget() float64 {
+	target := limiter.baseRewardTarget + limiter.rolloverTarget
+	if target < 0 {
+		return 0
+	}
+	return target
+}
+
+// result of current period estimated from cluster's reward so far, called with lock held before next period begins
+func (limiter *ClusterLimiter) closePeriod() *PeriodRecord {
+	cur, _ := limiter.RewardCounter.ClusterValue(0)
+	return &PeriodRecord{
+		Name:             limiter.name,
+		Labels:           limiter.lbs,
+		BeginTime:        limiter.beginTime,
+		EndTime:          limiter.endTime,
+		BaseRewardTarget: limiter.baseRewardTarget,
+		RewardTarget:     limiter.periodTarget(),
+		Reward:           cur.Sum - limiter.periodRewardBase.Sum,
+	}
+}
+
+// store rewards of periods, and settle closed periods whose attribution window has passed with their rewards
+// in store, late ones included. the difference is rolled over into the period following each of them
+func (limiter *ClusterLimiter) settlePeriods() {
+	if cluster_counter.Periodic(limiter.periodInterval, limiter.schedule) == false || limiter.factory == nil || limiter.factory.counterFactory == nil {
+		return
+	}
+
+	limiter.mu.Lock()
+	timeNow := limiter.now()
+	var due []*PeriodRecord
+	for len(limiter.unsettled) > 0 && timeNow.After(limiter.unsettled[0].EndTime.Add(limiter.attributionWindow)) {
+		due = append(due, limiter.unsettled[0])
+		limiter.unsettled = limiter.unsettled[1:]
+	}
+	if len(due) == 0 && timeNow.Before(limiter.lastRewardStoreTime.Add(limiter.Options.BurstInterval)) {
+		limiter.mu.Unlock()
+		return
+	}
+	limiter.lastRewardStoreTime = timeNow
+	limiter.collectPeriodReward()
+	beginTime, endTime := limiter.beginTime, limiter.endTime
+	openedBeginTime := limiter.openedBeginTime
+	limiter.openedBeginTime = beginTime
+	limiter.mu.Unlock()
+
+	limiter.storePeriodRewards()
+	if openedBeginTime.Equal(beginTime) == false {
+		if openedBeginTime.IsZero() {
+			due = append(limiter.restorePeriod(beginTime, endTime), due...)
+		}
+		_ = limiter.factory.counterFactory.StoreHistory(limiter.periodOpenName(), limiter.labels, beginTime,
+			limiter.periodRewardRetention(beginTime, endTime), cluster_counter.CounterValue{Count: 1})
+	}
+
+	for _, record := range due {
+		// estimate at close is kept if store fails
+		if value, err := limiter.loadPeriodReward(record.BeginTime, record.EndTime); err == nil {
+			record.Reward = value.Sum
+		}
+		nextBeginTime, nextEndTime := limiter.period(record.EndTime)
+		limiter.settle(record, nextBeginTime, nextEndTime)
+	}
+	limiter.loadRollover(beginTime, endTime)
+}
+
+// record of the period before current one if it was opened by some node but is not settled yet,
+// so a restarted node settles it in place of its lost record
+func (limiter *ClusterLimiter) restorePeriod(beginTime time.Time, endTime time.Time) []*PeriodRecord {
+	if value, err := limiter.loadPeriodValue(limiter.settlementName(), beginTime, endTime); err != nil || value.Count != 0 {
+		return nil
+	}
+	prevBeginTime, prevEndTime, ok := limiter.previousPeriod(beginTime)
+	if ok == false {
+		return nil
+	}
+	if value, err := limiter.loadPeriodValue(limiter.periodOpenName(), prevBeginTime, prevEndTime); err != nil || value.Count == 0 {
+		return nil
+	}
+
+	limiter.mu.RLock()
+	defer limiter.mu.RUnlock()
+	return []*PeriodRecord{{
+		Name:             limiter.name,
+		Labels:           limiter.lbs,
+		BeginTime:        prevBeginTime,
+		EndTime:          prevEndTime,
+		BaseRewardTarget: limiter.baseRewardTarget,
+		RewardTarget:     limiter.baseRewardTarget,
+	}}
+}
+
+// period ending not after beginTime, searched back a week for schedules
+func (limiter *ClusterLimiter) previousPeriod(beginTime time.Time) (time.Time, time.Time, bool) {
+	for days := 0; days <= 7; days++ {
+		prevBeginTime, prevEndTime := limiter.period(beginTime.Add(-time.Nanosecond).AddDate(0, 0, -days))
+		if prevEndTime.After(beginTime) == false && prevEndTime.After(prevBeginTime) {
+			return prevBeginTime, prevEndTime, true
+		}
+	}
+	return time.Time{}, time.Time{}, false
+}
+
+// settle closed period with rollover stored for it, and set rollover of the period [nextBeginTime, nextEndTime)
+// if absent. the first node setting it wins, so nodes agree on it and only the winner records the period
+func (limiter *ClusterLimiter) settle(record *PeriodRecord, nextBeginTime time.Time, nextEndTime time.Time) {
+	hasStore := limiter.factory != nil && limiter.factory.counterFactory != nil
+	rollover := record.RewardTarget - record.BaseRewardTarget
+	if hasStore {
+		if value, err := limiter.loadPeriodValue(limiter.settlementName(), record.BeginTime, record.EndTime); err == nil {
+			rollover = value.Sum
+			record.RewardTarget = math.Max(0, record.BaseRewardTarget+rollover)
+		}
+	}
+
+	var nextRollover float64
+	if opts := limiter.Options.Rollover; opts != nil {
+		diff := record.RewardTarget - record.Reward
+		if (diff > 0 && opts.CarryUnspent == false) || (diff < 0 && opts.SubtractOverspend == false) {
+			diff = 0
+		}
+		if diff > 0 && opts.MaxCarryRatio > 0 && diff > opts.MaxCarryRatio*record.BaseRewardTarget {
+			diff = opts.MaxCarryRatio * record.BaseRewardTarget
+		}
+		record.Rollover = diff
+
+		// rollover of the period is its even share of balance left in flight, the rest is still left after it
+		balance := rollover * float64(limiter.remainingPeriods(record.BeginTime)-1)
+		nextRollover = (balance + diff) / float64(limiter.remainingPeriods(nextBeginTime))
+	}
+
+	var nodeHash int64
+	settlement := cluster_counter.CounterValue{Sum: nextRollover}
+	if hasStore {
+		nodeHash = limiter.nodeHash()
+		settlement.Count = nodeHash
+		// settlement is set once per cluster, the first node setting it wins
+		stored, err := limiter.factory.counterFactory.SetHistoryIfAbsent(limiter.settlementName(), limiter.labels,
+			nextBeginTime, limiter.periodRewardRetention(nextBeginTime, nextEndTime), settlement)
+		// each node settles on its own if store fails
+		if err == nil && stored.Count != 0 {
+			settlement = stored
+		}
+	}
+
+	limiter.mu.Lock()
+	if limiter.Options.Rollover != nil && limiter.beginTime.Equal(nextBeginTime) {
+		limiter.applyRollover(settlement.Sum)
+	}
+	limiter.mu.Unlock()
+
+	if settlement.Count == nodeHash {
+		limiter.recordPeriod(record)
+	}
+}
+
+// apply rollover of current period settled by any node, until it is found in store
+func (limiter *ClusterLimiter) loadRollover(beginTime time.Time, endTime time.Time) {
+	limiter.mu.RLock()
+	loaded := limiter.rolloverLoaded || limiter.Options.Rollover == nil
+	limiter.mu.RUnlock()
+	if loaded {
+		return
+	}
+
+	value, err := limiter.loadPeriodValue(limiter.settlementName(), beginTime, endTime)
+	if err != nil || value.Count == 0 {
+		return
+	}
+	limiter.mu.Lock()
+	if limiter.beginTime.Equal(beginTime) {
+		limiter.applyRollover(value.Sum)
+	}
+	limiter.mu.Unlock()
+}
+
+// set rollover of current period, called with lock held
+func (limiter *ClusterLimiter) applyRollover(rollover float64) {
+	limiter.rolloverTarget = rollover
+	limiter.rewardTarget = limiter.periodTarget()
+	limiter.rolloverLoaded = true
+}
+
+// identifies node in settlement, never 0
+func (limiter *ClusterLimiter) nodeHash() int64 {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(limiter.factory.counterFactory.NodeID()))
+	return int64(h.Sum32()) + 1
+}
+
+// number of periods from beginTime to the end of flight, at least 1
+func (limiter *ClusterLimiter) remainingPeriods(beginTime time.Time) int {
+	flightEndTime := limiter.Options.Rollover.FlightEndTime
+	periods := 0
+	for t := beginTime; t.Before(flightEndTime) && periods < MaxFlightPeriods; periods++ {
+		_, endTime := limiter.period(t)
+		if endTime.After(t) == false {
+			break
+		}
+		t = endTime
+	}
+	if periods == 0 {
+		return 1
+	}
+	return periods
+}
+
+// target moved into current period from previous ones
+func (limiter *ClusterLimiter) RolloverTarget() float64 {
+	limiter.mu.RLock()
+	defer limiter.mu.RUnlock()
+
+	return limiter.rolloverTarget
+}
+
+// send record to factory's recorder
+func (limiter *ClusterLimiter) recordPeriod(record *PeriodRecord) {
+	if record == nil || limiter.factory == nil || limiter.factory.PeriodRecorder == nil ||
+		reflect.ValueOf(limiter.factory.PeriodRecorder).IsNil() {
+		return
+	}
+	limiter.factory.PeriodRecorder.Record(record)
+}
@@ -0,0 +1,180 @@
+package cluster_limiter
+
+import (
+	"github.com/boostlearn/go-cluster-limiter/cluster_counter"
+	"github.com/boostlearn/go-cluster-limiter/cluster_counter/breaker_store"
+	"github.com/boostlearn/go-cluster-limiter/cluster_counter/clocktest"
+	"github.com/boostlearn/go-cluster-limiter/cluster_counter/memory_store"
+	"math"
+	"testing"
+	"time"
+)
+
+type periodRecorderForTest struct {
+	records []*PeriodRecord
+}
+
+func (recorder *periodRecorderForTest) Record(record *PeriodRecord) {
+	recorder.records = append(recorder.records, record)
+}
+
+func TestClusterLimiter_Rollover(t *testing.T) {
+	beginTime := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := clocktest.NewFakeClock(beginTime)
+	recorder := &periodRecorderForTest{}
+	factory := NewFactory(&ClusterLimiterFactoryOpts{
+		Name: "test", Store: memory_store.NewStoreWithClock(clock), Clock: clock, PeriodRecorder: recorder})
+	factory.Stop()
+
+	limiter, err := factory.NewClusterLimiter(&ClusterLimiterOpts{Name: "r", RewardTarget: 100, PeriodInterval: time.Hour,
+		Rollover: &RolloverOpts{CarryUnspent: true, MaxCarryRatio: 0.5, SubtractOverspend: true}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// unspent 70 is carried up to half of target
+	limiter.Reward(30)
+	factory.Heartbeat()
+	clock.Advance(time.Hour + time.Second)
+	factory.Heartbeat()
+	if len(recorder.records) != 1 || recorder.records[0].Reward != 30 || recorder.records[0].Rollover != 50 {
+		t.Fatal("period record error", recorder.records)
+	}
+	if limiter.GetRewardTarget() != 150 {
+		t.Fatal("unspent target should be carried", limiter.GetRewardTarget())
+	}
+
+	// overspend 50 is subtracted
+	limiter.Reward(200)
+	factory.Heartbeat()
+	clock.Advance(time.Hour)
+	factory.Heartbeat()
+	if len(recorder.records) != 2 || recorder.records[1].RewardTarget != 150 || recorder.records[1].Rollover != -50 {
+		t.Fatal("period record error", recorder.records[1])
+	}
+	if limiter.GetRewardTarget() != 50 {
+		t.Fatal("overspend should be subtracted", limiter.GetRewardTarget())
+	}
+}
+
+func TestClusterLimiter_RolloverFlight(t *testing.T) {
+	beginTime := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := clocktest.NewFakeClock(beginTime)
+	factory := NewFactory(&ClusterLimiterFactoryOpts{
+		Name: "test", Store: memory_store.NewStoreWithClock(clock), Clock: clock})
+	factory.Stop()
+
+	limiter, _ := factory.NewClusterLimiter(&ClusterLimiterOpts{Name: "f", RewardTarget: 100, PeriodInterval: time.Hour,
+		Rollover: &RolloverOpts{CarryUnspent: true, FlightEndTime: beginTime.Add(4 * time.Hour)}})
+
+	// unspent target of the first period is spread across the other 3 periods
+	factory.Heartbeat()
+	clock.Advance(time.Hour + time.Second)
+	factory.Heartbeat()
+	if math.Abs(limiter.RolloverTarget()-100.0/3) > 1e-9 {
+		t.Fatal("unspent target should be spread across flight", limiter.RolloverTarget())
+	}
+
+	// the rest stays spread when the second period reaches its target
+	limiter.Reward(limiter.GetRewardTarget())
+	factory.Heartbeat()
+	clock.Advance(time.Hour)
+	factory.Heartbeat()
+	if math.Abs(limiter.RolloverTarget()-100.0/3) > 1e-6 {
+		t.Fatal("unspent target should be spread across flight", limiter.RolloverTarget())
+	}
+}
+
+func TestClusterLimiter_RolloverCluster(t *testing.T) {
+	beginTime := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := clocktest.NewFakeClock(beginTime)
+	store := memory_store.NewStoreWithClock(clock)
+	newNode := func(nodeID string, recorder *periodRecorderForTest) (*ClusterLimiterFactory, *ClusterLimiter) {
+		factory := NewFactory(&ClusterLimiterFactoryOpts{
+			Name: "test", Store: store, Clock: clock, NodeID: nodeID, PeriodRecorder: recorder})
+		factory.Stop()
+		limiter, _ := factory.NewClusterLimiter(&ClusterLimiterOpts{Name: "c", RewardTarget: 100, PeriodInterval: time.Hour,
+			Rollover: &RolloverOpts{CarryUnspent: true}})
+		return factory, limiter
+	}
+
+	// both nodes carry the same unspent target, and the period is recorded once
+	recorderA, recorderB := &periodRecorderForTest{}, &periodRecorderForTest{}
+	factoryA, limiterA := newNode("node-a", recorderA)
+	factoryB, limiterB := newNode("node-b", recorderB)
+	limiterA.Reward(20)
+	limiterB.Reward(10)
+	factoryA.Heartbeat()
+	factoryB.Heartbeat()
+	clock.Advance(time.Hour + time.Second)
+	factoryA.Heartbeat()
+	factoryB.Heartbeat()
+	if len(recorderA.records)+len(recorderB.records) != 1 {
+		t.Fatal("period should be recorded once", recorderA.records, recorderB.records)
+	}
+	if limiterA.GetRewardTarget() != 170 || limiterB.GetRewardTarget() != 170 {
+		t.Fatal("nodes should carry the same target", limiterA.GetRewardTarget(), limiterB.GetRewardTarget())
+	}
+
+	// a node started in the period applies rollover settled by others
+	factoryC, limiterC := newNode("node-c", nil)
+	factoryC.Heartbeat()
+	if limiterC.GetRewardTarget() != 170 {
+		t.Fatal("started node should load rollover", limiterC.GetRewardTarget())
+	}
+
+	// a node restarted after the period ends settles it in place of the lost record
+	limiterC.Reward(100)
+	clock.Advance(10 * time.Minute)
+	factoryC.Heartbeat()
+	clock.Advance(time.Hour)
+	recorderD := &periodRecorderForTest{}
+	factoryD, limiterD := newNode("node-d", recorderD)
+	factoryD.Heartbeat()
+	if len(recorderD.records) != 1 || recorderD.records[0].RewardTarget != 170 || recorderD.records[0].Reward != 100 ||
+		recorderD.records[0].Rollover != 70 {
+		t.Fatal("restarted node should settle previous period", recorderD.records)
+	}
+	if limiterD.GetRewardTarget() != 170 {
+		t.Fatal("restarted node should carry unspent target", limiterD.GetRewardTarget())
+	}
+}
+
+// store adding values only, e.g. one region of tiered store
+type addOnlyStoreForTest struct {
+	store cluster_counter.DataStoreI
+}
+
+func (store *addOnlyStoreForTest) Store(name string, beginTime time.Time, endTime time.Time, lbs map[string]string,
+	value cluster_counter.CounterValue, force bool) error {
+	return store.store.Store(name, beginTime, endTime, lbs, value, force)
+}
+
+func (store *addOnlyStoreForTest) Load(name string, beginTime time.Time, endTime time.Time, lbs map[string]string,
+) (cluster_counter.CounterValue, error) {
+	return store.store.Load(name, beginTime, endTime, lbs)
+}
+
+func TestClusterLimiter_RolloverStore(t *testing.T) {
+	opts := func() *ClusterLimiterOpts {
+		return &ClusterLimiterOpts{Name: "s", RewardTarget: 100, PeriodInterval: time.Hour,
+			Rollover: &RolloverOpts{CarryUnspent: true}}
+	}
+
+	addOnlyStore, _ := breaker_store.NewStore(&addOnlyStoreForTest{store: memory_store.NewStore()}, nil)
+	factory := NewFactory(&ClusterLimiterFactoryOpts{Name: "test", Store: addOnlyStore})
+	factory.Stop()
+	if _, err := factory.NewClusterLimiter(opts()); err == nil {
+		t.Fatal("rollover should need a store setting values if absent")
+	}
+	if _, err := factory.NewClusterLimiterVec(opts(), []string{"a"}, nil); err == nil {
+		t.Fatal("rollover should need a store setting values if absent")
+	}
+
+	store, _ := breaker_store.NewStore(memory_store.NewStore(), nil)
+	factory = NewFactory(&ClusterLimiterFactoryOpts{Name: "test", Store: store})
+	factory.Stop()
+	if _, err := factory.NewClusterLimiter(opts()); err != nil {
+		t.Fatal(err)
+	}
+}
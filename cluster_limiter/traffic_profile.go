@@ -0,0 +1,231 @@
+package cluster_limiter
+
+import (
+	"errors"
+	"github.com/boostlearn/go-cluster-limiter/cluster_counter"
+	"sync"
+	"time"
+)
+
+const DefaultTrafficProfileCycleSeconds = 86400
+const DefaultTrafficProfileHistory = 4
+const DefaultTrafficProfileDeclineExpRatio = 0.5
+const DefaultTrafficProfileSmoothSlots = 3
+
+// options of learning traffic profile from requests of previous cycles in store
+type TrafficProfileOpts struct {
+	// requests are counted in store per slot, e.g. 5 minutes
+	Slot time.Duration
+	// length of profile, e.g. one day or one week
+	Cycle time.Duration
+	// IANA name of time zone cycles are aligned to, default is UTC
+	TimeZone string
+	// number of previous cycles to learn from
+	History int
+	// weight of a cycle relative to the next one
+	DeclineExpRatio float64
+	// width of moving average over neighbouring slots
+	SmoothSlots int
+}
+
+// smoothed requests of each slot of cycle in cluster, used as pacing curve and to estimate pass rate
+type TrafficProfile struct {
+	opts     *TrafficProfileOpts
+	location *time.Location
+
+	mu    sync.RWMutex
+	shape *slotShape // nil if not ready
+
+	slotMu    sync.Mutex
+	slotBegin time.Time
+	slotValue cluster_counter.CounterValue
+	finished  []profileSlot
+}
+
+// local requests of one finished slot, to be stored as history
+type profileSlot struct {
+	beginTime time.Time
+	value     cluster_counter.CounterValue
+}
+
+// build profile used from timeNow on
+func newTrafficProfile(opts *TrafficProfileOpts, timeNow time.Time) (*TrafficProfile, error) {
+	if opts.Slot.Truncate(time.Second) <= 0 {
+		return nil, errors.New("traffic profile's slot not set")
+	}
+
+	if opts.Cycle == 0 {
+		opts.Cycle = DefaultTrafficProfileCycleSeconds * time.Second
+	}
+
+	if opts.Cycle < opts.Slot || opts.Cycle%opts.Slot != 0 {
+		return nil, errors.New("traffic profile's cycle should be multiple of slot")
+	}
+
+	if opts.History <= 0 {
+		opts.History = DefaultTrafficProfileHistory
+	}
+
+	if opts.DeclineExpRatio <= 0 || opts.DeclineExpRatio > 1 {
+		opts.DeclineExpRatio = DefaultTrafficProfileDeclineExpRatio
+	}
+
+	if opts.SmoothSlots <= 0 {
+		opts.SmoothSlots = DefaultTrafficProfileSmoothSlots
+	}
+
+	location, err := loadLocation(opts.TimeZone)
+	if err != nil {
+		return nil, err
+	}
+
+	// slots are aligned in local time and loaded from store at a fixed interval,
+	// so every offset of time zone within history and the next year should be a multiple of slot
+	profile := &TrafficProfile{opts: opts, location: location}
+	for t := timeNow.Add(-profile.retention()); t.Before(timeNow.AddDate(1, 0, 0)); t = t.Add(24 * time.Hour) {
+		if _, offset := t.In(location).Zone(); (time.Duration(offset)*time.Second)%opts.Slot != 0 {
+			return nil, errors.New("traffic profile's slot should divide offsets of time zone")
+		}
+	}
+	return profile, nil
+}
+
+// number of slots of one cycle
+func (profile *TrafficProfile) slots() int {
+	return int(profile.opts.Cycle / profile.opts.Slot)
+}
+
+// how long requests of a slot are kept in store
+func (profile *TrafficProfile) retention() time.Duration {
+	return profile.opts.Cycle * time.Duration(profile.opts.History+1)
+}
+
+// count local requests arrived since last observation into the slot of last observation, called by heartbeat
+func (profile *TrafficProfile) observe(t time.Time, requests cluster_counter.CounterValue) {
+	profile.slotMu.Lock()
+	defer profile.slotMu.Unlock()
+
+	if profile.slotBegin.IsZero() == false {
+		profile.slotValue = profile.slotValue.Add(requests)
+	}
+	profile.rotate(t)
+}
+
+// finish slot before t, called with slotMu held
+func (profile *TrafficProfile) rotate(t time.Time) {
+	slotBegin := alignTime(t, profile.opts.Slot, profile.location)
+	if slotBegin.Equal(profile.slotBegin) {
+		return
+	}
+	if profile.slotValue.Count != 0 || profile.slotValue.Sum != 0 {
+		profile.finished = append(profile.finished, profileSlot{beginTime: profile.slotBegin, value: profile.slotValue})
+	}
+	profile.slotBegin = slotBegin
+	profile.slotValue = cluster_counter.CounterValue{}
+}
+
+// take local requests of slots finished before t
+func (profile *TrafficProfile) finishedSlots(t time.Time) []profileSlot {
+	profile.slotMu.Lock()
+	defer profile.slotMu.Unlock()
+
+	profile.rotate(t)
+	finished := profile.finished
+	profile.finished = nil
+	return finished
+}
+
+// begin of the cycle containing t
+func (profile *TrafficProfile) cycleBegin(t time.Time) time.Time {
+	return alignTime(t, profile.opts.Cycle, profile.location)
+}
+
+// build profile from requests of previous cycles before t, loaded by load
+// cycles without requests are skipped, e.g. before limiter is created
+func (profile *TrafficProfile) build(t time.Time,
+	load func(beginTime time.Time, interval time.Duration, n int) ([]float64, error)) error {
+	slots := profile.slots()
+	beginTime := profile.cycleBegin(t).Add(-time.Duration(profile.opts.History) * profile.opts.Cycle)
+	values, err := load(beginTime, profile.opts.Slot, slots*profile.opts.History)
+	if err != nil {
+		return err
+	}
+
+	// cycles of the same slot are averaged, recent ones weigh more
+	sums := make([]float64, slots)
+	var totalWeight float64
+	cycleWeight := 1.0
+	for cycle := profile.opts.History - 1; cycle >= 0; cycle-- {
+		cycleValues := values[cycle*slots : (cycle+1)*slots]
+		var cycleSum float64
+		for _, v := range cycleValues {
+			cycleSum += v
+		}
+		if cycleSum > 0 {
+			for i, v := range cycleValues {
+				sums[i] += v * cycleWeight
+			}
+			totalWeight += cycleWeight
+		}
+		cycleWeight *= profile.opts.DeclineExpRatio
+	}
+	if totalWeight == 0 {
+		return nil
+	}
+
+	// moving average over neighbouring slots, the cycle wraps around
+	weights := make([]float64, slots)
+	half := profile.opts.SmoothSlots / 2
+	for i := range weights {
+		var sum float64
+		for j := i - half; j < i-half+profile.opts.SmoothSlots; j++ {
+			sum += sums[((j%slots)+slots)%slots]
+		}
+		weights[i] = sum / float64(profile.opts.SmoothSlots) / totalWeight
+	}
+
+	shape := newSlotShape(profile.opts.Slot, weights, profile.location)
+	profile.mu.Lock()
+	profile.shape = shape
+	profile.mu.Unlock()
+	return nil
+}
+
+// whether profile is learned from history
+func (profile *TrafficProfile) Ready() bool {
+	profile.mu.RLock()
+	defer profile.mu.RUnlock()
+
+	return profile.shape != nil
+}
+
+// expected requests of each slot, empty if not ready
+func (profile *TrafficProfile) Weights() []float64 {
+	shape := profile.currentShape()
+	if shape == nil {
+		return []float64{}
+	}
+	return append([]float64{}, shape.weights...)
+}
+
+// expected requests within [beginTime, endTime), 0 if not ready
+func (profile *TrafficProfile) Requests(beginTime time.Time, endTime time.Time) float64 {
+	shape := profile.currentShape()
+	if shape == nil {
+		return 0
+	}
+	return shape.integral(beginTime, endTime)
+}
+
+// pacing follows profile, linear if not ready
+func (profile *TrafficProfile) Progress(beginTime time.Time, completionTime time.Time, t time.Time) float64 {
+	return profile.currentShape().progress(beginTime, completionTime, t)
+}
+
+// shape of last build, replaced as a whole so readers need no copy
+func (profile *TrafficProfile) currentShape() *slotShape {
+	profile.mu.RLock()
+	defer profile.mu.RUnlock()
+
+	return profile.shape
+}
@@ -0,0 +1,107 @@
+package cluster_limiter
+
+import (
+	"github.com/boostlearn/go-cluster-limiter/cluster_counter"
+	"github.com/boostlearn/go-cluster-limiter/cluster_counter/clocktest"
+	"github.com/boostlearn/go-cluster-limiter/cluster_counter/memory_store"
+	"math"
+	"testing"
+	"time"
+)
+
+func TestTrafficProfile_Build(t *testing.T) {
+	profile, err := newTrafficProfile(&TrafficProfileOpts{Slot: 6 * time.Hour, History: 3, SmoothSlots: 1}, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	beginTime := time.Date(2020, 1, 4, 0, 0, 0, 0, time.UTC)
+	history := []float64{
+		0, 0, 0, 0, // cycle without requests is skipped
+		1, 1, 1, 1,
+		0, 0, 4, 4,
+	}
+	err = profile.build(beginTime.Add(time.Hour), func(loadTime time.Time, interval time.Duration, n int) ([]float64, error) {
+		if loadTime != beginTime.Add(-72*time.Hour) || interval != 6*time.Hour || n != len(history) {
+			t.Fatal("history range error", loadTime, interval, n)
+		}
+		return history, nil
+	})
+	if err != nil || profile.Ready() == false {
+		t.Fatal("profile should be ready", err)
+	}
+
+	// the latest cycle weighs twice of the previous one
+	if weights := profile.Weights(); math.Abs(weights[0]-1.0/3) > 1e-9 || math.Abs(weights[2]-3) > 1e-9 {
+		t.Fatal("weights error", weights)
+	}
+	if p := profile.Progress(beginTime, beginTime.Add(24*time.Hour), beginTime.Add(18*time.Hour)); math.Abs(p-0.55) > 1e-6 {
+		t.Fatal("progress should follow profile", p)
+	}
+	if allocs := testing.AllocsPerRun(100, func() {
+		profile.Progress(beginTime, beginTime.Add(24*time.Hour), beginTime.Add(18*time.Hour))
+	}); allocs != 0 {
+		t.Fatal("progress should not copy weights", allocs)
+	}
+
+	if _, err := newTrafficProfile(&TrafficProfileOpts{Slot: 7 * time.Hour}, time.Now()); err == nil {
+		t.Fatal("cycle should be multiple of slot")
+	}
+
+	// offset of summer time is not a multiple of slot
+	timeNow := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	if _, err := newTrafficProfile(&TrafficProfileOpts{Slot: 2 * time.Hour, TimeZone: "Europe/London"}, timeNow); err == nil {
+		t.Fatal("slot should divide every offset of time zone")
+	}
+	if _, err := newTrafficProfile(&TrafficProfileOpts{Slot: time.Hour, TimeZone: "Europe/London"}, timeNow); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestClusterLimiter_TrafficProfile(t *testing.T) {
+	beginTime := time.Date(2020, 1, 3, 0, 0, 0, 0, time.UTC)
+	clock := clocktest.NewFakeClock(beginTime)
+	factory := NewFactory(&ClusterLimiterFactoryOpts{
+		Name: "test", Store: memory_store.NewStoreWithClock(clock), Clock: clock})
+	factory.Stop()
+
+	// requests of yesterday all arrived in the second half of day
+	profileOpts := &TrafficProfileOpts{Slot: 6 * time.Hour, History: 2, SmoothSlots: 1}
+	for i, requests := range []float64{0, 0, 1000, 1000} {
+		_ = factory.counterFactory.StoreHistory("testp:profile", nil,
+			beginTime.Add(time.Duration(i-4)*6*time.Hour), 72*time.Hour, cluster_counter.CounterValue{Sum: requests})
+	}
+
+	limiter, err := factory.NewClusterLimiter(&ClusterLimiterOpts{Name: "p", RewardTarget: 100,
+		PeriodInterval: 24 * time.Hour, TrafficProfile: profileOpts})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if limiter.TrafficProfile().Ready() == false {
+		t.Fatal("profile should be learned at startup")
+	}
+	if math.Abs(limiter.IdealPassRate()-0.05) > 1e-9 {
+		t.Fatal("pass rate prior should reach target with expected requests", limiter.IdealPassRate())
+	}
+
+	clock.Advance(12 * time.Hour)
+	if limiter.IdealReward() != 0 {
+		t.Fatal("pacing should follow profile", limiter.IdealReward())
+	}
+	clock.Advance(6 * time.Hour)
+	if math.Abs(limiter.IdealReward()-50) > 1e-9 {
+		t.Fatal("pacing should follow profile", limiter.IdealReward())
+	}
+
+	factory.Heartbeat()
+	for i := 0; i < 10; i++ {
+		limiter.Take(1)
+	}
+	clock.Advance(6 * time.Hour)
+	factory.Heartbeat()
+	values, err := factory.counterFactory.LoadHistory("testp:profile", nil,
+		beginTime.Add(18*time.Hour), 6*time.Hour, 72*time.Hour, 1)
+	if err != nil || values[0].Sum != 10 {
+		t.Fatal("requests of finished slot should be stored", values, err)
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"github.com/boostlearn/go-cluster-limiter/cluster_counter/http_store"
+	"github.com/boostlearn/go-cluster-limiter/cluster_counter/memory_store"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+var (
+	listenAddr string
+)
+
+func init() {
+	flag.StringVar(&listenAddr, "l", "0.0.0.0:20002", "listen address")
+}
+
+func main() {
+	flag.Parse()
+
+	store := memory_store.NewStore()
+
+	server := &http.Server{
+		Addr:         listenAddr,
+		Handler:      http_store.NewServer(store),
+		ReadTimeout:  5 * time.Second,
+		WriteTimeout: 5 * time.Second,
+	}
+
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+		<-signals
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_ = server.Shutdown(ctx)
+	}()
+
+	log.Println("counter store server listen on", listenAddr)
+	err := server.ListenAndServe()
+	if err != nil && err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+}
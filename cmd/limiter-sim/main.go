@@ -0,0 +1,171 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/boostlearn/go-cluster-limiter/cluster_limiter"
+	"github.com/boostlearn/go-cluster-limiter/simulator"
+	"io/ioutil"
+	"log"
+	"math"
+	"os"
+	"strconv"
+	"time"
+)
+
+var (
+	optionsFile string
+	nodes       int
+	duration    time.Duration
+	step        time.Duration
+	sample      time.Duration
+	seed        int64
+
+	trafficFile    string
+	trafficRate    float64
+	trafficWave    float64
+	rewardFile     string
+	rewardRate     float64
+	storeLatency   time.Duration
+	storeFailure   float64
+	rewardTarget   float64
+	periodInterval time.Duration
+
+	burstInterval          time.Duration
+	declineExpRatio        float64
+	maxBoostFactor         float64
+	updatePassRateMinCount int64
+	pacing                 string
+)
+
+func init() {
+	flag.StringVar(&optionsFile, "o", "", "limiter: options file in json, flags below override it")
+	flag.Float64Var(&rewardTarget, "target", 10000, "limiter: reward target")
+	flag.DurationVar(&periodInterval, "period", time.Hour, "limiter: period interval")
+	flag.DurationVar(&burstInterval, "burst", 0, "limiter: burst interval")
+	flag.Float64Var(&declineExpRatio, "decline", 0, "limiter: decline exp ratio")
+	flag.Float64Var(&maxBoostFactor, "boost", 0, "limiter: max boost factor")
+	flag.Int64Var(&updatePassRateMinCount, "min-count", 0, "limiter: update pass rate min count")
+	flag.StringVar(&pacing, "pacing", "linear", "limiter: pacing curve, linear, front-loaded or traffic-shape")
+
+	flag.IntVar(&nodes, "n", 4, "cluster: number of nodes")
+	flag.DurationVar(&storeLatency, "latency", 0, "store: latency")
+	flag.Float64Var(&storeFailure, "failure", 0, "store: failure rate")
+
+	flag.StringVar(&trafficFile, "t", "", "traffic: csv of seconds,requests per second")
+	flag.Float64Var(&trafficRate, "rate", 100, "traffic: requests per second if no csv")
+	flag.Float64Var(&trafficWave, "wave", 0.5, "traffic: relative amplitude of hourly sine wave if no csv")
+	flag.StringVar(&rewardFile, "r", "", "reward: csv of seconds,reward rate")
+	flag.Float64Var(&rewardRate, "reward", 0.5, "reward: reward rate if no csv")
+
+	flag.DurationVar(&duration, "d", 0, "simulation: duration, default is one period")
+	flag.DurationVar(&step, "step", 100*time.Millisecond, "simulation: heartbeat step")
+	flag.DurationVar(&sample, "sample", time.Minute, "simulation: sample interval")
+	flag.Int64Var(&seed, "seed", 1, "simulation: random seed")
+}
+
+func main() {
+	flag.Parse()
+
+	opts := &cluster_limiter.ClusterLimiterOpts{
+		RewardTarget:   rewardTarget,
+		PeriodInterval: periodInterval,
+	}
+	if len(optionsFile) > 0 {
+		fs, err := ioutil.ReadFile(optionsFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := json.Unmarshal(fs, opts); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if burstInterval > 0 {
+		opts.BurstInterval = burstInterval
+	}
+	if declineExpRatio > 0 {
+		opts.DeclineExpRatio = declineExpRatio
+	}
+	if maxBoostFactor > 0 {
+		opts.MaxBoostFactor = maxBoostFactor
+	}
+	if updatePassRateMinCount > 0 {
+		opts.UpdatePassRateMinCount = updatePassRateMinCount
+	}
+	switch pacing {
+	case "linear":
+	case "front-loaded":
+		opts.PacingCurve = cluster_limiter.FrontLoadedPacing{}
+	case "traffic-shape":
+		opts.PacingCurve = &cluster_limiter.TrafficShapePacing{}
+	default:
+		log.Fatal("unknown pacing curve: ", pacing)
+	}
+
+	var traffic simulator.Curve = simulator.CurveFunc(func(elapsed time.Duration) float64 {
+		return trafficRate * (1 + trafficWave*math.Sin(elapsed.Hours()*2*math.Pi))
+	})
+	if len(trafficFile) > 0 {
+		traffic = loadCurve(trafficFile)
+	}
+
+	reward := simulator.ConstantCurve(rewardRate)
+	if len(rewardFile) > 0 {
+		reward = loadCurve(rewardFile)
+	}
+
+	result, err := simulator.Run(&simulator.SimulatorOpts{
+		Limiter:          opts,
+		Nodes:            nodes,
+		Traffic:          traffic,
+		RewardRate:       reward,
+		StoreLatency:     storeLatency,
+		StoreFailureRate: storeFailure,
+		Duration:         duration,
+		Step:             step,
+		SampleInterval:   sample,
+		Seed:             seed,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	writer := csv.NewWriter(os.Stdout)
+	_ = writer.Write([]string{"seconds", "traffic", "requests", "passes", "rewards", "ideal_reward",
+		"pass_rate", "ideal_pass_rate"})
+	for _, s := range result.Samples {
+		_ = writer.Write([]string{
+			formatFloat(s.Elapsed.Seconds()), formatFloat(s.Traffic), formatFloat(s.Requests),
+			formatFloat(s.Passes), formatFloat(s.Rewards), formatFloat(s.IdealReward),
+			formatFloat(s.PassRate), formatFloat(s.IdealPassRate),
+		})
+	}
+	writer.Flush()
+
+	for _, period := range result.Periods {
+		fmt.Fprintf(os.Stderr, "period %v: requests %v passes %v rewards %v target %v error %.2f%%\n",
+			period.BeginTime.Format("2006-01-02 15:04:05"), period.Requests, period.Passes, period.Rewards,
+			period.Target, period.Error*100)
+	}
+	fmt.Fprintf(os.Stderr, "final error: %.2f%%\n", result.FinalError*100)
+}
+
+func loadCurve(path string) simulator.Curve {
+	file, err := os.Open(path)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer file.Close()
+
+	curve, err := simulator.LoadCurveCSV(file)
+	if err != nil {
+		log.Fatal(path, ": ", err)
+	}
+	return curve
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'f', 4, 64)
+}
@@ -0,0 +1,100 @@
+package simulator
+
+import (
+	"encoding/csv"
+	"errors"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// value changing over simulated time, e.g. requests per second or reward rate
+type Curve interface {
+	Value(elapsed time.Duration) float64
+}
+
+// curve of a function
+type CurveFunc func(elapsed time.Duration) float64
+
+func (f CurveFunc) Value(elapsed time.Duration) float64 {
+	return f(elapsed)
+}
+
+// curve of a constant value
+func ConstantCurve(v float64) Curve {
+	return CurveFunc(func(time.Duration) float64 { return v })
+}
+
+type curvePoint struct {
+	elapsed time.Duration
+	value   float64
+}
+
+// curve of points, linearly interpolated between points and flat outside them
+type PointsCurve struct {
+	points []curvePoint
+}
+
+func (curve *PointsCurve) Value(elapsed time.Duration) float64 {
+	points := curve.points
+	if len(points) == 0 {
+		return 0
+	}
+
+	i := sort.Search(len(points), func(i int) bool { return points[i].elapsed > elapsed })
+	if i == 0 {
+		return points[0].value
+	}
+	if i == len(points) {
+		return points[len(points)-1].value
+	}
+
+	prev, next := points[i-1], points[i]
+	ratio := float64(elapsed-prev.elapsed) / float64(next.elapsed-prev.elapsed)
+	return prev.value + (next.value-prev.value)*ratio
+}
+
+// load curve from csv lines of "seconds,value"; a header line is skipped
+func LoadCurveCSV(r io.Reader) (*PointsCurve, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.Comment = '#'
+
+	curve := &PointsCurve{}
+	for line := 1; ; line++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(record) < 2 {
+			return nil, errors.New("curve line " + strconv.Itoa(line) + ": need seconds and value")
+		}
+
+		seconds, err := strconv.ParseFloat(strings.TrimSpace(record[0]), 64)
+		if err != nil && line == 1 {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		value, err := strconv.ParseFloat(strings.TrimSpace(record[1]), 64)
+		if err != nil {
+			return nil, err
+		}
+		curve.points = append(curve.points, curvePoint{
+			elapsed: time.Duration(seconds * float64(time.Second)),
+			value:   value,
+		})
+	}
+
+	if len(curve.points) == 0 {
+		return nil, errors.New("empty curve")
+	}
+	sort.SliceStable(curve.points, func(i, j int) bool { return curve.points[i].elapsed < curve.points[j].elapsed })
+	return curve, nil
+}
@@ -0,0 +1,273 @@
+// offline simulation of limiters on simulated time, for tuning limiter's options
+package simulator
+
+import (
+	"errors"
+	"fmt"
+	"github.com/boostlearn/go-cluster-limiter/cluster_counter"
+	"github.com/boostlearn/go-cluster-limiter/cluster_counter/breaker_store"
+	"github.com/boostlearn/go-cluster-limiter/cluster_counter/clocktest"
+	"github.com/boostlearn/go-cluster-limiter/cluster_counter/memory_store"
+	"github.com/boostlearn/go-cluster-limiter/cluster_limiter"
+	"math/rand"
+	"time"
+)
+
+const DefaultStepMilliseconds = 100
+const DefaultSampleIntervalSeconds = 60
+const DefaultLimiterName = "sim"
+
+// start of simulated time, aligned to hours and days
+var DefaultStartTime = time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// options of one simulation
+type SimulatorOpts struct {
+	// options of the limiter on every node, copied for each node
+	Limiter *cluster_limiter.ClusterLimiterOpts
+
+	Nodes int
+	// share of traffic of each node, even if empty
+	NodeWeights []float64
+
+	// requests per second of the cluster
+	Traffic Curve
+	// probability of a passed request being rewarded, default is 1
+	RewardRate Curve
+
+	// delay before stored data is visible to other nodes
+	StoreLatency time.Duration
+	// probability of a store call failing
+	StoreFailureRate float64
+	// wrap store of each node with a circuit breaker driven by simulated time, none if not set
+	Breaker *breaker_store.BreakerStoreOpts
+
+	StartTime time.Time
+	// default is one period of the limiter
+	Duration time.Duration
+	// simulated time between heartbeats
+	Step           time.Duration
+	SampleInterval time.Duration
+	Seed           int64
+}
+
+// state of cluster at one moment, counts are totals within the current period
+type Sample struct {
+	Elapsed       time.Duration
+	Traffic       float64
+	Requests      float64
+	Passes        float64
+	Rewards       float64
+	IdealReward   float64
+	PassRate      float64
+	IdealPassRate float64
+}
+
+// result of one period of the limiter
+type PeriodResult struct {
+	BeginTime time.Time
+	Requests  float64
+	Passes    float64
+	Rewards   float64
+	Target    float64
+	// (Rewards - Target) / Target
+	Error float64
+}
+
+type Result struct {
+	Samples []*Sample
+	Periods []*PeriodResult
+	// error of the last period
+	FinalError float64
+}
+
+type node struct {
+	factory *cluster_limiter.ClusterLimiterFactory
+	limiter *cluster_limiter.ClusterLimiter
+	weight  float64
+	debt    float64
+}
+
+// run simulation, the same options and seed give the same result
+func Run(opts *SimulatorOpts) (*Result, error) {
+	if opts.Limiter == nil {
+		return nil, errors.New("limiter options not set")
+	}
+
+	// defaults are filled into copies, so that the same options can be run again
+	optsCopy := *opts
+	limiterOptsCopy := *opts.Limiter
+	optsCopy.Limiter = &limiterOptsCopy
+	opts = &optsCopy
+
+	if opts.Traffic == nil {
+		return nil, errors.New("traffic not set")
+	}
+
+	if opts.RewardRate == nil {
+		opts.RewardRate = ConstantCurve(1.0)
+	}
+
+	if opts.Nodes <= 0 {
+		opts.Nodes = 1
+	}
+
+	if len(opts.NodeWeights) > 0 && len(opts.NodeWeights) != opts.Nodes {
+		return nil, errors.New("node weights do not match nodes")
+	}
+
+	if opts.StartTime.IsZero() {
+		opts.StartTime = DefaultStartTime
+	}
+
+	if opts.Step == 0 {
+		opts.Step = time.Duration(DefaultStepMilliseconds) * time.Millisecond
+	}
+
+	if opts.SampleInterval == 0 {
+		opts.SampleInterval = time.Duration(DefaultSampleIntervalSeconds) * time.Second
+	}
+
+	if len(opts.Limiter.Name) == 0 {
+		opts.Limiter.Name = DefaultLimiterName
+	}
+
+	periodInterval := opts.Limiter.PeriodInterval.Truncate(time.Second)
+	if periodInterval == 0 {
+		if opts.Limiter.BeginTime.IsZero() {
+			opts.Limiter.BeginTime = opts.StartTime
+			opts.Limiter.EndTime = opts.StartTime.Add(opts.Duration)
+		}
+		if opts.Limiter.EndTime.After(opts.Limiter.BeginTime) == false {
+			return nil, errors.New("duration or limiter's end time not set")
+		}
+	}
+
+	if opts.Duration == 0 {
+		if periodInterval > 0 {
+			opts.Duration = periodInterval
+		} else {
+			opts.Duration = opts.Limiter.EndTime.Sub(opts.StartTime)
+		}
+	}
+
+	random := rand.New(rand.NewSource(opts.Seed))
+	clock := clocktest.NewFakeClock(opts.StartTime)
+	store := &simStore{
+		store:       memory_store.NewStoreWithClock(clock),
+		clock:       clock,
+		latency:     opts.StoreLatency,
+		failureRate: opts.StoreFailureRate,
+		seed:        opts.Seed,
+	}
+
+	var nodes []*node
+	var totalWeight float64
+	for i := 0; i < opts.Nodes; i++ {
+		var nodeDataStore cluster_counter.DataStoreI = &nodeStore{simStore: store, node: i}
+		if opts.Breaker != nil {
+			breakerOpts := *opts.Breaker
+			breakerOpts.Clock = clock
+			breakerStore, err := breaker_store.NewStore(nodeDataStore, &breakerOpts)
+			if err != nil {
+				return nil, err
+			}
+			nodeDataStore = breakerStore
+		}
+		factory := cluster_limiter.NewFactory(&cluster_limiter.ClusterLimiterFactoryOpts{
+			Name:              DefaultLimiterName,
+			HeartbeatInterval: opts.Step,
+			Store:             nodeDataStore,
+			Clock:             clock,
+			RandSource:        rand.NewSource(opts.Seed + int64(i) + 1),
+			NodeID:            fmt.Sprintf("node-%v", i),
+		})
+		// heartbeats are driven by the loop below, so background tickers must not run them concurrently
+		factory.Stop()
+		limiterOpts := *opts.Limiter
+		limiter, err := factory.NewClusterLimiter(&limiterOpts)
+		if err != nil {
+			return nil, err
+		}
+
+		weight := 1.0
+		if len(opts.NodeWeights) > 0 {
+			weight = opts.NodeWeights[i]
+		}
+		totalWeight += weight
+		nodes = append(nodes, &node{factory: factory, limiter: limiter, weight: weight})
+	}
+	if totalWeight <= 0 {
+		return nil, errors.New("node weights should be positive")
+	}
+
+	result := &Result{}
+	var period *PeriodResult
+	for elapsed := time.Duration(0); elapsed < opts.Duration; elapsed += opts.Step {
+		timeNow := clock.Now()
+		if period == nil || (periodInterval > 0 && timeNow.Truncate(periodInterval).After(period.BeginTime)) {
+			period = &PeriodResult{BeginTime: timeNow, Target: opts.Limiter.RewardTarget}
+			if periodInterval > 0 {
+				period.BeginTime = timeNow.Truncate(periodInterval)
+			}
+			result.Periods = append(result.Periods, period)
+		}
+
+		traffic := opts.Traffic.Value(elapsed)
+		rewardRate := opts.RewardRate.Value(elapsed)
+		for _, n := range nodes {
+			n.debt += traffic * opts.Step.Seconds() * n.weight / totalWeight
+			for ; n.debt >= 1.0; n.debt -= 1.0 {
+				period.Requests += 1
+				var passed bool
+				if opts.Limiter.TakeWithScore {
+					passed = n.limiter.TakeWithScore(1, random.Float64())
+				} else {
+					passed = n.limiter.Take(1)
+				}
+				if passed == false {
+					continue
+				}
+				period.Passes += 1
+				if random.Float64() < rewardRate {
+					n.limiter.Reward(1)
+					period.Rewards += 1
+				}
+			}
+		}
+
+		for _, n := range nodes {
+			n.factory.Heartbeat()
+		}
+
+		if elapsed%opts.SampleInterval == 0 {
+			result.Samples = append(result.Samples, sample(elapsed, traffic, period, nodes))
+		}
+		clock.Advance(opts.Step)
+	}
+
+	for _, period := range result.Periods {
+		if period.Target > 0 {
+			period.Error = (period.Rewards - period.Target) / period.Target
+		}
+	}
+	if len(result.Periods) > 0 {
+		result.FinalError = result.Periods[len(result.Periods)-1].Error
+	}
+	return result, nil
+}
+
+func sample(elapsed time.Duration, traffic float64, period *PeriodResult, nodes []*node) *Sample {
+	s := &Sample{
+		Elapsed:     elapsed,
+		Traffic:     traffic,
+		Requests:    period.Requests,
+		Passes:      period.Passes,
+		Rewards:     period.Rewards,
+		IdealReward: nodes[0].limiter.IdealReward(),
+	}
+	for _, n := range nodes {
+		s.PassRate += n.limiter.PassRate() / float64(len(nodes))
+		s.IdealPassRate += n.limiter.IdealPassRate() / float64(len(nodes))
+	}
+	return s
+}
@@ -0,0 +1,80 @@
+package simulator
+
+import (
+	"github.com/boostlearn/go-cluster-limiter/cluster_counter/breaker_store"
+	"github.com/boostlearn/go-cluster-limiter/cluster_limiter"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func simulatorOptsForTest() *SimulatorOpts {
+	return &SimulatorOpts{
+		Limiter: &cluster_limiter.ClusterLimiterOpts{
+			RewardTarget:   1000,
+			PeriodInterval: time.Hour,
+		},
+		Nodes: 3,
+		Traffic: CurveFunc(func(elapsed time.Duration) float64 {
+			return 20 + 10*math.Sin(elapsed.Hours()*2*math.Pi)
+		}),
+		RewardRate:       ConstantCurve(0.5),
+		StoreLatency:     time.Second,
+		StoreFailureRate: 0.01,
+		Seed:             1,
+	}
+}
+
+func TestRun(t *testing.T) {
+	result, err := Run(simulatorOptsForTest())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Periods) != 1 || len(result.Samples) != 60 {
+		t.Fatal("result size error", len(result.Periods), len(result.Samples))
+	}
+	if math.Abs(result.FinalError) > 0.1 {
+		t.Fatal("reward should be close to target", result.Periods[0])
+	}
+
+	// options are not changed by run
+	opts := simulatorOptsForTest()
+	again, _ := Run(opts)
+	if reflect.DeepEqual(result, again) == false {
+		t.Fatal("same seed should give same result")
+	}
+	if opts.Step != 0 || opts.StartTime.IsZero() == false || len(opts.Limiter.Name) > 0 {
+		t.Fatal("options should not be changed by run")
+	}
+}
+
+func TestLoadCurveCSV(t *testing.T) {
+	curve, err := LoadCurveCSV(strings.NewReader("seconds,rate\n0,10\n60,20\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if curve.Value(30*time.Second) != 15 || curve.Value(time.Hour) != 20 {
+		t.Fatal("curve value error", curve.Value(30*time.Second))
+	}
+}
+
+func TestRun_Breaker(t *testing.T) {
+	opts := simulatorOptsForTest()
+	opts.StoreFailureRate = 0.2
+	opts.Breaker = &breaker_store.BreakerStoreOpts{FailureThreshold: 1, OpenInterval: 5 * time.Second}
+	result, err := Run(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// breaker opens and closes on simulated time, so the run is repeatable
+	again, _ := Run(opts)
+	if reflect.DeepEqual(result, again) == false {
+		t.Fatal("same seed should give same result")
+	}
+	if opts.Breaker.Clock != nil {
+		t.Fatal("options should not be changed by run")
+	}
+}
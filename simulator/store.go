@@ -0,0 +1,116 @@
+package simulator
+
+import (
+	"errors"
+	"github.com/boostlearn/go-cluster-limiter/cluster_counter"
+	"hash/fnv"
+	"strconv"
+	"time"
+)
+
+var errStoreFailure = errors.New("simulated store failure")
+
+type pendingWrite struct {
+	applyTime time.Time
+	item      cluster_counter.StoreItem
+}
+
+// store shared by simulated nodes: writes become visible after latency, calls fail at failure rate.
+// only used within the simulation loop, so not locked
+type simStore struct {
+	store       cluster_counter.DataStoreI
+	clock       cluster_counter.Clock
+	latency     time.Duration
+	failureRate float64
+	seed        int64
+
+	pending []pendingWrite
+}
+
+// view of store for one node
+type nodeStore struct {
+	*simStore
+	node int
+}
+
+func (store *nodeStore) Store(name string, beginTime time.Time, endTime time.Time, lbs map[string]string,
+	value cluster_counter.CounterValue, force bool) error {
+	if store.fail("store", name) {
+		return errStoreFailure
+	}
+	return store.simStore.Store(name, beginTime, endTime, lbs, value, force)
+}
+
+func (store *nodeStore) Load(name string, beginTime time.Time, endTime time.Time, lbs map[string]string,
+) (cluster_counter.CounterValue, error) {
+	if store.fail("load", name) {
+		return cluster_counter.CounterValue{}, errStoreFailure
+	}
+	return store.simStore.Load(name, beginTime, endTime, lbs)
+}
+
+func (store *nodeStore) SetIfAbsent(name string, beginTime time.Time, endTime time.Time, lbs map[string]string,
+	value cluster_counter.CounterValue) (cluster_counter.CounterValue, error) {
+	if store.fail("set", name) {
+		return cluster_counter.CounterValue{}, errStoreFailure
+	}
+	return store.simStore.SetIfAbsent(name, beginTime, endTime, lbs, value)
+}
+
+// whether call fails, decided by the call itself rather than a shared random source,
+// so that the order of counters within heartbeat does not change the result
+func (store *nodeStore) fail(op string, name string) bool {
+	if store.failureRate <= 0 {
+		return false
+	}
+
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(op + "|" + name + "|" + strconv.Itoa(store.node) + "|" +
+		strconv.FormatInt(store.seed, 10) + "|" + strconv.FormatInt(store.clock.Now().UnixNano(), 10)))
+	return float64(h.Sum64()>>11)/float64(1<<53) < store.failureRate
+}
+
+func (store *simStore) Store(name string, beginTime time.Time, endTime time.Time, lbs map[string]string,
+	value cluster_counter.CounterValue, force bool) error {
+	if store.latency <= 0 {
+		return store.store.Store(name, beginTime, endTime, lbs, value, force)
+	}
+	store.pending = append(store.pending, pendingWrite{
+		applyTime: store.clock.Now().Add(store.latency),
+		item: cluster_counter.StoreItem{
+			StoreKey: cluster_counter.StoreKey{Name: name, BeginTime: beginTime, EndTime: endTime, Labels: lbs},
+			Value:    value,
+			Force:    force,
+		},
+	})
+	return nil
+}
+
+func (store *simStore) Load(name string, beginTime time.Time, endTime time.Time, lbs map[string]string,
+) (cluster_counter.CounterValue, error) {
+	store.apply()
+	return store.store.Load(name, beginTime, endTime, lbs)
+}
+
+// set value without latency, as it is read back by the caller
+func (store *simStore) SetIfAbsent(name string, beginTime time.Time, endTime time.Time, lbs map[string]string,
+	value cluster_counter.CounterValue) (cluster_counter.CounterValue, error) {
+	store.apply()
+	setStore, ok := store.store.(cluster_counter.SetIfAbsentDataStoreI)
+	if ok == false {
+		return cluster_counter.CounterValue{}, errors.New("store cannot set values if absent")
+	}
+	return setStore.SetIfAbsent(name, beginTime, endTime, lbs, value)
+}
+
+// apply writes whose latency passed
+func (store *simStore) apply() {
+	timeNow := store.clock.Now()
+	pos := 0
+	for pos < len(store.pending) && store.pending[pos].applyTime.After(timeNow) == false {
+		item := store.pending[pos].item
+		_ = store.store.Store(item.Name, item.BeginTime, item.EndTime, item.Labels, item.Value, item.Force)
+		pos++
+	}
+	store.pending = store.pending[pos:]
+}
@@ -2,7 +2,7 @@ package tests
 
 import (
 	"github.com/boostlearn/go-cluster-limiter/cluster_counter"
-	"github.com/boostlearn/go-cluster-limiter/cluster_counter/redis_store"
+	"github.com/boostlearn/go-cluster-limiter/cluster_counter/memory_store"
 	"github.com/boostlearn/go-cluster-limiter/cluster_limiter"
 	"log"
 	"math/rand"
@@ -15,10 +15,8 @@ var limiter *cluster_limiter.ClusterLimiter
 var scorelimiter *cluster_limiter.ClusterLimiter
 
 func init() {
-	counterStore, err := redis_store.NewStore("127.0.0.1:6379", "", "blcl:")
-	if err != nil {
-		log.Println("new store error:", err)
-	}
+	var err error
+	counterStore := memory_store.NewStore()
 
 	counterFactory := cluster_counter.NewFactory(
 		&cluster_counter.ClusterCounterFactoryOpts{